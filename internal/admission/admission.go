@@ -0,0 +1,112 @@
+package admission
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"kerberos/internal/ratelimit"
+)
+
+// Config for the admission controller.
+type Config struct {
+	MaxRate  float64          // Starting and maximum admission rate per service (req/s)
+	MinRate  float64          // Rate never drops below this
+	Increase float64          // Rate added per successful upstream response
+	Decrease float64          // Factor applied to the rate per upstream 503 (0 < Decrease < 1)
+	Now      func() time.Time // Optional clock, for tests
+}
+
+// DefaultConfig returns sensible defaults.
+func DefaultConfig() Config {
+	return Config{
+		MaxRate:  1000,
+		MinRate:  1,
+		Increase: 1,
+		Decrease: 0.5,
+	}
+}
+
+// Controller throttles inbound requests per service when its upstreams report
+// overload (503), adjusting each service's admission rate AIMD-style:
+// additive increase on success, multiplicative decrease on 503.
+type Controller struct {
+	cfg      Config
+	mu       sync.Mutex
+	services map[string]*ratelimit.Bucket
+}
+
+// New creates an admission controller. Zero or out-of-range fields of cfg
+// take their DefaultConfig values.
+func New(cfg Config) *Controller {
+	def := DefaultConfig()
+	if cfg.MaxRate <= 0 {
+		cfg.MaxRate = def.MaxRate
+	}
+	if cfg.MinRate <= 0 {
+		cfg.MinRate = math.Min(def.MinRate, cfg.MaxRate)
+	}
+	if cfg.Increase <= 0 {
+		cfg.Increase = def.Increase
+	}
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = def.Decrease
+	}
+	return &Controller{
+		cfg:      cfg,
+		services: make(map[string]*ratelimit.Bucket),
+	}
+}
+
+func (c *Controller) bucket(service string) *ratelimit.Bucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bucketLocked(service)
+}
+
+// bucketLocked returns the service's bucket, creating it at MaxRate.
+// Caller must hold c.mu.
+func (c *Controller) bucketLocked(service string) *ratelimit.Bucket {
+	b, ok := c.services[service]
+	if !ok {
+		b = ratelimit.NewBucket(c.cfg.MaxRate, burstFor(c.cfg.MaxRate), c.cfg.Now)
+		c.services[service] = b
+	}
+	return b
+}
+
+// Admit reports whether a request to service may proceed. When it may not,
+// it also returns how long until the next request would be admitted.
+func (c *Controller) Admit(service string) (bool, time.Duration) {
+	return c.bucket(service).Allow()
+}
+
+// Observe adjusts the service's admission rate from an upstream response
+// status: 503 backs off, other 5xx are ignored, anything else recovers.
+func (c *Controller) Observe(service string, status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.bucketLocked(service)
+	rate := b.Rate()
+	switch {
+	case status == http.StatusServiceUnavailable:
+		rate = math.Max(c.cfg.MinRate, rate*c.cfg.Decrease)
+	case status >= 500:
+		return
+	default:
+		rate = math.Min(c.cfg.MaxRate, rate+c.cfg.Increase)
+	}
+	b.SetLimit(rate, burstFor(rate))
+}
+
+// Rate returns the current admission rate for service in requests per second.
+func (c *Controller) Rate(service string) float64 {
+	return c.bucket(service).Rate()
+}
+
+// burstFor allows up to one second's worth of requests at once.
+func burstFor(rate float64) int {
+	return int(math.Max(1, math.Ceil(rate)))
+}
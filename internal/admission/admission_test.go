@@ -0,0 +1,81 @@
+package admission
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func admitted(c *Controller, service string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := c.Admit(service); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestController_ThrottlesOnSustained503sAndRecovers(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := New(Config{MaxRate: 100, MinRate: 2, Increase: 10, Decrease: 0.5, Now: func() time.Time { return now }})
+
+	if got := admitted(c, "reports", 50); got != 50 {
+		t.Fatalf("healthy service: expected all 50 admitted, got %d", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		c.Observe("reports", http.StatusServiceUnavailable)
+	}
+	if got := c.Rate("reports"); got != 2 {
+		t.Fatalf("expected rate to fall to the floor of 2, got %v", got)
+	}
+	now = now.Add(time.Second)
+	if got := admitted(c, "reports", 50); got != 2 {
+		t.Errorf("throttled service: expected 2 admitted in a second, got %d", got)
+	}
+	if got := admitted(c, "echo", 50); got != 50 {
+		t.Errorf("other services must not be throttled, got %d admitted", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Observe("reports", http.StatusOK)
+	}
+	if got := c.Rate("reports"); got != 100 {
+		t.Fatalf("expected rate to recover to 100, got %v", got)
+	}
+	now = now.Add(time.Second)
+	if got := admitted(c, "reports", 50); got != 50 {
+		t.Errorf("recovered service: expected all 50 admitted, got %d", got)
+	}
+}
+
+func TestController_ZeroConfigUsesDefaults(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := New(Config{Now: func() time.Time { return now }})
+
+	if got := admitted(c, "reports", 10); got != 10 {
+		t.Fatalf("expected requests to be admitted at the default rate, got %d of 10", got)
+	}
+	for i := 0; i < 100; i++ {
+		c.Observe("reports", http.StatusServiceUnavailable)
+	}
+	if got := c.Rate("reports"); got != DefaultConfig().MinRate {
+		t.Fatalf("expected the rate to fall to the default floor, got %v", got)
+	}
+	admitted(c, "reports", 10)
+	ok, wait := c.Admit("reports")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("expected a rejection with a wait of at most 1s, got %v %v", ok, wait)
+	}
+}
+
+func TestController_IgnoresOtherServerErrors(t *testing.T) {
+	c := New(Config{MaxRate: 100, MinRate: 1, Increase: 1, Decrease: 0.5})
+
+	c.Observe("echo", http.StatusServiceUnavailable)
+	c.Observe("echo", http.StatusInternalServerError)
+	if got := c.Rate("echo"); got != 50 {
+		t.Errorf("expected only the 503 to change the rate, got %v", got)
+	}
+}
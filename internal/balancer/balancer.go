@@ -3,12 +3,13 @@ package balancer
 import (
 	"hash/fnv"
 	"math/rand"
-	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"kerberos/internal/clientip"
+	"kerberos/internal/clock"
 	"kerberos/internal/registry"
 )
 
@@ -21,6 +22,15 @@ const (
 	WeightedRoundRobin Strategy = "weighted-round-robin"
 	WeightedRandom   Strategy = "weighted-random"
 	IPHash           Strategy = "ip-hash"
+	KeyHash          Strategy = "key-hash"
+	Failover         Strategy = "failover"
+	P2C              Strategy = "p2c"
+	WeightedP2C      Strategy = "weighted-p2c"
+	ConsistentHash   Strategy = "consistent-hash"
+	PowerOfTwoChoices Strategy = "p2c-ewma"
+	Maglev           Strategy = "maglev"
+	Custom           Strategy = "custom" // Selects with the Selector given to WithSelector
+	StickyCookie     Strategy = "sticky-cookie" // Follows the cookie set by WithStickyCookie
 )
 
 // Balancer selects service instances for forwarding.
@@ -28,51 +38,282 @@ type Balancer struct {
 	mu        sync.Mutex
 	indexes   map[string]*uint64
 	strategy  Strategy
-	registry  *registry.Registry
+	strategyOf func(serviceName string) (Strategy, bool) // per-service overrides of strategy
+	registry  registry.Store
 	rand      *rand.Rand
+	onSelect  SelectFunc
+	sink      MetricsSink
+	hashKey   func(*http.Request) string
+	loads     map[string]float64 // service/id -> last reported load, guarded by mu
+	priority  map[string]map[string]int // service -> instance ID -> rank
+	inflight  map[string]int            // service/id -> selections not yet Done, guarded by mu
+	rings     map[string]*ring          // service -> consistent hash ring, guarded by mu
+	maglevs   map[string]*maglevTable   // service -> Maglev lookup table, guarded by mu
+	maglevSize int
+	maxConcurrency int // default cap on requests in flight per instance, 0 for none
+	selector  Selector // for the Custom strategy
+	sticky    *StickyCookieConfig // for the StickyCookie strategy
+	slowStart time.Duration // ramp-up window for new instances, 0 to disable
+	latencies map[string]*peakEWMA      // service/id -> response time average, guarded by mu
+	outliers  map[string]*outlierState  // service/id -> outlier detection state, guarded by mu
+	outlier   *OutlierDetection         // nil without outlier detection
+	localZone string                    // preferred zone, "" without zone awareness
+	minLocal  int                       // local candidates needed to stay in localZone
+	clock     clock.Clock
+	clientIP  *clientip.Resolver
 }
 
-// New creates a load balancer using the given strategy and registry.
-func New(strategy Strategy, reg *registry.Registry) *Balancer {
-	return &Balancer{
-		indexes:  make(map[string]*uint64),
-		strategy: strategy,
-		registry: reg,
-		rand:     rand.New(rand.NewSource(rand.Int63())),
+// SelectFunc observes a selection: the candidates considered, the instance
+// chosen (nil if none), and the reason for the choice.
+type SelectFunc func(serviceName string, candidates []registry.Instance, chosen *registry.Instance, reason string)
+
+// Option configures a Balancer.
+type Option func(*Balancer)
+
+// WithOnSelect registers a callback invoked on every selection. Useful for
+// diagnosing why traffic lands where it does.
+func WithOnSelect(fn SelectFunc) Option {
+	return func(b *Balancer) {
+		b.onSelect = fn
+	}
+}
+
+// WithClock replaces the wall clock used to age latency averages, e.g. in
+// tests.
+func WithClock(c clock.Clock) Option {
+	return func(b *Balancer) {
+		b.clock = c
 	}
 }
 
+// WithClientIP sets how IPHash determines the client's IP. By default
+// forwarding headers are ignored and the connection's remote address is used.
+func WithClientIP(r *clientip.Resolver) Option {
+	return func(b *Balancer) {
+		b.clientIP = r
+	}
+}
+
+// WithStrategies gives some services their own strategy, e.g.
+// ConsistentHash for a cache while the rest use round-robin. Services not in
+// m use the strategy passed to New.
+func WithStrategies(m map[string]Strategy) Option {
+	return WithStrategyFunc(func(serviceName string) (Strategy, bool) {
+		s, ok := m[serviceName]
+		return s, ok
+	})
+}
+
+// WithStrategyFunc is like WithStrategies but asks fn for each service's
+// strategy; fn returns false to use the strategy passed to New.
+func WithStrategyFunc(fn func(serviceName string) (Strategy, bool)) Option {
+	return func(b *Balancer) {
+		b.strategyOf = fn
+	}
+}
+
+// strategyFor returns the strategy selecting among the service's instances.
+func (b *Balancer) strategyFor(serviceName string) Strategy {
+	if b.strategyOf != nil {
+		if s, ok := b.strategyOf(serviceName); ok {
+			return s
+		}
+	}
+	return b.strategy
+}
+
+// New creates a load balancer using the given strategy and registry, which
+// may be any registry.Store.
+func New(strategy Strategy, reg registry.Store, opts ...Option) *Balancer {
+	b := &Balancer{
+		indexes:   make(map[string]*uint64),
+		loads:     make(map[string]float64),
+		priority:  make(map[string]map[string]int),
+		inflight:  make(map[string]int),
+		rings:     make(map[string]*ring),
+		maglevs:   make(map[string]*maglevTable),
+		maglevSize: DefaultMaglevTableSize,
+		latencies: make(map[string]*peakEWMA),
+		outliers:  make(map[string]*outlierState),
+		strategy:  strategy,
+		registry:  reg,
+		rand:      rand.New(rand.NewSource(rand.Int63())),
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
 // Select returns the next instance for the given service.
 // req may be nil for strategies that don't need it (RoundRobin, Random, Weighted*).
 // For IPHash, req is used to extract client IP.
 func (b *Balancer) Select(serviceName string, req *http.Request) *registry.Instance {
+	return b.SelectMatching(serviceName, req, nil)
+}
+
+// SelectMatching is like Select but only considers instances for which match
+// returns true. A nil match considers every instance. Draining and unhealthy
+// instances are never selected, and ejected ones only if nothing else
+// matches. Instances at their concurrency cap are passed over. With
+// ZoneAware, instances in other zones are only considered when the local
+// zone has too few matching instances.
+func (b *Balancer) SelectMatching(serviceName string, req *http.Request, match func(registry.Instance) bool) *registry.Instance {
+	inst, _ := b.SelectMatchingReason(serviceName, req, match)
+	return inst
+}
+
+// SelectMatchingReason is like SelectMatching but also returns the reason for
+// the outcome, as passed to WithOnSelect: the deciding strategy, or why no
+// instance was selected, e.g. "no-instances", "draining" when every instance
+// is draining, "unhealthy", "no-match" or "at-capacity".
+func (b *Balancer) SelectMatchingReason(serviceName string, req *http.Request, match func(registry.Instance) bool) (*registry.Instance, string) {
 	instances := b.registry.GetInstances(serviceName)
 	if len(instances) == 0 {
-		return nil
+		b.trace(serviceName, nil, nil, "no-instances")
+		return nil, "no-instances"
+	}
+	instances = filter(instances, func(inst registry.Instance) bool { return !inst.Draining })
+	if len(instances) == 0 {
+		b.trace(serviceName, nil, nil, "draining")
+		return nil, "draining"
+	}
+	instances = filter(instances, func(inst registry.Instance) bool { return !inst.Unhealthy })
+	if len(instances) == 0 {
+		b.trace(serviceName, nil, nil, "unhealthy")
+		return nil, "unhealthy"
+	}
+	if match != nil {
+		instances = filter(instances, match)
+		if len(instances) == 0 {
+			b.trace(serviceName, nil, nil, "no-match")
+			return nil, "no-match"
+		}
+	}
+	instances = b.withoutEjected(serviceName, instances)
+
+	// A selection can lose the race for an instance's last slot to another;
+	// the instance is full then and the next round passes it over.
+	var candidates []registry.Instance
+	var inst *registry.Instance
+	var reason string
+	for {
+		candidates = b.withoutFull(serviceName, instances)
+		if len(candidates) == 0 {
+			b.trace(serviceName, nil, nil, "at-capacity")
+			return nil, "at-capacity"
+		}
+		candidates = b.preferLocalZone(candidates)
+		inst, reason = b.pick(serviceName, candidates, req)
+		if inst == nil || b.tryBegin(serviceName, inst) {
+			break
+		}
+	}
+	b.trace(serviceName, candidates, inst, reason)
+	if b.sink != nil && inst != nil {
+		b.sink.Selected(serviceName, *inst)
+	}
+	return inst, reason
+}
+
+// Done reports that the request sent to inst after a selection has completed.
+func (b *Balancer) Done(serviceName string, inst *registry.Instance) {
+	if inst != nil {
+		b.end(serviceName, inst)
+	}
+	if b.sink != nil && inst != nil {
+		b.sink.Done(serviceName, *inst)
 	}
+}
+
+// pick applies the configured strategy and reports which one decided.
+func (b *Balancer) pick(serviceName string, instances []registry.Instance, req *http.Request) (*registry.Instance, string) {
+	return b.pickWith(b.strategyFor(serviceName), serviceName, instances, req)
+}
 
-	switch b.strategy {
+// pickWith applies strategy and reports which one decided.
+func (b *Balancer) pickWith(strategy Strategy, serviceName string, instances []registry.Instance, req *http.Request) (*registry.Instance, string) {
+	switch strategy {
 	case RoundRobin:
-		return b.selectRoundRobin(serviceName, instances)
+		return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
 	case Random:
-		return b.selectRandom(instances)
+		return b.selectRandom(instances), string(Random)
 	case WeightedRoundRobin:
 		if hasValidWeights(instances) {
-			return b.selectWeightedRoundRobin(serviceName, instances)
+			return b.selectWeightedRoundRobin(serviceName, instances, b.weights(serviceName, instances)), string(WeightedRoundRobin)
 		}
-		return b.selectRoundRobin(serviceName, instances)
+		return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
 	case WeightedRandom:
 		if hasValidWeights(instances) {
-			return b.selectWeightedRandom(instances)
+			return b.selectWeightedRandom(instances, b.weights(serviceName, instances)), string(WeightedRandom)
 		}
-		return b.selectRandom(instances)
+		return b.selectRandom(instances), string(Random)
 	case IPHash:
-		return b.selectIPHash(instances, req)
+		return b.selectIPHash(instances, req), string(IPHash)
+	case Failover:
+		return b.selectFailover(serviceName, instances), string(Failover)
+	case P2C:
+		return b.selectP2C(serviceName, instances, nil), string(P2C)
+	case WeightedP2C:
+		if hasValidWeights(instances) {
+			return b.selectP2C(serviceName, instances, b.weights(serviceName, instances)), string(WeightedP2C)
+		}
+		return b.selectP2C(serviceName, instances, nil), string(P2C)
+	case PowerOfTwoChoices:
+		return b.selectPeakEWMA(serviceName, instances), string(PowerOfTwoChoices)
+	case ConsistentHash:
+		if key := b.requestKey(req); key != "" {
+			return b.selectConsistentHash(serviceName, instances, key), string(ConsistentHash)
+		}
+		return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
+	case Maglev:
+		if key := b.requestKey(req); key != "" {
+			return b.selectMaglev(serviceName, instances, key), string(Maglev)
+		}
+		return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
+	case KeyHash:
+		if key := b.requestKey(req); key != "" {
+			return &instances[hashIndex(key, len(instances))], string(KeyHash)
+		}
+		return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
+	case Custom:
+		if b.selector != nil {
+			return b.selector.Select(instances, req), string(Custom)
+		}
+		return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
+	case StickyCookie:
+		if b.sticky == nil {
+			return b.selectRoundRobin(serviceName, instances), string(RoundRobin)
+		}
+		if inst := b.stickyInstance(serviceName, instances, req); inst != nil {
+			return inst, string(StickyCookie)
+		}
+		return b.pickWith(b.sticky.Base, serviceName, instances, req)
 	default:
-		return &instances[0]
+		return &instances[0], "first"
 	}
 }
 
+func (b *Balancer) trace(serviceName string, candidates []registry.Instance, chosen *registry.Instance, reason string) {
+	if b.onSelect == nil {
+		return
+	}
+	b.onSelect(serviceName, candidates, chosen, reason)
+}
+
+// filter returns the instances match keeps in a new slice, leaving instances
+// as they are: the selection may filter the same instances again.
+func filter(instances []registry.Instance, match func(registry.Instance) bool) []registry.Instance {
+	kept := make([]registry.Instance, 0, len(instances))
+	for _, inst := range instances {
+		if match(inst) {
+			kept = append(kept, inst)
+		}
+	}
+	return kept
+}
+
 func hasValidWeights(instances []registry.Instance) bool {
 	for _, inst := range instances {
 		if inst.Weight < 1 {
@@ -104,10 +345,10 @@ func (b *Balancer) selectRandom(instances []registry.Instance) *registry.Instanc
 	return &instances[i]
 }
 
-func (b *Balancer) selectWeightedRoundRobin(serviceName string, instances []registry.Instance) *registry.Instance {
+func (b *Balancer) selectWeightedRoundRobin(serviceName string, instances []registry.Instance, weights []int) *registry.Instance {
 	total := 0
-	for _, inst := range instances {
-		total += inst.Weight
+	for _, w := range weights {
+		total += w
 	}
 	if total <= 0 {
 		return &instances[0]
@@ -125,7 +366,7 @@ func (b *Balancer) selectWeightedRoundRobin(serviceName string, instances []regi
 
 	slot := int((n - 1) % uint64(total))
 	for i := range instances {
-		slot -= instances[i].Weight
+		slot -= weights[i]
 		if slot < 0 {
 			return &instances[i]
 		}
@@ -133,10 +374,10 @@ func (b *Balancer) selectWeightedRoundRobin(serviceName string, instances []regi
 	return &instances[len(instances)-1]
 }
 
-func (b *Balancer) selectWeightedRandom(instances []registry.Instance) *registry.Instance {
+func (b *Balancer) selectWeightedRandom(instances []registry.Instance, weights []int) *registry.Instance {
 	total := 0
-	for _, inst := range instances {
-		total += inst.Weight
+	for _, w := range weights {
+		total += w
 	}
 	if total <= 0 {
 		return &instances[0]
@@ -145,7 +386,7 @@ func (b *Balancer) selectWeightedRandom(instances []registry.Instance) *registry
 	r := b.rand.Intn(total)
 	b.mu.Unlock()
 	for i := range instances {
-		r -= instances[i].Weight
+		r -= weights[i]
 		if r < 0 {
 			return &instances[i]
 		}
@@ -154,41 +395,12 @@ func (b *Balancer) selectWeightedRandom(instances []registry.Instance) *registry
 }
 
 func (b *Balancer) selectIPHash(instances []registry.Instance, req *http.Request) *registry.Instance {
-	ip := clientIP(req)
-	h := fnv.New32a()
-	h.Write([]byte(ip))
-	hash := h.Sum32()
-	i := int(hash % uint32(len(instances)))
-	if i < 0 {
-		i = -i
-	}
-	return &instances[i]
+	return &instances[hashIndex(b.clientIP.FromRequest(req), len(instances))]
 }
 
-func clientIP(req *http.Request) string {
-	if req == nil {
-		return ""
-	}
-	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
-		// X-Forwarded-For: client, proxy1, proxy2 — take first (original client)
-		if idx := strings.Index(xff, ","); idx >= 0 {
-			xff = xff[:idx]
-		}
-		return trimIP(xff)
-	}
-	host, _, _ := net.SplitHostPort(req.RemoteAddr)
-	if host != "" {
-		return host
-	}
-	return req.RemoteAddr
-}
-
-func trimIP(s string) string {
-	for len(s) > 0 && (s[0] == ' ' || s[0] == '\t') {
-		s = s[1:]
-	}
-	for len(s) > 0 && (s[len(s)-1] == ' ' || s[len(s)-1] == '\t') {
-		s = s[:len(s)-1]
-	}
-	return s
+// hashIndex maps key onto one of n slots.
+func hashIndex(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
 }
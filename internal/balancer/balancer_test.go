@@ -1,10 +1,17 @@
 package balancer
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"kerberos/internal/clock"
 	"kerberos/internal/registry"
 )
 
@@ -146,3 +153,618 @@ func TestBalancer_Select_IPHash(t *testing.T) {
 		}
 	}
 }
+
+func TestBalancer_OnSelect_ReportsChoiceAndReason(t *testing.T) {
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "a", Addr: "http://a"})
+	r.Register("echo", registry.Instance{ID: "b", Addr: "http://b"})
+
+	type call struct {
+		service    string
+		candidates int
+		chosen     string
+		reason     string
+	}
+	var calls []call
+	b := New(WeightedRoundRobin, r, WithOnSelect(func(service string, candidates []registry.Instance, chosen *registry.Instance, reason string) {
+		c := call{service: service, candidates: len(candidates), reason: reason}
+		if chosen != nil {
+			c.chosen = chosen.ID
+		}
+		calls = append(calls, c)
+	}))
+
+	b.Select("echo", nil)
+	b.Select("missing", nil)
+
+	want := []call{
+		{service: "echo", candidates: 2, chosen: "a", reason: "round-robin"}, // no weights: falls back
+		{service: "missing", candidates: 0, chosen: "", reason: "no-instances"},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("expected %d callbacks, got %d: %v", len(want), len(calls), calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("callback %d: want %+v, got %+v", i, want[i], calls[i])
+		}
+	}
+}
+
+func TestBalancer_MetricsSink_CountsSelectionsAndInFlight(t *testing.T) {
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "a", Addr: "http://a"})
+	r.Register("echo", registry.Instance{ID: "b", Addr: "http://b"})
+	r.Register("echo", registry.Instance{ID: "c", Addr: "http://c"})
+
+	sink := NewCounters()
+	b := New(RoundRobin, r, WithMetricsSink(sink))
+
+	// Two full round-robin cycles; complete all but the last selection.
+	var last *registry.Instance
+	for i := 0; i < 6; i++ {
+		last = b.Select("echo", nil)
+		if i < 5 {
+			b.Done("echo", last)
+		}
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if got := sink.Selections("echo", id); got != 2 {
+			t.Errorf("instance %s: want 2 selections, got %d", id, got)
+		}
+	}
+	if got := sink.InFlight("echo", last.ID); got != 1 {
+		t.Errorf("instance %s: want 1 in flight, got %d", last.ID, got)
+	}
+	if got := sink.InFlight("echo", "a"); got != 0 {
+		t.Errorf("instance a: want 0 in flight, got %d", got)
+	}
+}
+
+func TestBalancer_Select_KeyHash(t *testing.T) {
+	r := registry.New()
+	r.Register("orders", registry.Instance{ID: "a", Addr: "http://a"})
+	r.Register("orders", registry.Instance{ID: "b", Addr: "http://b"})
+	r.Register("orders", registry.Instance{ID: "c", Addr: "http://c"})
+	b := New(KeyHash, r, WithHashKey(PathSegmentKey(1)))
+
+	byKey := make(map[string]string)
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("order-%d", i)
+		for j := 0; j < 3; j++ {
+			req := httptest.NewRequest(http.MethodPut, "/orders/"+key+"/items", nil)
+			inst := b.Select("orders", req)
+			if inst == nil {
+				t.Fatalf("Select %s: got nil", key)
+			}
+			if prev, ok := byKey[key]; ok && prev != inst.ID {
+				t.Fatalf("key %s moved from %s to %s", key, prev, inst.ID)
+			}
+			byKey[key] = inst.ID
+			seen[inst.ID] = true
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected keys spread across all 3 instances, saw %v", seen)
+	}
+}
+
+func TestBalancer_Select_KeyHash_JSONField(t *testing.T) {
+	r := registry.New()
+	r.Register("orders", registry.Instance{ID: "a", Addr: "http://a"})
+	r.Register("orders", registry.Instance{ID: "b", Addr: "http://b"})
+	b := New(KeyHash, r, WithHashKey(JSONFieldKey("order_id", 64)))
+
+	newReq := func(body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	}
+	first := b.Select("orders", newReq(`{"order_id":"42","qty":1}`))
+	again := newReq(`{"qty":7,"order_id":"42"}`)
+	second := b.Select("orders", again)
+	if first == nil || second == nil || first.ID != second.ID {
+		t.Errorf("same order_id should map to the same instance, got %v and %v", first, second)
+	}
+
+	body, _ := io.ReadAll(again.Body)
+	if string(body) != `{"qty":7,"order_id":"42"}` {
+		t.Errorf("body must be restored for forwarding, got %q", string(body))
+	}
+
+	// Bodies over the limit give no key but are forwarded whole, whether
+	// their length is declared or not.
+	large := `{"order_id":"42","note":"` + strings.Repeat("x", 100) + `"}`
+	key := JSONFieldKey("order_id", 64)
+	for _, length := range []int64{int64(len(large)), -1} {
+		req := newReq(large)
+		req.ContentLength = length
+		if got := key(req); got != "" {
+			t.Errorf("length %d: expected no key for a body over the limit, got %q", length, got)
+		}
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != large {
+			t.Errorf("length %d: body must be forwarded whole, got %q", length, string(body))
+		}
+	}
+}
+
+func TestBalancer_Select_FailoverFollowsPriority(t *testing.T) {
+	r := registry.New()
+	r.Register("db", registry.Instance{ID: "replica-2", Addr: "http://r2"})
+	r.Register("db", registry.Instance{ID: "primary", Addr: "http://p"})
+	r.Register("db", registry.Instance{ID: "replica-1", Addr: "http://r1"})
+	r.Register("db", registry.Instance{ID: "unlisted", Addr: "http://u"})
+	b := New(Failover, r, WithPriority("db", "primary", "replica-1", "replica-2"))
+
+	expectAll := func(want string) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if inst := b.Select("db", nil); inst == nil || inst.ID != want {
+				t.Fatalf("want %s, got %v", want, inst)
+			}
+		}
+	}
+
+	expectAll("primary")
+	r.Unregister("db", "primary")
+	expectAll("replica-1")
+	r.Unregister("db", "replica-1")
+	expectAll("replica-2")
+	r.Unregister("db", "replica-2")
+	expectAll("unlisted")
+
+	r.Register("db", registry.Instance{ID: "primary", Addr: "http://p"})
+	expectAll("primary")
+}
+
+func TestBalancer_ReportLoad_IgnoresNonFinite(t *testing.T) {
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: "http://a", Weight: 2})
+	b := New(WeightedRoundRobin, r)
+
+	b.ReportLoad("svc", "a", 0.5)
+	for _, load := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		b.ReportLoad("svc", "a", load)
+		if w := b.weights("svc", r.GetInstances("svc")); w[0] != 100 {
+			t.Errorf("load %v: expected the last finite load to stay in effect (weight 100), got %d", load, w[0])
+		}
+	}
+}
+
+func TestBalancer_RunPruner_ForgetsUnregistered(t *testing.T) {
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: "http://a"})
+	r.Register("svc", registry.Instance{ID: "b", Addr: "http://b"})
+	b := New(WeightedRoundRobin, r)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		b.RunPruner(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	b.ReportLoad("svc", "a", 0.5)
+	b.ReportLoad("svc", "b", 0.5)
+	b.ReportLatency("svc", "a", time.Millisecond)
+	// RunPruner may not have subscribed yet; unregister until it has acted.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.Unregister("svc", "a")
+		b.mu.Lock()
+		_, load := b.loads["svc/a"]
+		_, latency := b.latencies["svc/a"]
+		_, other := b.loads["svc/b"]
+		b.mu.Unlock()
+		if !load && !latency {
+			if !other {
+				t.Error("expected the load of the registered instance to be kept")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the unregistered instance's state to be forgotten")
+		}
+		r.Register("svc", registry.Instance{ID: "a", Addr: "http://a"})
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBalancer_Select_WeightedP2C_RespectsCapacityAndLoad(t *testing.T) {
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "big", Addr: "http://a", Weight: 8})
+	r.Register("svc", registry.Instance{ID: "small-1", Addr: "http://b", Weight: 1})
+	r.Register("svc", registry.Instance{ID: "small-2", Addr: "http://c", Weight: 1})
+
+	// Requests are never completed, so in-flight counts only grow.
+	share := func(strategy Strategy) map[string]int {
+		b := New(strategy, r)
+		counts := map[string]int{}
+		for i := 0; i < 100; i++ {
+			counts[b.Select("svc", nil).ID]++
+		}
+		return counts
+	}
+
+	plain := share(P2C)
+	if plain["big"] > 40 {
+		t.Errorf("p2c: expected in-flight to even out regardless of weight, got %v", plain)
+	}
+	weighted := share(WeightedP2C)
+	if weighted["big"] < 70 {
+		t.Errorf("weighted-p2c: expected the big instance to carry ~80%%, got %v", weighted)
+	}
+
+	// Load dominates capacity: a big instance already saturated loses out.
+	b := New(WeightedP2C, r)
+	big := &registry.Instance{ID: "big"}
+	for i := 0; i < 80; i++ {
+		b.tryBegin("svc", big)
+	}
+	for i := 0; i < 10; i++ {
+		if inst := b.Select("svc", nil); inst.ID == "big" {
+			t.Fatalf("selection %d: expected the saturated big instance to be avoided", i)
+		}
+	}
+	for i := 0; i < 80; i++ {
+		b.Done("svc", big)
+	}
+	picked := false
+	for i := 0; i < 10; i++ {
+		picked = picked || b.Select("svc", nil).ID == "big"
+	}
+	if !picked {
+		t.Error("expected the big instance to be used again once its requests completed")
+	}
+}
+
+func TestBalancer_Select_ConsistentHash_StableAcrossChurn(t *testing.T) {
+	r := registry.New()
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("cache-%d", i)
+		r.Register("cache", registry.Instance{ID: id, Addr: "http://" + id})
+	}
+	b := New(ConsistentHash, r, WithHashKey(HeaderKey("X-Cache-Key")))
+
+	const keys = 2000
+	assign := func() map[string]string {
+		owners := make(map[string]string, keys)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Cache-Key", key)
+			owners[key] = b.Select("cache", req).ID
+		}
+		return owners
+	}
+
+	before := assign()
+	if again := assign(); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("expected the same key to map to the same instance")
+	}
+	perInstance := map[string]int{}
+	for _, id := range before {
+		perInstance[id]++
+	}
+	for id, n := range perInstance {
+		if n < keys/10/2 || n > keys/10*2 {
+			t.Errorf("%s owns %d of %d keys; expected roughly 1/10", id, n, keys)
+		}
+	}
+
+	// Removing an instance only remaps the keys it owned.
+	r.Unregister("cache", "cache-3")
+	removed := assign()
+	for key, id := range before {
+		if id != "cache-3" && removed[key] != id {
+			t.Fatalf("key %s moved from %s to %s although its owner stayed", key, id, removed[key])
+		}
+	}
+
+	// Adding an instance only moves keys to the new instance, about 1/N.
+	r.Register("cache", registry.Instance{ID: "cache-10", Addr: "http://cache-10"})
+	added := assign()
+	moved := 0
+	for key, id := range removed {
+		if added[key] != id {
+			if added[key] != "cache-10" {
+				t.Fatalf("key %s moved from %s to %s instead of the new instance", key, id, added[key])
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > keys*2/10 {
+		t.Errorf("expected about 1/10 of keys to move to the new instance, %d of %d did", moved, keys)
+	}
+}
+
+func TestBalancer_ZoneAware(t *testing.T) {
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "a1", Addr: "http://a1", Zone: "zone-a"})
+	r.Register("echo", registry.Instance{ID: "a2", Addr: "http://a2", Zone: "zone-a"})
+	r.Register("echo", registry.Instance{ID: "b1", Addr: "http://b1", Zone: "zone-b"})
+	r.Register("echo", registry.Instance{ID: "b2", Addr: "http://b2", Zone: "zone-b"})
+	b := New(RoundRobin, r, ZoneAware("zone-a", 2))
+
+	// selectZones makes n selections among the instances matching and
+	// returns how many landed in each zone.
+	selectZones := func(n int, match func(registry.Instance) bool) map[string]int {
+		t.Helper()
+		zones := make(map[string]int)
+		for i := 0; i < n; i++ {
+			inst := b.SelectMatching("echo", nil, match)
+			if inst == nil {
+				t.Fatalf("Select %d: got nil", i)
+			}
+			zones[inst.Zone]++
+		}
+		return zones
+	}
+
+	if zones := selectZones(10, nil); zones["zone-a"] != 10 {
+		t.Errorf("expected all traffic to stay in the local zone, got %v", zones)
+	}
+	// With one local instance ruled out the local zone is below its minimum
+	// of 2, so traffic spills over to the other zone too.
+	if zones := selectZones(9, func(inst registry.Instance) bool { return inst.ID != "a1" }); zones["zone-a"] != 3 || zones["zone-b"] != 6 {
+		t.Errorf("expected traffic spread over all zones, got %v", zones)
+	}
+
+	r.Unregister("echo", "a1")
+	r.Unregister("echo", "a2")
+	if zones := selectZones(10, nil); zones["zone-b"] != 10 {
+		t.Errorf("expected failover to the other zone, got %v", zones)
+	}
+}
+
+func TestBalancer_Select_Maglev(t *testing.T) {
+	r := registry.New()
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("session-%d", i)
+		r.Register("sessions", registry.Instance{ID: id, Addr: "http://" + id})
+	}
+	b := New(Maglev, r, WithHashKey(HeaderKey("X-Session")), WithMaglevTableSize(5000))
+
+	const keys = 20000
+	assign := func() map[string]string {
+		owners := make(map[string]string, keys)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Session", key)
+			owners[key] = b.Select("sessions", req).ID
+		}
+		return owners
+	}
+
+	before := assign()
+	if again := assign(); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("expected the same key to map to the same instance")
+	}
+	perInstance := map[string]int{}
+	for _, id := range before {
+		perInstance[id]++
+	}
+	for id, n := range perInstance {
+		if n < keys/10*85/100 || n > keys/10*115/100 {
+			t.Errorf("%s owns %d of %d keys; expected within 15%% of 1/10", id, n, keys)
+		}
+	}
+
+	// Removing an instance remaps its own keys and only a few others.
+	r.Unregister("sessions", "session-3")
+	after := assign()
+	moved := 0
+	for key, id := range before {
+		if id != "session-3" && after[key] != id {
+			moved++
+		}
+	}
+	if moved > keys*3/100 {
+		t.Errorf("expected under 3%% of keys of remaining instances to move, %d of %d did", moved, keys)
+	}
+}
+
+func TestBalancer_Select_HashStrategiesSkipExcluded(t *testing.T) {
+	for _, strategy := range []Strategy{ConsistentHash, Maglev} {
+		t.Run(string(strategy), func(t *testing.T) {
+			r := registry.New()
+			for i := 0; i < 5; i++ {
+				id := fmt.Sprintf("cache-%d", i)
+				r.Register("cache", registry.Instance{ID: id, Addr: "http://" + id})
+			}
+			b := New(strategy, r, WithHashKey(HeaderKey("X-Key")), WithMaglevTableSize(1000))
+
+			const keys = 500
+			assign := func(match func(registry.Instance) bool) map[string]string {
+				owners := make(map[string]string, keys)
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("key-%d", i)
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.Header.Set("X-Key", key)
+					owners[key] = b.SelectMatching("cache", req, match).ID
+				}
+				return owners
+			}
+			table := func() any {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				if strategy == Maglev {
+					return b.maglevs["cache"]
+				}
+				return b.rings["cache"]
+			}
+
+			all := assign(nil)
+			built := table()
+			filtered := assign(func(inst registry.Instance) bool { return inst.ID != "cache-2" })
+			if table() != built {
+				t.Error("expected excluding an instance not to rebuild the table")
+			}
+			for key, id := range all {
+				switch {
+				case filtered[key] == "cache-2":
+					t.Fatalf("key %s went to the excluded instance", key)
+				case id != "cache-2" && filtered[key] != id:
+					t.Fatalf("key %s moved from %s to %s although its owner was not excluded", key, id, filtered[key])
+				}
+			}
+			if again := assign(nil); fmt.Sprint(again) != fmt.Sprint(all) {
+				t.Error("expected keys to return to the excluded instance once it is a candidate again")
+			}
+		})
+	}
+}
+
+func TestBalancer_WithStrategies_PerService(t *testing.T) {
+	r := registry.New()
+	for _, id := range []string{"a", "b", "c"} {
+		r.Register("api", registry.Instance{ID: id, Addr: "http://api-" + id})
+		r.Register("cache", registry.Instance{ID: id, Addr: "http://cache-" + id})
+	}
+	var reasons []string
+	b := New(RoundRobin, r,
+		WithHashKey(HeaderKey("X-Cache-Key")),
+		WithStrategies(map[string]Strategy{"cache": ConsistentHash}),
+		WithOnSelect(func(serviceName string, _ []registry.Instance, _ *registry.Instance, reason string) {
+			reasons = append(reasons, serviceName+":"+reason)
+		}),
+	)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Cache-Key", "user-42")
+
+	var api []string
+	cached := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		api = append(api, b.Select("api", req).ID)
+		cached[b.Select("cache", req).ID] = true
+	}
+	if got := strings.Join(api, ""); got != "abcabc" {
+		t.Errorf("api: expected round-robin order abcabc, got %s", got)
+	}
+	if len(cached) != 1 {
+		t.Errorf("cache: expected one key to stick to one instance, got %v", cached)
+	}
+	if reasons[0] != "api:round-robin" || reasons[1] != "cache:consistent-hash" {
+		t.Errorf("expected each service's own strategy to decide, got %v", reasons[:2])
+	}
+}
+
+func TestBalancer_SlowStart_RampsUpNewInstance(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1000, 0))
+	r := registry.New(registry.WithClock(clk))
+	r.Register("echo", registry.Instance{ID: "old", Addr: "http://old", Weight: 10})
+	clk.Advance(time.Hour)
+	r.Register("echo", registry.Instance{ID: "new", Addr: "http://new", Weight: 10})
+	b := New(WeightedRoundRobin, r, WithClock(clk), WithSlowStart(time.Minute))
+
+	// share returns the new instance's share of n selections, n being a
+	// multiple of the total effective weight so round-robin is exact.
+	share := func(n int) float64 {
+		got := 0
+		for i := 0; i < n; i++ {
+			if b.Select("echo", nil).ID == "new" {
+				got++
+			}
+		}
+		return float64(got) / float64(n)
+	}
+
+	if got := share(1100); got != 1.0/11 {
+		t.Errorf("just registered: expected a tenth of the old instance's traffic (1/11), got %.3f", got)
+	}
+	clk.Advance(30 * time.Second)
+	if got := share(1500); got != 1.0/3 {
+		t.Errorf("halfway through the window: expected half the old instance's traffic (1/3), got %.3f", got)
+	}
+	clk.Advance(30 * time.Second)
+	if got := share(2000); got != 0.5 {
+		t.Errorf("after the window: expected a full share, got %.3f", got)
+	}
+}
+
+// lastIDSelector picks the instance whose ID sorts last.
+type lastIDSelector struct{}
+
+func (lastIDSelector) Select(instances []registry.Instance, _ *http.Request) *registry.Instance {
+	last := &instances[0]
+	for i := range instances {
+		if instances[i].ID > last.ID {
+			last = &instances[i]
+		}
+	}
+	return last
+}
+
+func TestBalancer_SelectMatching_LostSlotKeepsCandidates(t *testing.T) {
+	r := registry.New()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		r.Register("svc", registry.Instance{ID: id, Addr: "http://" + id, MaxConcurrency: 1})
+	}
+	var b *Balancer
+	var rounds []string
+	b = New(RoundRobin, r, WithSelector(SelectorFunc(func(instances []registry.Instance, _ *http.Request) *registry.Instance {
+		ids := make([]string, len(instances))
+		for i, inst := range instances {
+			ids[i] = inst.ID
+		}
+		rounds = append(rounds, strings.Join(ids, ","))
+		inst := &instances[0]
+		if len(rounds) <= 2 {
+			// Another selection takes the instance's only slot first.
+			b.tryBegin("svc", inst)
+		}
+		return inst
+	})))
+
+	inst := b.Select("svc", nil)
+	if inst == nil {
+		t.Fatal("expected an instance once the selection stopped losing slots")
+	}
+	want := []string{"a,b,c,d", "b,c,d", "c,d"}
+	if strings.Join(rounds, " ") != strings.Join(want, " ") {
+		t.Errorf("expected each round to pass over just the instances filled so far, got candidates %q, want %q", rounds, want)
+	}
+	if inst.ID != "c" {
+		t.Errorf("expected c, the first instance left, got %s", inst.ID)
+	}
+}
+
+func TestBalancer_WithSelector(t *testing.T) {
+	r := registry.New()
+	for _, id := range []string{"b", "d", "a", "c"} {
+		r.Register("api", registry.Instance{ID: id, Addr: "http://api-" + id})
+		r.Register("web", registry.Instance{ID: id, Addr: "http://web-" + id})
+	}
+	var reason string
+	b := New(RoundRobin, r,
+		WithSelector(lastIDSelector{}),
+		WithStrategies(map[string]Strategy{"web": RoundRobin}),
+		WithOnSelect(func(_ string, _ []registry.Instance, _ *registry.Instance, r string) { reason = r }),
+	)
+
+	for i := 0; i < 3; i++ {
+		if got := b.Select("api", nil).ID; got != "d" {
+			t.Fatalf("expected the selector to pick d, got %s", got)
+		}
+	}
+	if reason != string(Custom) {
+		t.Errorf("expected reason %q, got %q", Custom, reason)
+	}
+	// Candidates ruled out before selection never reach the selector.
+	if got := b.SelectMatching("api", nil, func(inst registry.Instance) bool { return inst.ID != "d" }).ID; got != "c" {
+		t.Errorf("expected c once d is ruled out, got %s", got)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[b.Select("web", nil).ID] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("expected web to keep round-robin, got %v", seen)
+	}
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import "kerberos/internal/registry"
+
+// WithMaxConcurrency caps the requests in flight to each instance at n,
+// counted from selection until Done, so a backend with limited capacity is
+// not overrun. Instances at the cap are passed over; when every candidate
+// is, Select returns nil. An instance's own MaxConcurrency takes precedence.
+// n <= 0 leaves instances without their own limit uncapped.
+func WithMaxConcurrency(n int) Option {
+	return func(b *Balancer) {
+		b.maxConcurrency = max(0, n)
+	}
+}
+
+// concurrencyLimit returns the cap on requests in flight to inst, 0 for none.
+func (b *Balancer) concurrencyLimit(inst registry.Instance) int {
+	if inst.MaxConcurrency > 0 {
+		return inst.MaxConcurrency
+	}
+	return b.maxConcurrency
+}
+
+// Full reports whether the instance has as many requests in flight as it
+// may have.
+func (b *Balancer) Full(serviceName string, inst registry.Instance) bool {
+	limit := b.concurrencyLimit(inst)
+	if limit == 0 {
+		return false
+	}
+	return b.InFlight(serviceName, inst.ID) >= limit
+}
+
+// withoutFull returns the candidates below their concurrency cap.
+func (b *Balancer) withoutFull(serviceName string, instances []registry.Instance) []registry.Instance {
+	if b.maxConcurrency == 0 && !anyCapped(instances) {
+		return instances
+	}
+	return filter(instances, func(inst registry.Instance) bool { return !b.Full(serviceName, inst) })
+}
+
+func anyCapped(instances []registry.Instance) bool {
+	for _, inst := range instances {
+		if inst.MaxConcurrency > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tryBegin counts a request in flight to inst unless that would exceed its
+// cap, reporting whether it did. Checking and counting under one lock keeps
+// concurrent selections from overshooting the cap.
+func (b *Balancer) tryBegin(serviceName string, inst *registry.Instance) bool {
+	limit := b.concurrencyLimit(*inst)
+	key := serviceName + "/" + inst.ID
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit > 0 && b.inflight[key] >= limit {
+		return false
+	}
+	b.inflight[key]++
+	return true
+}
@@ -0,0 +1,78 @@
+package balancer
+
+import (
+	"math"
+	"time"
+
+	"kerberos/internal/registry"
+)
+
+// ewmaDecay is the time constant of the latency average: the weight of a
+// sample fades to 1/e after this long.
+const ewmaDecay = 10 * time.Second
+
+// peakEWMA is an exponentially weighted moving average of response times
+// that jumps straight to any sample above it, so an instance that slows down
+// is avoided at once and trusted again only gradually.
+type peakEWMA struct {
+	value float64 // nanoseconds
+	stamp time.Time
+}
+
+func (e *peakEWMA) observe(d time.Duration, now time.Time) {
+	sample := float64(d)
+	if e.stamp.IsZero() || sample > e.value {
+		e.value = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(ewmaDecay))
+		e.value = e.value*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+// ReportLatency records how long an instance took to respond, for the
+// PowerOfTwoChoices strategy.
+func (b *Balancer) ReportLatency(serviceName, id string, d time.Duration) {
+	key := serviceName + "/" + id
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.latencies[key]
+	if !ok {
+		e = &peakEWMA{}
+		b.latencies[key] = e
+	}
+	e.observe(d, b.clock.Now())
+}
+
+// selectPeakEWMA samples two distinct instances and returns the one with the
+// lower average latency times requests in flight. Instances without reported
+// latencies score zero, so new instances are tried early.
+func (b *Balancer) selectPeakEWMA(serviceName string, instances []registry.Instance) *registry.Instance {
+	if len(instances) == 1 {
+		return &instances[0]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.rand.Intn(len(instances))
+	j := b.rand.Intn(len(instances) - 1)
+	if j >= i {
+		j++
+	}
+	if b.ewmaScore(serviceName, instances[j].ID) < b.ewmaScore(serviceName, instances[i].ID) {
+		return &instances[j]
+	}
+	return &instances[i]
+}
+
+// ewmaScore is the instance's latency average times its requests in flight,
+// counting the one about to be sent. Caller must hold b.mu.
+func (b *Balancer) ewmaScore(serviceName, id string) float64 {
+	key := serviceName + "/" + id
+	var latency float64
+	if e, ok := b.latencies[key]; ok {
+		latency = e.value
+	}
+	return latency * float64(b.inflight[key]+1)
+}
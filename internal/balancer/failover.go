@@ -0,0 +1,35 @@
+package balancer
+
+import "kerberos/internal/registry"
+
+// WithPriority sets the failover order for a service under the Failover
+// strategy: traffic goes to the first listed instance that is available, then
+// the next. Instances not listed rank after listed ones, in registration order.
+func WithPriority(serviceName string, ids ...string) Option {
+	return func(b *Balancer) {
+		ranks := make(map[string]int, len(ids))
+		for i, id := range ids {
+			ranks[id] = i
+		}
+		b.priority[serviceName] = ranks
+	}
+}
+
+// selectFailover returns the highest-priority instance.
+func (b *Balancer) selectFailover(serviceName string, instances []registry.Instance) *registry.Instance {
+	ranks := b.priority[serviceName]
+	rank := func(inst registry.Instance) int {
+		if r, ok := ranks[inst.ID]; ok {
+			return r
+		}
+		return len(ranks)
+	}
+
+	best := 0
+	for i := 1; i < len(instances); i++ {
+		if rank(instances[i]) < rank(instances[best]) {
+			best = i
+		}
+	}
+	return &instances[best]
+}
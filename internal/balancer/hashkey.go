@@ -0,0 +1,103 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WithHashKey sets the function extracting the affinity key for hashing
+// strategies. Requests with the same key go to the same instance. When unset
+// the request path is used.
+func WithHashKey(fn func(*http.Request) string) Option {
+	return func(b *Balancer) {
+		b.hashKey = fn
+	}
+}
+
+// requestKey returns the affinity key for req, or "" if there is none.
+func (b *Balancer) requestKey(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	if b.hashKey != nil {
+		return b.hashKey(req)
+	}
+	return req.URL.Path
+}
+
+// HeaderKey keys requests by the value of a header.
+func HeaderKey(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// PathSegmentKey keys requests by the i-th (0-based) segment of the path,
+// e.g. index 2 of "/api/orders/42" is "42".
+func PathSegmentKey(i int) func(*http.Request) string {
+	return func(req *http.Request) string {
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if i < 0 || i >= len(segments) {
+			return ""
+		}
+		return segments[i]
+	}
+}
+
+// DefaultMaxKeyBody is the largest body JSONFieldKey reads when given a
+// maxBody of 0, 1 MiB like circuitbreaker.DefaultMaxRetryBody.
+const DefaultMaxKeyBody = 1 << 20
+
+// JSONFieldKey keys requests by a top-level field of a JSON body. The body is
+// restored so it can still be forwarded. Bodies over maxBody bytes are not
+// read into memory and give no key; pass the client's
+// circuitbreaker.Settings.MaxRetryBody to buffer no more than retries do.
+// Zero means DefaultMaxKeyBody; a negative maxBody reads every body.
+func JSONFieldKey(field string, maxBody int64) func(*http.Request) string {
+	if maxBody == 0 {
+		maxBody = DefaultMaxKeyBody
+	}
+	return func(req *http.Request) string {
+		if req.Body == nil || req.Body == http.NoBody {
+			return ""
+		}
+		if maxBody > 0 && req.ContentLength > maxBody {
+			return ""
+		}
+		var src io.Reader = req.Body
+		if maxBody > 0 {
+			src = io.LimitReader(req.Body, maxBody+1)
+		}
+		body, err := io.ReadAll(src)
+		if err == nil && maxBody > 0 && int64(len(body)) > maxBody {
+			// Too large to parse; forward what was read and the rest
+			// unread.
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			return ""
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return ""
+		}
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(body, &fields) != nil {
+			return ""
+		}
+		raw, ok := fields[field]
+		if !ok {
+			return ""
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s
+		}
+		return string(raw) // numbers and other scalars keep their JSON form
+	}
+}
@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"context"
+	"math"
+
+	"kerberos/internal/registry"
+)
+
+// loadScale gives effective weights enough resolution to shift traffic
+// gradually as reported load changes.
+const loadScale = 100
+
+// ReportLoad records the load an instance reported (0 = idle, 1 = saturated).
+// Weighted strategies reduce the instance's effective weight in proportion,
+// shifting traffic toward less-loaded instances. NaN and infinite loads are
+// ignored.
+func (b *Balancer) ReportLoad(serviceName, id string, load float64) {
+	if math.IsNaN(load) || math.IsInf(load, 0) {
+		return
+	}
+	load = math.Max(0, math.Min(1, load))
+	b.mu.Lock()
+	b.loads[serviceName+"/"+id] = load
+	b.mu.Unlock()
+}
+
+// RunPruner forgets what the balancer tracks per instance (reported load,
+// response times, outlier state) as instances are unregistered, until ctx is
+// done, so that state does not pile up as instances come and go.
+func (b *Balancer) RunPruner(ctx context.Context) {
+	events, stop := b.registry.Watch()
+	defer stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Kind == registry.Unregistered {
+				b.forget(e.Service, e.Instance.ID)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forget drops the per-instance state of an unregistered instance.
+func (b *Balancer) forget(serviceName, id string) {
+	key := serviceName + "/" + id
+	b.mu.Lock()
+	delete(b.loads, key)
+	delete(b.latencies, key)
+	delete(b.outliers, key)
+	b.mu.Unlock()
+}
+
+// weights returns the effective weight of each instance: its registered
+// weight, scaled down by its last reported load and, during slow start, by
+// how recently it was registered.
+func (b *Balancer) weights(serviceName string, instances []registry.Instance) []int {
+	weights := make([]int, len(instances))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.loads) == 0 && b.slowStart <= 0 {
+		for i, inst := range instances {
+			weights[i] = inst.Weight
+		}
+		return weights
+	}
+	now := b.clock.Now()
+	for i, inst := range instances {
+		load := b.loads[serviceName+"/"+inst.ID]
+		w := int(math.Round(float64(inst.Weight*loadScale) * (1 - load) * b.ramp(inst, now)))
+		weights[i] = max(1, w)
+	}
+	return weights
+}
@@ -0,0 +1,140 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"kerberos/internal/registry"
+)
+
+// DefaultMaglevTableSize is the lookup table size used by the Maglev strategy
+// unless WithMaglevTableSize sets another. It should be prime and much larger
+// than the number of instances; 65537 suits up to a few hundred.
+const DefaultMaglevTableSize = 65537
+
+// WithMaglevTableSize sets the size of the Maglev lookup table. Larger tables
+// spread keys more evenly across many instances at the cost of memory and
+// rebuild time. Sizes that are not prime are rounded up to the next prime.
+func WithMaglevTableSize(n int) Option {
+	return func(b *Balancer) {
+		b.maglevSize = nextPrime(n)
+	}
+}
+
+// maglevTable is a Maglev lookup table (Eisenbud et al., NSDI 2016) over a
+// fixed set of instances: each slot names the instance owning the keys that
+// hash to it. Every instance owns almost exactly its share of slots, and when
+// an instance is added or removed most slots keep their owner.
+type maglevTable struct {
+	ids     string   // Instance IDs the table was built from, to detect changes
+	owners  []string // Sorted instance IDs
+	entries []int32  // entries[slot] indexes owners
+}
+
+func newMaglevTable(ids string, owners []string, size int) *maglevTable {
+	m := uint64(size)
+	offsets := make([]uint64, len(owners))
+	skips := make([]uint64, len(owners))
+	for i, id := range owners {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		offsets[i] = h.Sum64() % m
+		h2 := fnv.New64()
+		h2.Write([]byte(id))
+		skips[i] = h2.Sum64()%(m-1) + 1
+	}
+
+	entries := make([]int32, size)
+	for i := range entries {
+		entries[i] = -1
+	}
+	// Instances take turns claiming the next free slot of their own
+	// permutation of the table until every slot is owned.
+	next := make([]uint64, len(owners))
+	filled := 0
+	for filled < size {
+		for i := range owners {
+			slot := (offsets[i] + next[i]*skips[i]) % m
+			for entries[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % m
+			}
+			entries[slot] = int32(i)
+			next[i]++
+			filled++
+			if filled == size {
+				break
+			}
+		}
+	}
+	return &maglevTable{ids: ids, owners: owners, entries: entries}
+}
+
+// lookup returns the ID of the instance owning key among those ok accepts:
+// the owner of the key's slot or, if ok rejects it, of the next slot whose
+// owner ok accepts. Since owners are spread evenly over the table, the keys
+// of a rejected instance are shared out among the others. It returns false
+// if ok accepts none of the owners.
+func (t *maglevTable) lookup(key string, ok func(id string) bool) (string, bool) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	start := h.Sum64() % uint64(len(t.entries))
+	for n := uint64(0); n < uint64(len(t.entries)); n++ {
+		if id := t.owners[t.entries[(start+n)%uint64(len(t.entries))]]; ok(id) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// selectMaglev maps key onto instances through the service's Maglev table.
+// The table is built over every registered instance and only rebuilt when
+// registrations change; instances left out of this selection are skipped,
+// so a filter excluding some of them does not cost a rebuild.
+func (b *Balancer) selectMaglev(serviceName string, instances []registry.Instance, key string) *registry.Instance {
+	registered := b.registry.GetInstances(serviceName)
+	if len(registered) == 0 {
+		// Unregistered since the candidates were listed.
+		return &instances[0]
+	}
+	sig := instanceSig(registered)
+
+	b.mu.Lock()
+	t := b.maglevs[serviceName]
+	if t == nil || t.ids != sig {
+		ids := make([]string, len(registered))
+		for i, inst := range registered {
+			ids[i] = inst.ID
+		}
+		sort.Strings(ids)
+		t = newMaglevTable(sig, ids, b.maglevSize)
+		b.maglevs[serviceName] = t
+	}
+	b.mu.Unlock()
+
+	byID := indexByID(instances)
+	id, found := t.lookup(key, func(id string) bool { _, ok := byID[id]; return ok })
+	if !found {
+		return &instances[0]
+	}
+	return &instances[byID[id]]
+}
+
+// nextPrime returns the smallest prime >= n, and at least 2.
+func nextPrime(n int) int {
+	if n <= 2 {
+		return 2
+	}
+	for ; ; n++ {
+		prime := true
+		for d := 2; d*d <= n; d++ {
+			if n%d == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
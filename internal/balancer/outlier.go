@@ -0,0 +1,137 @@
+package balancer
+
+import (
+	"time"
+
+	"kerberos/internal/registry"
+)
+
+// OutlierDetection configures passive outlier detection: an instance whose
+// requests fail too often in a row is ejected, i.e. not selected, for a
+// while. Zero fields take the values from DefaultOutlierDetection.
+type OutlierDetection struct {
+	// ConsecutiveFailures ejects an instance after this many failed requests
+	// (errors or 5xx responses) in a row.
+	ConsecutiveFailures int
+
+	// BaseEjectionTime is how long the first ejection lasts. Each further
+	// ejection lasts one BaseEjectionTime longer; every BaseEjectionTime an
+	// instance stays healthy takes one back off again.
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime caps how long an ejection lasts.
+	MaxEjectionTime time.Duration
+}
+
+// DefaultOutlierDetection returns sensible defaults.
+func DefaultOutlierDetection() OutlierDetection {
+	return OutlierDetection{
+		ConsecutiveFailures: 5,
+		BaseEjectionTime:    30 * time.Second,
+		MaxEjectionTime:     300 * time.Second,
+	}
+}
+
+// WithOutlierDetection ejects instances that keep failing, as reported with
+// ReportResult. If every candidate is ejected they are all considered again,
+// so a service is never left without instances by ejection alone.
+func WithOutlierDetection(cfg OutlierDetection) Option {
+	defaults := DefaultOutlierDetection()
+	if cfg.ConsecutiveFailures <= 0 {
+		cfg.ConsecutiveFailures = defaults.ConsecutiveFailures
+	}
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = defaults.BaseEjectionTime
+	}
+	if cfg.MaxEjectionTime <= 0 {
+		cfg.MaxEjectionTime = max(defaults.MaxEjectionTime, cfg.BaseEjectionTime)
+	}
+	return func(b *Balancer) {
+		b.outlier = &cfg
+	}
+}
+
+// outlierState tracks one instance for outlier detection.
+type outlierState struct {
+	failures     int       // consecutive failures since the last success or ejection
+	ejections    int       // ejection multiplier, see OutlierDetection.BaseEjectionTime
+	ejectedUntil time.Time // zero if never ejected
+}
+
+// ReportResult records whether a request sent to an instance failed, for
+// outlier detection. It does nothing without WithOutlierDetection.
+func (b *Balancer) ReportResult(serviceName, id string, failed bool) {
+	if b.outlier == nil {
+		return
+	}
+	key := serviceName + "/" + id
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.outliers[key]
+	if !ok {
+		if !failed {
+			return
+		}
+		s = &outlierState{}
+		b.outliers[key] = s
+	}
+	now := b.clock.Now()
+	if !failed || now.Before(s.ejectedUntil) {
+		// Requests sent before an ejection may still fail while it lasts;
+		// the instance starts with a clean slate once re-admitted.
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures < b.outlier.ConsecutiveFailures {
+		return
+	}
+	if !s.ejectedUntil.IsZero() {
+		healthy := int(now.Sub(s.ejectedUntil) / b.outlier.BaseEjectionTime)
+		s.ejections = max(0, s.ejections-healthy)
+	}
+	s.ejections++
+	s.failures = 0
+	s.ejectedUntil = now.Add(min(b.outlier.BaseEjectionTime*time.Duration(s.ejections), b.outlier.MaxEjectionTime))
+}
+
+// Ejected reports whether outlier detection currently keeps the instance
+// from being selected.
+func (b *Balancer) Ejected(serviceName, id string) bool {
+	if b.outlier == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ejected(serviceName+"/"+id, b.clock.Now())
+}
+
+// ejected reports whether the instance under key is ejected at now. Caller
+// must hold b.mu.
+func (b *Balancer) ejected(key string, now time.Time) bool {
+	s, ok := b.outliers[key]
+	return ok && now.Before(s.ejectedUntil)
+}
+
+// withoutEjected returns the instances that are not ejected, or all of them
+// if none are left.
+func (b *Balancer) withoutEjected(serviceName string, instances []registry.Instance) []registry.Instance {
+	if b.outlier == nil {
+		return instances
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	n := 0
+	for _, inst := range instances {
+		if !b.ejected(serviceName+"/"+inst.ID, now) {
+			n++
+		}
+	}
+	if n == 0 || n == len(instances) {
+		return instances
+	}
+	return filter(instances, func(inst registry.Instance) bool {
+		return !b.ejected(serviceName+"/"+inst.ID, now)
+	})
+}
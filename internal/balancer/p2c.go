@@ -0,0 +1,74 @@
+package balancer
+
+import "kerberos/internal/registry"
+
+// end counts a request to inst counted in flight by tryBegin as completed.
+// Selections are counted as in flight until Done is called.
+func (b *Balancer) end(serviceName string, inst *registry.Instance) {
+	key := serviceName + "/" + inst.ID
+	b.mu.Lock()
+	if b.inflight[key] > 1 {
+		b.inflight[key]--
+	} else {
+		delete(b.inflight, key)
+	}
+	b.mu.Unlock()
+}
+
+// InFlight returns the number of requests sent to the instance that have not
+// been reported Done yet.
+func (b *Balancer) InFlight(serviceName, instanceID string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inflight[serviceName+"/"+instanceID]
+}
+
+// selectP2C samples two distinct instances, uniformly or in proportion to
+// weights when given, and returns the one with fewer requests in flight per
+// unit of weight.
+func (b *Balancer) selectP2C(serviceName string, instances []registry.Instance, weights []int) *registry.Instance {
+	if len(instances) == 1 {
+		return &instances[0]
+	}
+	if weights == nil {
+		weights = make([]int, len(instances))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := sample(weights, b.rand.Intn(total), -1)
+	j := sample(weights, b.rand.Intn(total-weights[i]), i)
+
+	// Compare (inflight+1)/weight of both without dividing.
+	li := (b.inflight[serviceName+"/"+instances[i].ID] + 1) * weights[j]
+	lj := (b.inflight[serviceName+"/"+instances[j].ID] + 1) * weights[i]
+	if lj < li {
+		return &instances[j]
+	}
+	return &instances[i]
+}
+
+// sample returns the index whose weight range contains r, skipping index
+// skip (whose weight must already be excluded from r's range).
+func sample(weights []int, r, skip int) int {
+	last := 0
+	for k, w := range weights {
+		if k == skip {
+			continue
+		}
+		last = k
+		r -= w
+		if r < 0 {
+			return k
+		}
+	}
+	return last
+}
@@ -0,0 +1,110 @@
+package balancer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kerberos/internal/registry"
+)
+
+// ringReplicas is the number of virtual nodes per instance on the hash ring.
+// md5 yields four points per hash, as in ketama.
+const ringReplicas = 160
+
+// ring is a consistent hash ring over a fixed set of instances.
+type ring struct {
+	ids    string   // Instance IDs the ring was built from, to detect changes
+	points []uint32 // Sorted virtual node hashes
+	owners []string // owners[i] is the instance ID owning points[i]
+}
+
+func newRing(ids string, instances []registry.Instance) *ring {
+	type point struct {
+		hash  uint32
+		owner string
+	}
+	pts := make([]point, 0, len(instances)*ringReplicas)
+	for _, inst := range instances {
+		for i := 0; i < ringReplicas/4; i++ {
+			sum := md5.Sum([]byte(inst.ID + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				pts = append(pts, point{binary.LittleEndian.Uint32(sum[j*4:]), inst.ID})
+			}
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i].hash != pts[j].hash {
+			return pts[i].hash < pts[j].hash
+		}
+		return pts[i].owner < pts[j].owner
+	})
+
+	r := &ring{ids: ids, points: make([]uint32, len(pts)), owners: make([]string, len(pts))}
+	for i, p := range pts {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return r
+}
+
+// lookup returns the ID of the instance owning key among those ok accepts:
+// the first virtual node at or after the key's hash, wrapping around, whose
+// owner is accepted. It returns false if ok accepts none of the owners.
+func (r *ring) lookup(key string, ok func(id string) bool) (string, bool) {
+	sum := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(sum[:4])
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for n := 0; n < len(r.points); n++ {
+		if id := r.owners[(start+n)%len(r.points)]; ok(id) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// selectConsistentHash maps key onto instances through the service's hash
+// ring. The ring is built over every registered instance and only rebuilt
+// when registrations change; instances left out of this selection are
+// skipped, so their keys fall to the next instance on the ring while the
+// others keep theirs. Adding or removing an instance only remaps the keys it
+// gains or loses.
+func (b *Balancer) selectConsistentHash(serviceName string, instances []registry.Instance, key string) *registry.Instance {
+	registered := b.registry.GetInstances(serviceName)
+	sig := instanceSig(registered)
+
+	b.mu.Lock()
+	r := b.rings[serviceName]
+	if r == nil || r.ids != sig {
+		r = newRing(sig, registered)
+		b.rings[serviceName] = r
+	}
+	b.mu.Unlock()
+
+	byID := indexByID(instances)
+	id, found := r.lookup(key, func(id string) bool { _, ok := byID[id]; return ok })
+	if !found {
+		return &instances[0]
+	}
+	return &instances[byID[id]]
+}
+
+// instanceSig identifies a set of instances by their sorted IDs.
+func instanceSig(instances []registry.Instance) string {
+	ids := make([]string, len(instances))
+	for i, inst := range instances {
+		ids[i] = inst.ID
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, "\x00")
+}
+
+// indexByID maps the IDs of instances to their index.
+func indexByID(instances []registry.Instance) map[string]int {
+	byID := make(map[string]int, len(instances))
+	for i, inst := range instances {
+		byID[inst.ID] = i
+	}
+	return byID
+}
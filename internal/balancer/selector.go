@@ -0,0 +1,34 @@
+package balancer
+
+import (
+	"net/http"
+
+	"kerberos/internal/registry"
+)
+
+// Selector is balancing logic supplied by the user rather than one of the
+// built-in strategies. Select picks one of instances for req, which may be
+// nil; returning nil means no instance is available. The instances are the
+// candidates left after draining, ejected and unmatched instances are ruled
+// out, and the returned pointer should point into the slice.
+type Selector interface {
+	Select(instances []registry.Instance, req *http.Request) *registry.Instance
+}
+
+// SelectorFunc adapts a function to a Selector.
+type SelectorFunc func(instances []registry.Instance, req *http.Request) *registry.Instance
+
+// Select calls f(instances, req).
+func (f SelectorFunc) Select(instances []registry.Instance, req *http.Request) *registry.Instance {
+	return f(instances, req)
+}
+
+// WithSelector selects instances with s instead of the strategy passed to
+// New. Services given their own strategy with WithStrategies keep it; they
+// can use s too by naming the Custom strategy.
+func WithSelector(s Selector) Option {
+	return func(b *Balancer) {
+		b.selector = s
+		b.strategy = Custom
+	}
+}
@@ -0,0 +1,70 @@
+package balancer
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"kerberos/internal/registry"
+)
+
+// MetricsSink receives per-instance selection and completion events, e.g. to
+// feed an external autoscaler. It is called on the request path, so
+// implementations must be cheap and safe for concurrent use.
+type MetricsSink interface {
+	Selected(serviceName string, inst registry.Instance)
+	Done(serviceName string, inst registry.Instance)
+}
+
+// WithMetricsSink reports every selection and completion to s.
+func WithMetricsSink(s MetricsSink) Option {
+	return func(b *Balancer) {
+		b.sink = s
+	}
+}
+
+// Counters is a MetricsSink keeping per-instance selection counts and
+// in-flight gauges in atomics.
+type Counters struct {
+	instances sync.Map // service + "/" + id -> *instanceCounters
+}
+
+type instanceCounters struct {
+	selections atomic.Uint64
+	inFlight   atomic.Int64
+}
+
+// NewCounters creates an empty Counters sink.
+func NewCounters() *Counters {
+	return &Counters{}
+}
+
+func (c *Counters) get(serviceName, id string) *instanceCounters {
+	key := serviceName + "/" + id
+	if v, ok := c.instances.Load(key); ok {
+		return v.(*instanceCounters)
+	}
+	v, _ := c.instances.LoadOrStore(key, &instanceCounters{})
+	return v.(*instanceCounters)
+}
+
+// Selected implements MetricsSink.
+func (c *Counters) Selected(serviceName string, inst registry.Instance) {
+	ic := c.get(serviceName, inst.ID)
+	ic.selections.Add(1)
+	ic.inFlight.Add(1)
+}
+
+// Done implements MetricsSink.
+func (c *Counters) Done(serviceName string, inst registry.Instance) {
+	c.get(serviceName, inst.ID).inFlight.Add(-1)
+}
+
+// Selections returns how many times the instance has been selected.
+func (c *Counters) Selections(serviceName, id string) uint64 {
+	return c.get(serviceName, id).selections.Load()
+}
+
+// InFlight returns the number of selections not yet completed.
+func (c *Counters) InFlight(serviceName, id string) int64 {
+	return c.get(serviceName, id).inFlight.Load()
+}
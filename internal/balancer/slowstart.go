@@ -0,0 +1,33 @@
+package balancer
+
+import (
+	"time"
+
+	"kerberos/internal/registry"
+)
+
+// slowStartFloor is the share of its weight a just-registered instance gets
+// under slow start.
+const slowStartFloor = 0.1
+
+// WithSlowStart ramps the effective weight of newly registered instances up
+// from a tenth of their weight to all of it over window, so an instance
+// warming caches or JIT-compiling is not flooded straight away. It applies
+// to the weighted strategies.
+func WithSlowStart(window time.Duration) Option {
+	return func(b *Balancer) {
+		b.slowStart = window
+	}
+}
+
+// ramp returns the fraction of its weight inst gets at now under slow start.
+func (b *Balancer) ramp(inst registry.Instance, now time.Time) float64 {
+	if b.slowStart <= 0 || inst.RegisteredAt.IsZero() {
+		return 1
+	}
+	age := now.Sub(inst.RegisteredAt)
+	if age >= b.slowStart {
+		return 1
+	}
+	return max(slowStartFloor, float64(age)/float64(b.slowStart))
+}
@@ -0,0 +1,135 @@
+package balancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"kerberos/internal/registry"
+)
+
+// StickyCookieConfig configures the StickyCookie strategy: the gateway sets
+// a signed cookie naming the instance that served a client, and sends the
+// client's later requests there for as long as the instance can be selected.
+type StickyCookieConfig struct {
+	// Secret keys the HMAC signing the cookies, so clients cannot pick an
+	// instance themselves. Required.
+	Secret []byte
+
+	// Name is the prefix of the cookie names; each service gets its own
+	// cookie, named Name-service. Defaults to "kerberos-sticky".
+	Name string
+
+	// Base selects instances for clients without a valid cookie, or whose
+	// instance is gone, draining or unhealthy. Defaults to RoundRobin.
+	Base Strategy
+
+	// MaxAge is how long clients keep the cookie. Zero sets a session
+	// cookie.
+	MaxAge time.Duration
+
+	// Secure limits the cookie to HTTPS requests.
+	Secure bool
+}
+
+// WithStickyCookie configures the StickyCookie strategy, for services using
+// it. Without this option StickyCookie falls back to round-robin.
+func WithStickyCookie(cfg StickyCookieConfig) Option {
+	if cfg.Name == "" {
+		cfg.Name = "kerberos-sticky"
+	}
+	if cfg.Base == "" || cfg.Base == StickyCookie {
+		cfg.Base = RoundRobin
+	}
+	return func(b *Balancer) {
+		b.sticky = &cfg
+	}
+}
+
+// AffinityCookie returns the cookie to set on the response to req, which was
+// sent to inst, so the client sticks to inst. It returns nil unless the
+// service uses StickyCookie, and if req already carries a cookie for inst.
+func (b *Balancer) AffinityCookie(serviceName string, req *http.Request, inst registry.Instance) *http.Cookie {
+	if b.sticky == nil || b.strategyFor(serviceName) != StickyCookie {
+		return nil
+	}
+	if id, ok := b.sticky.instanceID(serviceName, req); ok && id == inst.ID {
+		return nil
+	}
+	c := &http.Cookie{
+		Name:     b.sticky.cookieName(serviceName),
+		Value:    b.sticky.sign(serviceName, inst.ID),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   b.sticky.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if b.sticky.MaxAge > 0 {
+		c.MaxAge = int(b.sticky.MaxAge / time.Second)
+	}
+	return c
+}
+
+// stickyInstance returns the candidate named by req's cookie, or nil if there
+// is no valid cookie or its instance is not among the candidates.
+func (b *Balancer) stickyInstance(serviceName string, instances []registry.Instance, req *http.Request) *registry.Instance {
+	id, ok := b.sticky.instanceID(serviceName, req)
+	if !ok {
+		return nil
+	}
+	for i := range instances {
+		if instances[i].ID == id {
+			return &instances[i]
+		}
+	}
+	return nil
+}
+
+// cookieName returns the name of the service's cookie.
+func (c *StickyCookieConfig) cookieName(serviceName string) string {
+	return c.Name + "-" + serviceName
+}
+
+// sign returns the cookie value naming the instance with the given ID: the
+// ID and its HMAC, both base64-encoded. The MAC covers the service too, so a
+// cookie cannot be replayed against another service.
+func (c *StickyCookieConfig) sign(serviceName, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." +
+		base64.RawURLEncoding.EncodeToString(c.mac(serviceName, id))
+}
+
+// instanceID returns the instance ID in req's cookie for the service, and
+// whether there is one with a valid signature.
+func (c *StickyCookieConfig) instanceID(serviceName string, req *http.Request) (string, bool) {
+	if req == nil {
+		return "", false
+	}
+	cookie, err := req.Cookie(c.cookieName(serviceName))
+	if err != nil {
+		return "", false
+	}
+	encID, encMAC, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return "", false
+	}
+	id, err := base64.RawURLEncoding.DecodeString(encID)
+	if err != nil {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, c.mac(serviceName, string(id))) {
+		return "", false
+	}
+	return string(id), true
+}
+
+func (c *StickyCookieConfig) mac(serviceName, id string) []byte {
+	h := hmac.New(sha256.New, c.Secret)
+	h.Write([]byte(serviceName))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
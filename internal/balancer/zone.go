@@ -0,0 +1,35 @@
+package balancer
+
+import "kerberos/internal/registry"
+
+// ZoneAware makes any strategy prefer instances in localZone, to avoid the
+// cost and latency of cross-zone traffic. The strategy chooses among the
+// local candidates while at least minLocal of them are available (at least
+// one), and among the instances of every zone otherwise. Candidates exclude
+// instances ruled out for a request, such as draining or ejected ones and
+// those a retry avoids, so traffic spills over when the local zone runs out
+// of healthy instances. An empty localZone disables zone awareness.
+func ZoneAware(localZone string, minLocal int) Option {
+	return func(b *Balancer) {
+		b.localZone = localZone
+		b.minLocal = max(1, minLocal)
+	}
+}
+
+// preferLocalZone returns the candidates in the local zone if there are
+// enough of them, or else all candidates.
+func (b *Balancer) preferLocalZone(instances []registry.Instance) []registry.Instance {
+	if b.localZone == "" {
+		return instances
+	}
+	local := 0
+	for _, inst := range instances {
+		if inst.Zone == b.localZone {
+			local++
+		}
+	}
+	if local < b.minLocal || local == len(instances) {
+		return instances
+	}
+	return filter(instances, func(inst registry.Instance) bool { return inst.Zone == b.localZone })
+}
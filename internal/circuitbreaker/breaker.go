@@ -2,13 +2,21 @@ package circuitbreaker
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"kerberos/internal/clock"
+	"kerberos/internal/hopbyhop"
 	"kerberos/internal/retry"
 	"github.com/sony/gobreaker"
 )
@@ -16,18 +24,204 @@ import (
 // Client wraps an HTTP client with per-target circuit breakers.
 type Client struct {
 	httpClient *http.Client
-	breakers   map[string]*gobreaker.CircuitBreaker
+	breakers   map[string]*breaker
 	mu         sync.RWMutex
 	retry      retry.Config
+	budget     *retry.BudgetTracker // nil without a retry budget
+	openFor    time.Duration
+	settings   Settings
+
+	headerClients map[time.Duration]*http.Client // by response header timeout, guarded by mu
+}
+
+// ErrRetriesExhausted is wrapped by errors returned after every retry attempt
+// has failed. The last attempt's error is wrapped as well.
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// ErrOpen matches every OpenError with errors.Is.
+var ErrOpen = errors.New("circuit breaker open")
+
+// OpenError is returned when a target's breaker rejects the request.
+type OpenError struct {
+	Target     string
+	RetryAfter time.Duration // How long the breaker stays open
+	Err        error         // gobreaker.ErrOpenState or gobreaker.ErrTooManyRequests
+}
+
+func (e *OpenError) Error() string {
+	return e.Target + ": " + e.Err.Error()
+}
+
+func (e *OpenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrOpen.
+func (e *OpenError) Is(target error) bool {
+	return target == ErrOpen
+}
+
+// InvalidTargetError is returned when a target address cannot be turned into
+// a forwarding URL. The request is never sent and the target's breaker is
+// left untouched; the address will not become valid by retrying it.
+type InvalidTargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *InvalidTargetError) Error() string {
+	return "invalid target " + e.Target + ": " + e.Err.Error()
+}
+
+func (e *InvalidTargetError) Unwrap() error {
+	return e.Err
+}
+
+// RequestOptions adjust how a single request is forwarded. Attach them to the
+// request's context with WithRequestOptions.
+type RequestOptions struct {
+	// NoKeepAlive forwards the way legacy backends that cannot cope with
+	// persistent connections or chunked bodies expect: the connection is
+	// closed after the response and the body is always sent with a
+	// Content-Length, never chunked. The request is still HTTP/1.1.
+	NoKeepAlive bool
+
+	// ResponseHeaderTimeout bounds the wait for the backend's response
+	// headers, separately from the overall request timeout, so a backend
+	// slow to start answering fails fast while a long body transfer is not
+	// cut off. 0 keeps the client's setting.
+	ResponseHeaderTimeout time.Duration
+}
+
+type requestOptionsKey struct{}
+
+// WithRequestOptions returns a copy of ctx carrying o.
+func WithRequestOptions(ctx context.Context, o RequestOptions) context.Context {
+	return context.WithValue(ctx, requestOptionsKey{}, o)
+}
+
+func requestOptions(ctx context.Context) RequestOptions {
+	o, _ := ctx.Value(requestOptionsKey{}).(RequestOptions)
+	return o
+}
+
+type probeKey struct{}
+
+// WithProbe returns a copy of ctx under which an attempt sent to a target for
+// which probe reports true passes the target's breaker even while it is open,
+// so that a last-resort probe can find out whether the target has recovered.
+// A half-open breaker still lets the probe through its own slot, so that the
+// probe's outcome can close it.
+func WithProbe(ctx context.Context, probe func(target string) bool) context.Context {
+	return context.WithValue(ctx, probeKey{}, probe)
+}
+
+func isProbe(ctx context.Context, target string) bool {
+	probe, _ := ctx.Value(probeKey{}).(func(string) bool)
+	return probe != nil && probe(target)
 }
 
-// Settings for creating a new breaker client.
+// NextFunc chooses the target for attempt n (counting from 1) of a request
+// sent with DoNext. lastErr is the error that ended the previous attempt, nil
+// on the first. With untried set only a target not attempted before for the
+// request will do. Returning "" gives up.
+type NextFunc func(n int, lastErr error, untried bool) string
+
+// ErrNoTarget is returned by DoNext when next offers no target at all.
+var ErrNoTarget = errors.New("no target")
+
+// Settings for creating a new breaker client. Zero fields take the values
+// from DefaultSettings.
 type Settings struct {
 	MaxRequests uint32  // Max requests when half-open
 	Interval    int64   // Time window for counting failures (seconds)
 	Timeout     int64   // How long circuit stays open (seconds)
 	ReadyToTrip func(counts gobreaker.Counts) bool
 	Retry       retry.Config // Optional; MaxRetries 0 disables retries
+
+	// DialTimeout bounds establishing a connection to a target, separately
+	// from the request timeout, so a dead instance fails quickly. 0 keeps the
+	// transport's own dial timeout. Only applies to *http.Transport.
+	DialTimeout time.Duration
+
+	// TLSConfig verifies https:// targets, e.g. with a RootCAs pool holding
+	// the self-signed certificate of a staging backend. nil keeps the
+	// transport's TLS settings. Only applies to *http.Transport.
+	TLSConfig *tls.Config
+
+	// Pool sizes the transport's connection pool. Zero fields keep the
+	// values of the client's own transport, if it sets them, or take those
+	// from DefaultPool. Only applies to *http.Transport.
+	Pool Pool
+
+	// OnStateChange is called with the target whenever its breaker changes
+	// state, e.g. from gobreaker.StateClosed to gobreaker.StateOpen. It runs
+	// synchronously while the breaker is locked, so it must not block or
+	// call back into the Client.
+	OnStateChange func(target string, from, to gobreaker.State)
+
+	// OnHealthChange, when set, is told a target is unhealthy as soon as its
+	// breaker opens and healthy again once the open timeout has passed and
+	// the breaker lets probe requests through. Pass Registry.SetHealthyAddr
+	// to stop the balancer selecting instances while their breaker is open.
+	// It is called like OnStateChange and must not block either.
+	OnHealthChange func(target string, healthy bool)
+
+	// Override optionally gives some targets their own breaker settings,
+	// e.g. a lower trip threshold for a sensitive service. Only MaxRequests,
+	// Interval, Timeout and ReadyToTrip are taken from an override; its zero
+	// fields keep the client's values. See Overrides for a fixed map.
+	Override func(target string) (Settings, bool)
+
+	// IsFailure decides whether a call counts as a failure for the breaker,
+	// given its response or its error. The response is passed on to the
+	// caller either way, so e.g. a 503 counted as a failure is still
+	// forwarded. nil counts exactly the calls that returned an error,
+	// including responses retried for a RetryableStatusCodes status. See
+	// FailureStatus.
+	IsFailure func(resp *http.Response, err error) bool
+
+	// MaxRetryBody is the largest request body, in bytes, buffered in
+	// memory so the request can be retried. Larger bodies are streamed to
+	// the backend as they arrive and their requests are not retried. Zero
+	// means DefaultMaxRetryBody; a negative value buffers every body.
+	MaxRetryBody int64
+
+	// Clock drives the retry budget's window; nil uses the wall clock.
+	Clock clock.Clock
+
+	// UnavailableAfter is how many failures in a row, retries included,
+	// it takes before Unavailable reports a target whose breaker is still
+	// closed, so one stray failure does not rule out an instance for a
+	// whole Timeout.
+	UnavailableAfter uint32
+}
+
+// DefaultMaxRetryBody is the default Settings.MaxRetryBody, 1 MiB.
+const DefaultMaxRetryBody = 1 << 20
+
+// FailureStatus returns an IsFailure that counts errors and responses with
+// any of the given status codes, e.g. 500 and 503, as failures.
+func FailureStatus(codes ...int) func(*http.Response, error) bool {
+	return func(resp *http.Response, err error) bool {
+		if err != nil {
+			return true
+		}
+		for _, code := range codes {
+			if resp.StatusCode == code {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Overrides returns an Override that looks targets up in m.
+func Overrides(m map[string]Settings) func(target string) (Settings, bool) {
+	return func(target string) (Settings, bool) {
+		s, ok := m[target]
+		return s, ok
+	}
 }
 
 // DefaultSettings returns sensible defaults.
@@ -39,6 +233,7 @@ func DefaultSettings() Settings {
 		ReadyToTrip: func(counts gobreaker.Counts) bool {
 			return counts.ConsecutiveFailures >= 5
 		},
+		UnavailableAfter: 3,
 	}
 }
 
@@ -47,99 +242,691 @@ func New(httpClient *http.Client, s Settings) *Client {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
+	if s.TLSConfig != nil {
+		httpClient = withTLSConfig(httpClient, s.TLSConfig)
+	}
+	if s.DialTimeout > 0 {
+		httpClient = withDialTimeout(httpClient, s.DialTimeout)
+	}
+	httpClient = withPool(httpClient, s.Pool)
+	httpClient = withUnixSockets(httpClient)
+	defaults := DefaultSettings()
+	if s.MaxRequests == 0 {
+		s.MaxRequests = defaults.MaxRequests
+	}
+	if s.Interval <= 0 {
+		s.Interval = defaults.Interval
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = defaults.Timeout
+	}
+	if s.ReadyToTrip == nil {
+		s.ReadyToTrip = defaults.ReadyToTrip
+	}
+	if s.UnavailableAfter == 0 {
+		s.UnavailableAfter = defaults.UnavailableAfter
+	}
+	var budget *retry.BudgetTracker
+	if s.Retry.Budget.Enabled() {
+		budget = retry.NewBudgetTracker(s.Retry.Budget, s.Clock)
+	}
 	return &Client{
 		httpClient: httpClient,
-		breakers:   make(map[string]*gobreaker.CircuitBreaker),
+		breakers:   make(map[string]*breaker),
 		retry:      s.Retry,
+		budget:     budget,
+		openFor:    time.Duration(s.Timeout) * time.Second,
+		settings:   s,
+
+		headerClients: make(map[time.Duration]*http.Client),
+	}
+}
+
+// withDialTimeout returns a copy of c whose transport gives up connecting
+// after d. c is returned unchanged if its transport cannot be configured.
+func withDialTimeout(c *http.Client, d time.Duration) *http.Client {
+	t, ok := cloneTransport(c)
+	if !ok {
+		return c
+	}
+	dialer := &net.Dialer{Timeout: d, KeepAlive: 30 * time.Second}
+	t.DialContext = dialer.DialContext
+	t.TLSHandshakeTimeout = d
+
+	clone := *c
+	clone.Transport = t
+	return &clone
+}
+
+// withTLSConfig returns a copy of c whose transport connects to https://
+// targets using cfg. c is returned unchanged if its transport cannot be
+// configured.
+func withTLSConfig(c *http.Client, cfg *tls.Config) *http.Client {
+	t, ok := cloneTransport(c)
+	if !ok {
+		return c
+	}
+	t.TLSClientConfig = cfg.Clone()
+
+	clone := *c
+	clone.Transport = t
+	return &clone
+}
+
+// cloneTransport returns a copy of c's transport, if it is an *http.Transport.
+func cloneTransport(c *http.Client) (*http.Transport, bool) {
+	rt := c.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, false
+	}
+	return t.Clone(), true
+}
+
+// clientFor returns the HTTP client to forward with under opts. Clients with
+// a response header timeout are created once per timeout and reused, so
+// their connections are pooled.
+func (c *Client) clientFor(opts RequestOptions) *http.Client {
+	d := opts.ResponseHeaderTimeout
+	if d <= 0 {
+		return c.httpClient
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hc, ok := c.headerClients[d]; ok {
+		return hc
+	}
+	t, ok := cloneTransport(c.httpClient)
+	if !ok {
+		return c.httpClient
+	}
+	t.ResponseHeaderTimeout = d
+	hc := *c.httpClient
+	hc.Transport = t
+	c.headerClients[d] = &hc
+	return &hc
+}
+
+// IsConnectError reports whether err comes from failing to connect to the
+// target, in which case nothing was sent and the request can safely go to
+// another instance.
+func IsConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// breaker pairs a target's circuit breaker with cumulative counters.
+type breaker struct {
+	cb          *gobreaker.TwoStepCircuitBreaker
+	requests    atomic.Uint64
+	successes   atomic.Uint64
+	failures    atomic.Uint64
+	consecutive atomic.Uint64
+	retries     atomic.Uint64
+	lastFailure atomic.Int64 // unix nanoseconds
+	openFor     time.Duration
+
+	mu          sync.Mutex
+	spare       []func(success bool) // half-open slots of canceled probes, guarded by mu
+	healthTimer *time.Timer          // half-opens the breaker for OnHealthChange, guarded by mu
+}
+
+// allow asks the breaker to let a call through. While half-open, the breaker
+// only lets MaxRequests probes through; a slot a canceled probe gave up is
+// handed on, so that cancellations cannot keep the breaker from closing.
+func (b *breaker) allow() (func(success bool), error) {
+	done, err := b.cb.Allow()
+	if errors.Is(err, gobreaker.ErrTooManyRequests) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if n := len(b.spare); n > 0 {
+			done, b.spare = b.spare[n-1], b.spare[:n-1]
+			return done, nil
+		}
 	}
+	return done, err
 }
 
-func (c *Client) getBreaker(target string) *gobreaker.CircuitBreaker {
+// release gives up the slot of a call allowed through without reporting its
+// outcome. Only half-open slots are scarce enough to keep.
+func (b *breaker) release(done func(success bool)) {
+	if b.cb.State() != gobreaker.StateHalfOpen {
+		return
+	}
+	b.mu.Lock()
+	b.spare = append(b.spare, done)
+	b.mu.Unlock()
+}
+
+// clearSpare drops the slots kept by release, which belong to the breaker's
+// state before a change.
+func (b *breaker) clearSpare() {
+	b.mu.Lock()
+	b.spare = nil
+	b.mu.Unlock()
+}
+
+func (b *breaker) record(failed bool) {
+	b.requests.Add(1)
+	if failed {
+		b.failures.Add(1)
+		b.consecutive.Add(1)
+		b.lastFailure.Store(time.Now().UnixNano())
+		return
+	}
+	b.successes.Add(1)
+	b.consecutive.Store(0)
+}
+
+// Stats is a snapshot of a target's breaker. Counters are cumulative since the
+// breaker was created; unlike gobreaker.Counts they survive state changes.
+// Requests rejected by an open breaker count as failures. Every attempt counts
+// as a request; Retries counts those sent to the target to retry a failed one.
+type Stats struct {
+	Requests            uint64 `json:"requests"`
+	Successes           uint64 `json:"successes"`
+	Failures            uint64 `json:"failures"`
+	ConsecutiveFailures uint64 `json:"consecutive_failures"`
+	Retries             uint64 `json:"retries"`
+	State               string `json:"state"`
+
+	// Counts are the breaker's own counts, which ReadyToTrip decides on.
+	// They are cleared every Interval and whenever the state changes.
+	Counts gobreaker.Counts `json:"counts"`
+}
+
+// Stats returns a snapshot of every target's breaker, keyed by target.
+func (c *Client) Stats() map[string]Stats {
 	c.mu.RLock()
-	cb, ok := c.breakers[target]
+	defer c.mu.RUnlock()
+
+	stats := make(map[string]Stats, len(c.breakers))
+	for target, b := range c.breakers {
+		stats[target] = Stats{
+			Requests:            b.requests.Load(),
+			Successes:           b.successes.Load(),
+			Failures:            b.failures.Load(),
+			ConsecutiveFailures: b.consecutive.Load(),
+			Retries:             b.retries.Load(),
+			State:               b.cb.State().String(),
+			Counts:              b.cb.Counts(),
+		}
+	}
+	return stats
+}
+
+// States returns the state of every target's breaker, keyed by target.
+func (c *Client) States() map[string]gobreaker.State {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	states := make(map[string]gobreaker.State, len(c.breakers))
+	for target, b := range c.breakers {
+		states[target] = b.cb.State()
+	}
+	return states
+}
+
+// Unavailable reports whether sending to target now would likely run into a
+// wall: its breaker is not closed, or its last Settings.UnavailableAfter
+// calls failed, the last one less than the breaker's open timeout ago.
+// Targets never used are available.
+func (c *Client) Unavailable(target string) bool {
+	c.mu.RLock()
+	b, ok := c.breakers[target]
+	c.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if b.cb.State() != gobreaker.StateClosed {
+		return true
+	}
+	if b.consecutive.Load() < uint64(c.settings.UnavailableAfter) {
+		return false
+	}
+	return time.Since(time.Unix(0, b.lastFailure.Load())) < b.openFor
+}
+
+// LastFailure returns when the last request to target failed, or the zero
+// time if none has.
+func (c *Client) LastFailure(target string) time.Time {
+	c.mu.RLock()
+	b, ok := c.breakers[target]
+	c.mu.RUnlock()
+	if !ok || b.failures.Load() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, b.lastFailure.Load())
+}
+
+func (c *Client) getBreaker(target string) *breaker {
+	c.mu.RLock()
+	b, ok := c.breakers[target]
 	c.mu.RUnlock()
 
 	if ok {
-		return cb
+		return b
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Double-check after acquiring write lock
-	if cb, ok = c.breakers[target]; ok {
-		return cb
+	if b, ok = c.breakers[target]; ok {
+		return b
 	}
 
-	cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+	s := c.settingsFor(target)
+	openFor := time.Duration(s.Timeout) * time.Second
+	b = &breaker{openFor: openFor}
+	onStateChange := c.healthHook(s.OnStateChange, b)
+	b.cb = gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
 		Name:        target,
-		MaxRequests: 3,
-		Interval:    60,
-		Timeout:     30,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures >= 5
+		MaxRequests: s.MaxRequests,
+		Interval:    time.Duration(s.Interval) * time.Second,
+		Timeout:     openFor,
+		ReadyToTrip: s.ReadyToTrip,
+		// The breaker's name is the target.
+		OnStateChange: func(target string, from, to gobreaker.State) {
+			b.clearSpare()
+			if onStateChange != nil {
+				onStateChange(target, from, to)
+			}
 		},
 	})
-	c.breakers[target] = cb
-	return cb
+	c.breakers[target] = b
+	return b
+}
+
+// settingsFor returns the client's settings with target's override, if any,
+// applied.
+func (c *Client) settingsFor(target string) Settings {
+	s := c.settings
+	if s.Override == nil {
+		return s
+	}
+	o, ok := s.Override(target)
+	if !ok {
+		return s
+	}
+	if o.MaxRequests != 0 {
+		s.MaxRequests = o.MaxRequests
+	}
+	if o.Interval > 0 {
+		s.Interval = o.Interval
+	}
+	if o.Timeout > 0 {
+		s.Timeout = o.Timeout
+	}
+	if o.ReadyToTrip != nil {
+		s.ReadyToTrip = o.ReadyToTrip
+	}
+	return s
 }
 
 // Do executes the request through the circuit breaker for the target.
 // Retries with exponential backoff on failure (if Retry configured).
 func (c *Client) Do(target string, req *http.Request) (*http.Response, error) {
-	cb := c.getBreaker(target)
-
-	result, err := cb.Execute(func() (interface{}, error) {
-		return c.doWithRetry(target, req)
+	return c.DoNext(req, func(n int, lastErr error, untried bool) string {
+		var badTarget *InvalidTargetError
+		var open *OpenError
+		if untried || errors.As(lastErr, &badTarget) || errors.As(lastErr, &open) {
+			// Retrying would fail the same way.
+			return ""
+		}
+		return target
 	})
+}
 
+// DoNext is like Do but asks next for the target of every attempt, so a retry
+// can go somewhere other than the target that just failed. Each attempt counts
+// towards the breaker of its own target.
+//
+// After an attempt that sent nothing to the backend (an unparseable target, a
+// failed connect, an open breaker) moving on to a target not attempted yet
+// does not use up a retry. A body too large to buffer is only ever handed to
+// one attempt.
+func (c *Client) DoNext(req *http.Request, next NextFunc) (*http.Response, error) {
+	body, err := bufferBody(req, c.maxRetryBody())
 	if err != nil {
 		return nil, err
 	}
-	return result.(*http.Response), nil
+	opts := requestOptions(req.Context())
+	httpClient := c.clientFor(opts)
+	maxRetries := c.maxRetries(req, body)
+	c.depositRetryBudget()
+	deadline := c.retryDeadline(req, time.Now())
+	backoff := c.retry.Next(1, 0) // before the next retry
+
+	attempted := make(map[string]bool)
+	var lastErr error
+	retries := 0
+	for n := 1; ; n++ {
+		if lastErr != nil && req.Context().Err() != nil {
+			// The client went away or the request's deadline passed; further
+			// attempts would fail the same way.
+			break
+		}
+		sent := lastErr != nil && !unsent(lastErr)
+		if sent && retries == maxRetries || lastErr != nil && !body.resendable() {
+			break
+		}
+		target := next(n, lastErr, lastErr != nil && retries == maxRetries)
+		if target == "" {
+			break
+		}
+		isRetry := sent || attempted[target]
+		if isRetry {
+			if !c.retryFits(deadline, backoff) {
+				// Another attempt could not finish in time; return now
+				// rather than sleep towards the deadline.
+				return nil, lastErr
+			}
+			if !c.withdrawRetryBudget() {
+				// Retrying now would add to an overload; give up early.
+				return nil, lastErr
+			}
+			retries++
+			if !sleepCtx(req.Context(), backoff) {
+				// The request's deadline passed or it was canceled; further
+				// attempts would fail the same way.
+				return nil, lastErr
+			}
+			backoff = c.retry.Next(retries+1, backoff)
+		}
+		attempted[target] = true
+		canRetry := func() bool {
+			return retries < maxRetries && c.retryBudgetAvailable() && c.retryFits(deadline, backoff)
+		}
+		resp, err := c.attempt(httpClient, target, req, body, opts, isRetry, canRetry)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	switch {
+	case lastErr == nil:
+		return nil, ErrNoTarget
+	case retries > 0 && retries == maxRetries:
+		return nil, fmt.Errorf("%w after %d attempts: %w", ErrRetriesExhausted, maxRetries+1, lastErr)
+	default:
+		return nil, lastErr
+	}
+}
+
+// unsent reports whether err means an attempt never reached the backend.
+func unsent(err error) bool {
+	var badTarget *InvalidTargetError
+	var open *OpenError
+	return errors.As(err, &badTarget) || errors.As(err, &open) || IsConnectError(err)
 }
 
-func (c *Client) doWithRetry(target string, req *http.Request) (*http.Response, error) {
+// attempt sends req to target once through target's breaker; isRetry marks
+// attempts after the first. A retryable status counts as a failure while
+// canRetry is set.
+func (c *Client) attempt(httpClient *http.Client, target string, req *http.Request, body *requestBody, opts RequestOptions, isRetry bool, canRetry func() bool) (*http.Response, error) {
 	forwardURL, err := buildForwardURL(target, req.URL.Path, req.URL.RawQuery)
 	if err != nil {
-		return nil, err
+		return nil, &InvalidTargetError{Target: target, Err: err}
 	}
-
-	var bodyBytes []byte
-	if req.Body != nil {
-		bodyBytes, _ = io.ReadAll(req.Body)
-		req.Body.Close()
+	b := c.getBreaker(target)
+	if isRetry {
+		b.retries.Add(1)
 	}
 
-	var lastErr error
-	for attempt := 0; attempt <= c.retry.MaxRetries; attempt++ {
-		var body io.Reader
-		if len(bodyBytes) > 0 {
-			body = bytes.NewReader(bodyBytes)
+	return c.execute(b, target, isProbe(req.Context(), target), func() (*http.Response, error) {
+		resp, err := c.send(httpClient, forwardURL, req, body, opts)
+		if err == nil && c.retry.RetryableStatus(resp.StatusCode) && canRetry() {
+			discard(resp)
+			return nil, fmt.Errorf("retryable status %d", resp.StatusCode)
 		}
-		reqCopy, err := http.NewRequestWithContext(req.Context(), req.Method, forwardURL, body)
-		if err != nil {
-			return nil, err
+		return resp, err
+	})
+}
+
+// execute runs call through b, which counts it as a failure if it returned an
+// error or, with IsFailure set, if IsFailure says so. What call returned is
+// passed through either way. A call the caller canceled is counted neither
+// way: that says nothing about the backend. A probe (see WithProbe) the
+// breaker rejects is run anyway; its outcome only shows in b's counters.
+func (c *Client) execute(b *breaker, target string, probe bool, call func() (*http.Response, error)) (*http.Response, error) {
+	done, err := b.allow()
+	if err != nil && !probe {
+		b.record(true)
+		return nil, &OpenError{Target: target, RetryAfter: b.openFor, Err: err}
+	}
+	resp, err := call()
+	if errors.Is(err, context.Canceled) {
+		if done != nil {
+			b.release(done)
 		}
-		for k, v := range req.Header {
-			reqCopy.Header[k] = v
+		return nil, err
+	}
+	failed := err != nil
+	if c.settings.IsFailure != nil {
+		failed = c.settings.IsFailure(resp, err)
+	}
+	if done != nil {
+		done(!failed)
+	}
+	b.record(failed)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// retryDeadline returns when the attempts for req, the first sent at start,
+// must be done: the earlier of the request's deadline and Retry.Deadline
+// after start, or the zero time if there is neither.
+func (c *Client) retryDeadline(req *http.Request, start time.Time) time.Time {
+	deadline, _ := req.Context().Deadline()
+	if c.retry.Deadline > 0 {
+		if d := start.Add(c.retry.Deadline); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
 		}
+	}
+	return deadline
+}
 
-		resp, err := c.httpClient.Do(reqCopy)
-		if err != nil {
-			lastErr = err
-			if attempt < c.retry.MaxRetries {
-				time.Sleep(c.retry.Backoff(attempt + 1))
-			}
-			continue
+// retryFits reports whether a retry after backoff could still be made in
+// time for deadline.
+func (c *Client) retryFits(deadline time.Time, backoff time.Duration) bool {
+	return c.retry.Fits(deadline, time.Now(), backoff)
+}
+
+// maxRetries returns how often req may be retried.
+func (c *Client) maxRetries(req *http.Request, body *requestBody) int {
+	if !c.retry.Retryable(req) || !body.replayable() {
+		return 0
+	}
+	return c.retry.MaxRetries
+}
+
+// maxRetryBody returns the largest body to buffer for retries, or -1 for no
+// limit.
+func (c *Client) maxRetryBody() int64 {
+	switch {
+	case c.settings.MaxRetryBody < 0:
+		return -1
+	case c.settings.MaxRetryBody == 0:
+		return DefaultMaxRetryBody
+	}
+	return c.settings.MaxRetryBody
+}
+
+// depositRetryBudget counts a request towards the retry budget.
+func (c *Client) depositRetryBudget() {
+	if c.budget != nil {
+		c.budget.Deposit()
+	}
+}
+
+// withdrawRetryBudget spends one retry, reporting false if the budget is
+// exhausted.
+func (c *Client) withdrawRetryBudget() bool {
+	return c.budget == nil || c.budget.Withdraw()
+}
+
+// retryBudgetAvailable reports whether a retry could be spent now, so a
+// retryable response is only discarded when it will actually be retried.
+func (c *Client) retryBudgetAvailable() bool {
+	return c.budget == nil || c.budget.Available()
+}
+
+// requestBody is a request body prepared for sending. A buffered body can be
+// sent any number of times; a streamed one only once.
+type requestBody struct {
+	buf    []byte    // the whole body, when buffered
+	stream io.Reader // the body, when too large to buffer
+	sent   bool      // whether stream has been handed out
+}
+
+// errBodySent is returned for attempts to send a streamed body again.
+var errBodySent = errors.New("request body too large to resend")
+
+// replayable reports whether the body is buffered, so its request can be
+// retried.
+func (b *requestBody) replayable() bool {
+	return b.stream == nil
+}
+
+// resendable reports whether the body can still be sent.
+func (b *requestBody) resendable() bool {
+	return b.stream == nil || !b.sent
+}
+
+// reader returns the body for one attempt, nil if it is empty.
+func (b *requestBody) reader() (io.Reader, error) {
+	if b.stream != nil {
+		if b.sent {
+			return nil, errBodySent
 		}
-		return resp, nil
+		b.sent = true
+		return b.stream, nil
+	}
+	if len(b.buf) == 0 {
+		return nil, nil
+	}
+	return bytes.NewReader(b.buf), nil
+}
+
+// bufferBody reads req's body so it can be sent more than once, if it is at
+// most limit bytes long; a negative limit buffers every body. A larger body
+// is left to be streamed once. A body that cannot be read in full, e.g. one
+// over an http.MaxBytesReader limit, is not forwarded and its read error is
+// returned.
+func bufferBody(req *http.Request, limit int64) (*requestBody, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return &requestBody{}, nil
+	}
+	if limit >= 0 && req.ContentLength > limit {
+		// Known to be too large; stream it without reading any of it here.
+		return &requestBody{stream: req.Body}, nil
+	}
+	r := io.Reader(req.Body)
+	if limit >= 0 {
+		r = io.LimitReader(req.Body, limit+1)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		req.Body.Close()
+		return nil, err
+	}
+	if limit >= 0 && int64(len(buf)) > limit {
+		// A body of unknown length turned out too large: send what was
+		// read followed by the rest.
+		return &requestBody{stream: io.MultiReader(bytes.NewReader(buf), req.Body)}, nil
+	}
+	req.Body.Close()
+	// Leave the body readable so the caller can resend it elsewhere.
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	return &requestBody{buf: buf}, nil
+}
+
+// send makes a single attempt to forward req to forwardURL.
+func (c *Client) send(httpClient *http.Client, forwardURL string, req *http.Request, reqBody *requestBody, opts RequestOptions) (*http.Response, error) {
+	body, err := reqBody.reader()
+	if err != nil {
+		return nil, err
+	}
+	reqCopy, err := http.NewRequestWithContext(req.Context(), req.Method, forwardURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		reqCopy.Header[k] = v
+	}
+	if _, ok := unixSocket(reqCopy.URL.Host); ok {
+		reqCopy.Host = "localhost"
+	}
+	upgrade := hopbyhop.UpgradeProtocol(req.Header)
+	hopbyhop.Remove(reqCopy.Header)
+	if upgrade != "" {
+		// Upgrades such as WebSocket are negotiated end to end; the backend's
+		// 101 response body is then the connection itself, which must not be
+		// cut off by the client's overall timeout.
+		reqCopy.Header.Set("Connection", "Upgrade")
+		reqCopy.Header.Set("Upgrade", upgrade)
+		untimed := *httpClient
+		untimed.Timeout = 0
+		httpClient = &untimed
+	}
+	if !reqBody.replayable() {
+		// NewRequest cannot tell the length of a streamed body.
+		reqCopy.ContentLength = req.ContentLength
+	}
+	if opts.NoKeepAlive {
+		// NewRequest already set the buffered length; never stream.
+		reqCopy.Close = true
+	} else if body != nil && req.ContentLength < 0 {
+		// The client streamed without a length; keep the backend seeing
+		// chunked framing instead of the length of our buffer.
+		reqCopy.ContentLength = -1
+		reqCopy.TransferEncoding = req.TransferEncoding
+	}
+	return httpClient.Do(reqCopy)
+}
+
+// discard drains and closes resp so its connection can be reused.
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// sleepCtx waits for d, returning false early if ctx is done first, or
+// already is.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	return nil, lastErr
 }
 
 func buildForwardURL(base, path, rawQuery string) (string, error) {
 	base = strings.TrimSuffix(base, "/")
+	// WebSocket instances are reached over HTTP and upgraded.
+	if rest, ok := strings.CutPrefix(base, "ws://"); ok {
+		base = "http://" + rest
+	} else if rest, ok := strings.CutPrefix(base, "wss://"); ok {
+		base = "https://" + rest
+	} else if path, ok := strings.CutPrefix(base, "unix://"); ok {
+		// The whole path names the socket; requests go to its root.
+		if !strings.HasPrefix(path, "/") {
+			return "", fmt.Errorf("unix socket path %q is not absolute", path)
+		}
+		base = "http://" + unixHost(path)
+	}
 	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
 		base = "http://" + base
 	}
@@ -147,7 +934,20 @@ func buildForwardURL(base, path, rawQuery string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	u.Path = path
+	u.Path = joinPath(u.Path, path)
 	u.RawQuery = rawQuery
 	return u.String(), nil
 }
+
+// joinPath appends the request path to the instance's base path with exactly
+// one slash between them.
+func joinPath(base, path string) string {
+	base = strings.TrimSuffix(base, "/")
+	if base == "" {
+		return path
+	}
+	if path == "" {
+		return base
+	}
+	return base + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,678 @@
+package circuitbreaker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"kerberos/internal/clock"
+	"kerberos/internal/retry"
+)
+
+func TestClient_Stats_CountsMixedTraffic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	target := backend.URL
+
+	s := DefaultSettings()
+	s.Retry = retry.Config{MaxRetries: 0}
+	c := New(backend.Client(), s)
+
+	do := func() error {
+		resp, err := c.Do(target, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := do(); err != nil {
+			t.Fatalf("Do %d: %v", i, err)
+		}
+	}
+	backend.Close()
+	for i := 0; i < 2; i++ {
+		if err := do(); err == nil {
+			t.Fatalf("Do after close %d: expected error", i)
+		}
+	}
+
+	stats, ok := c.Stats()[target]
+	if !ok {
+		t.Fatalf("no stats for %s", target)
+	}
+	want := Stats{
+		Requests: 4, Successes: 2, Failures: 2, ConsecutiveFailures: 2, State: "closed",
+		Counts: gobreaker.Counts{Requests: 4, TotalSuccesses: 2, TotalFailures: 2, ConsecutiveFailures: 2},
+	}
+	if stats != want {
+		t.Errorf("want %+v, got %+v", want, stats)
+	}
+}
+
+func TestNew_DialTimeoutConfiguresCopyOfTransport(t *testing.T) {
+	base := &http.Client{Timeout: time.Minute}
+	s := DefaultSettings()
+	s.DialTimeout = 50 * time.Millisecond
+	c := New(base, s)
+
+	if base.Transport != nil {
+		t.Error("the caller's client must not be modified")
+	}
+	tr, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok || tr == http.DefaultTransport {
+		t.Fatalf("expected a cloned *http.Transport, got %T", c.httpClient.Transport)
+	}
+	if tr.DialContext == nil || tr.TLSHandshakeTimeout != s.DialTimeout {
+		t.Error("expected the dial and TLS handshake timeouts to be set")
+	}
+	if c.httpClient.Timeout != time.Minute {
+		t.Errorf("expected the request timeout to be kept, got %v", c.httpClient.Timeout)
+	}
+}
+
+func TestClient_TLSConfig_TrustsSelfSignedBackend(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer backend.Close()
+
+	s := DefaultSettings()
+	s.Retry = retry.Config{MaxRetries: 0}
+	if _, err := New(&http.Client{}, s).Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Fatal("expected the self-signed certificate to be rejected by default")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+	s.TLSConfig = &tls.Config{RootCAs: pool}
+	resp, err := New(&http.Client{}, s).Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secure" {
+		t.Errorf("expected the backend's response, got %q", body)
+	}
+}
+
+func TestNew_Pool(t *testing.T) {
+	s := DefaultSettings()
+	s.Pool = Pool{MaxIdleConns: 50, MaxIdleConnsPerHost: 10, MaxConnsPerHost: 20, IdleConnTimeout: 30 * time.Second}
+	c := New(&http.Client{}, s)
+	tr, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected an *http.Transport, got %T", c.httpClient.Transport)
+	}
+	if tr.MaxIdleConns != 50 || tr.MaxIdleConnsPerHost != 10 || tr.MaxConnsPerHost != 20 || tr.IdleConnTimeout != 30*time.Second {
+		t.Errorf("expected the transport to reflect the pool settings, got %d %d %d %v",
+			tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost, tr.IdleConnTimeout)
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost == 10 {
+		t.Error("expected the default transport to be left alone")
+	}
+
+	tr = New(nil, DefaultSettings()).httpClient.Transport.(*http.Transport)
+	if want := DefaultPool(); tr.MaxIdleConns != want.MaxIdleConns || tr.MaxIdleConnsPerHost != want.MaxIdleConnsPerHost || tr.IdleConnTimeout != want.IdleConnTimeout {
+		t.Errorf("expected the default pool, got %d %d %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	// A caller's own transport is cloned, keeping its settings where the
+	// pool has none, and left alone itself.
+	own := &http.Transport{MaxConnsPerHost: 5, MaxIdleConnsPerHost: 7, DisableCompression: true}
+	s.Pool = Pool{MaxIdleConns: -1, MaxIdleConnsPerHost: 10}
+	tr = New(&http.Client{Transport: own}, s).httpClient.Transport.(*http.Transport)
+	if tr == own {
+		t.Fatal("expected the caller's transport to be cloned")
+	}
+	if tr.MaxConnsPerHost != 5 || tr.MaxIdleConnsPerHost != 10 || tr.MaxIdleConns != 0 || !tr.DisableCompression {
+		t.Errorf("expected the caller's settings to be kept unless overridden, got %d %d %d %v",
+			tr.MaxConnsPerHost, tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tr.DisableCompression)
+	}
+	if own.MaxIdleConnsPerHost != 7 {
+		t.Error("expected the caller's transport to be left alone")
+	}
+}
+
+func TestClient_Do_RefusedConnectionIsConnectError(t *testing.T) {
+	s := DefaultSettings()
+	s.DialTimeout = 100 * time.Millisecond
+	c := New(nil, s)
+
+	_, err := c.Do("http://127.0.0.1:1", httptest.NewRequest(http.MethodGet, "/", nil))
+	if !IsConnectError(err) {
+		t.Errorf("expected a connect error, got %v", err)
+	}
+}
+
+func TestClient_HonorsSettings(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	}))
+	defer backend.Close()
+
+	s := Settings{
+		MaxRequests: 1,
+		Timeout:     1,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= 2
+		},
+	}
+	c := New(backend.Client(), s)
+	do := func() error {
+		resp, err := c.Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		var openErr *OpenError
+		if err := do(); err == nil || errors.As(err, &openErr) {
+			t.Fatalf("request %d: expected a backend failure, got %v", i, err)
+		}
+	}
+	var openErr *OpenError
+	if err := do(); !errors.As(err, &openErr) {
+		t.Fatalf("expected the breaker to open after exactly 2 failures, got %v", err)
+	}
+	if openErr.RetryAfter != time.Second {
+		t.Errorf("expected RetryAfter to follow Timeout, got %v", openErr.RetryAfter)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected the open breaker to keep requests from the backend, got %d calls", calls.Load())
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if err := do(); !errors.As(err, &openErr) {
+		t.Errorf("expected the breaker to stay open within Timeout, got %v", err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if err := do(); errors.As(err, &openErr) || calls.Load() != 3 {
+		t.Errorf("expected a half-open probe to reach the backend after Timeout, got %v (%d calls)", err, calls.Load())
+	}
+}
+
+func TestClient_OnStateChange(t *testing.T) {
+	type change struct {
+		target   string
+		from, to gobreaker.State
+	}
+	var changes []change
+	s := Settings{
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= 2
+		},
+		OnStateChange: func(target string, from, to gobreaker.State) {
+			changes = append(changes, change{target, from, to})
+		},
+	}
+	c := New(http.DefaultClient, s)
+
+	const target = "http://127.0.0.1:1"
+	for i := 0; i < 2; i++ {
+		if _, err := c.Do(target, httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+			t.Fatal("expected the refused connection to fail")
+		}
+	}
+	want := []change{{target, gobreaker.StateClosed, gobreaker.StateOpen}}
+	if len(changes) != 1 || changes[0] != want[0] {
+		t.Errorf("got %v, want %v", changes, want)
+	}
+}
+
+func TestClient_Close_StopsHealthTimers(t *testing.T) {
+	var mu sync.Mutex
+	var reports []bool
+	c := New(http.DefaultClient, Settings{
+		Timeout:     1,
+		ReadyToTrip: func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 1 },
+		OnHealthChange: func(target string, healthy bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, healthy)
+		},
+	})
+
+	if _, err := c.Do("http://127.0.0.1:1", httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Fatal("expected the refused connection to fail")
+	}
+	c.Close()
+	time.Sleep(1100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 1 || reports[0] {
+		t.Errorf("expected only the unhealthy report once closed, got %v", reports)
+	}
+}
+
+func TestClient_OverridesPerTarget(t *testing.T) {
+	const (
+		payments  = "http://127.0.0.1:1"
+		analytics = "http://127.0.0.2:1"
+	)
+	tripAt := func(n uint32) func(gobreaker.Counts) bool {
+		return func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= n }
+	}
+	s := Settings{
+		ReadyToTrip: tripAt(5),
+		Override: Overrides(map[string]Settings{
+			payments: {ReadyToTrip: tripAt(2), Timeout: 7},
+		}),
+	}
+	c := New(http.DefaultClient, s)
+
+	// failuresUntilOpen sends requests to target until its breaker rejects one.
+	failuresUntilOpen := func(target string) (int, *OpenError) {
+		for i := 0; i < 10; i++ {
+			_, err := c.Do(target, httptest.NewRequest(http.MethodGet, "/", nil))
+			var openErr *OpenError
+			if errors.As(err, &openErr) {
+				return i, openErr
+			}
+		}
+		t.Fatalf("%s: breaker never opened", target)
+		return 0, nil
+	}
+
+	n, openErr := failuresUntilOpen(payments)
+	if n != 2 {
+		t.Errorf("overridden target: expected to trip after 2 failures, got %d", n)
+	}
+	if openErr.RetryAfter != 7*time.Second {
+		t.Errorf("overridden target: expected RetryAfter of its own Timeout, got %v", openErr.RetryAfter)
+	}
+	n, openErr = failuresUntilOpen(analytics)
+	if n != 5 {
+		t.Errorf("default target: expected to trip after 5 failures, got %d", n)
+	}
+	if openErr.RetryAfter != 30*time.Second {
+		t.Errorf("default target: expected the default RetryAfter, got %v", openErr.RetryAfter)
+	}
+}
+
+func TestClient_IsFailure_CountsStatusCodes(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	c := New(backend.Client(), Settings{
+		ReadyToTrip: func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 3 },
+		IsFailure:   FailureStatus(http.StatusInternalServerError, http.StatusServiceUnavailable),
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Do %d: expected the 503 without an error, got %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Do %d: expected 503, got %d", i, resp.StatusCode)
+		}
+	}
+	if stats := c.Stats()[backend.URL]; stats.Failures != 3 || stats.State != "open" {
+		t.Errorf("expected 3 failures to open the breaker, got %+v", stats)
+	}
+	_, err := c.Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !errors.Is(err, ErrOpen) {
+		t.Errorf("expected the open breaker to reject the request, got %v", err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("expected the backend to see 3 requests, got %d", n)
+	}
+}
+
+func TestClient_RetryBudget(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	clk := clock.NewManual(time.Unix(1000, 0))
+	c := New(backend.Client(), Settings{
+		ReadyToTrip: func(gobreaker.Counts) bool { return false },
+		Retry: retry.Config{
+			MaxRetries:           3,
+			RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+			// One retry per 10s window, however much traffic there is.
+			Budget: retry.Budget{MinPerSecond: 0.1},
+		},
+		Clock: clk,
+	})
+
+	// attempts sends one request and returns how often it reached the backend.
+	attempts := func() int32 {
+		before := hits.Load()
+		resp, err := c.Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected the 503 to be passed through, got %d", resp.StatusCode)
+		}
+		return hits.Load() - before
+	}
+
+	if n := attempts(); n != 2 {
+		t.Errorf("first request: expected 1 retry before the budget ran out, got %d attempts", n)
+	}
+	for i := 0; i < 3; i++ {
+		if n := attempts(); n != 1 {
+			t.Errorf("request with spent budget: expected no retries, got %d attempts", n)
+		}
+	}
+	clk.Advance(10 * time.Second)
+	if n := attempts(); n != 2 {
+		t.Errorf("after the budget refilled: expected 1 retry, got %d attempts", n)
+	}
+}
+
+func TestClient_RetryDeadline_StopsEarly(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	cfg := retry.Config{
+		MaxRetries:           5,
+		InitialBackoff:       100 * time.Millisecond,
+		MaxBackoff:           time.Second,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+		MinAttempt:           20 * time.Millisecond,
+	}
+	withDeadline := cfg
+	withDeadline.Deadline = 250 * time.Millisecond
+
+	for _, tt := range []struct {
+		name    string
+		retry   retry.Config
+		timeout time.Duration
+	}{
+		{"Retry.Deadline", withDeadline, 0},
+		{"request deadline", cfg, 250 * time.Millisecond},
+	} {
+		hits.Store(0)
+		c := New(backend.Client(), Settings{
+			ReadyToTrip: func(gobreaker.Counts) bool { return false },
+			Retry:       tt.retry,
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.timeout > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), tt.timeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+
+		// The first retry fits after 100ms; the second, after another
+		// 200ms, would not leave 20ms for the attempt.
+		start := time.Now()
+		resp, err := c.Do(backend.URL, req)
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatalf("%s: Do: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected the last 503 to be passed through, got %d", tt.name, resp.StatusCode)
+		}
+		if n := hits.Load(); n != 2 {
+			t.Errorf("%s: expected 2 attempts before the deadline, got %d", tt.name, n)
+		}
+		if elapsed >= 250*time.Millisecond {
+			t.Errorf("%s: expected to return before the deadline, took %v", tt.name, elapsed)
+		}
+	}
+}
+
+func TestClient_CanceledRequestStopsRetrying(t *testing.T) {
+	var hits atomic.Int32
+	arrived := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		arrived <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	c := New(backend.Client(), Settings{
+		ReadyToTrip: func(gobreaker.Counts) bool { return false },
+		Retry:       retry.Config{MaxRetries: 3},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	_, err := c.Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the backend call to be aborted")
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected no retries after the cancellation, got %d attempts", n)
+	}
+	if s := c.Stats()[backend.URL]; s.Failures != 0 {
+		t.Errorf("expected the cancellation not to count against the backend, got %+v", s)
+	}
+}
+
+func TestClient_CanceledProbeKeepsBreakerHalfOpen(t *testing.T) {
+	var mode atomic.Value // "fail", "hang" or "ok"
+	mode.Store("fail")
+	arrived := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch mode.Load() {
+		case "fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "hang":
+			arrived <- struct{}{}
+			<-r.Context().Done()
+		}
+	}))
+	defer backend.Close()
+
+	c := New(backend.Client(), Settings{
+		MaxRequests: 1,
+		Timeout:     1,
+		ReadyToTrip: func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 1 },
+		IsFailure:   FailureStatus(http.StatusInternalServerError),
+	})
+	get := func(ctx context.Context) (*http.Response, error) {
+		return c.Do(backend.URL, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	}
+
+	resp, err := get(context.Background())
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+	time.Sleep(1100 * time.Millisecond)
+	if got := c.States()[backend.URL]; got != gobreaker.StateHalfOpen {
+		t.Fatalf("expected the breaker to half-open, got %v", got)
+	}
+
+	mode.Store("hang")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	if _, err := get(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if got := c.States()[backend.URL]; got != gobreaker.StateHalfOpen {
+		t.Fatalf("expected the canceled probe to leave the breaker half-open, got %v", got)
+	}
+
+	// The canceled probe's slot goes to the next one, which closes the breaker.
+	mode.Store("ok")
+	resp, err = get(context.Background())
+	if err != nil {
+		t.Fatalf("expected the next probe through, got %v", err)
+	}
+	resp.Body.Close()
+	if got := c.States()[backend.URL]; got != gobreaker.StateClosed {
+		t.Errorf("expected the successful probe to close the breaker, got %v", got)
+	}
+}
+
+func TestClient_MaxRetryBody(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	c := New(backend.Client(), Settings{
+		ReadyToTrip: func(gobreaker.Counts) bool { return false },
+		Retry: retry.Config{
+			MaxRetries:           2,
+			InitialBackoff:       time.Millisecond,
+			MaxBackoff:           time.Millisecond,
+			RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+		},
+		MaxRetryBody: 16,
+	})
+	// send posts body, of unknown length if chunked, and returns what the
+	// backend received.
+	send := func(body string, chunked bool) []string {
+		bodies = nil
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		resp, err := c.DoNext(req, func(int, error, bool) string { return backend.URL })
+		if err != nil {
+			t.Fatalf("DoNext: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected the last 503 to be passed through, got %d", resp.StatusCode)
+		}
+		return bodies
+	}
+
+	small := "0123456789"
+	if got := send(small, false); len(got) != 3 || got[0] != small || got[2] != small {
+		t.Errorf("small body: expected 3 attempts carrying it, got %q", got)
+	}
+	large := strings.Repeat("abcdefgh", 8)
+	for _, chunked := range []bool{false, true} {
+		if got := send(large, chunked); len(got) != 1 || got[0] != large {
+			t.Errorf("large body (chunked %v): expected a single attempt carrying it, got %d attempts", chunked, len(got))
+		}
+	}
+
+	// Known to be too large, the body is handed on without being read.
+	body := &countingReader{r: strings.NewReader(large)}
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.ContentLength = int64(len(large))
+	b, err := bufferBody(req, 16)
+	if err != nil {
+		t.Fatalf("bufferBody: %v", err)
+	}
+	if b.replayable() || body.n != 0 {
+		t.Errorf("expected the body to be streamed unread, read %d bytes", body.n)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestNew_ZeroSettingsUseDefaults(t *testing.T) {
+	c := New(nil, Settings{})
+	d := DefaultSettings()
+	if c.settings.MaxRequests != d.MaxRequests || c.settings.Interval != d.Interval || c.settings.Timeout != d.Timeout || c.settings.ReadyToTrip == nil {
+		t.Errorf("expected defaults, got %+v", c.settings)
+	}
+	if c.openFor != 30*time.Second {
+		t.Errorf("expected a 30s open timeout, got %v", c.openFor)
+	}
+}
+
+func TestBuildForwardURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		path  string
+		query string
+		want  string
+	}{
+		{"empty base path", "http://host", "/echo/foo", "", "http://host/echo/foo"},
+		{"root base path", "http://host/", "/echo/foo", "", "http://host/echo/foo"},
+		{"base path", "http://host/api/v1", "/echo/foo", "", "http://host/api/v1/echo/foo"},
+		{"base path with trailing slash", "http://host/api/", "/echo", "", "http://host/api/echo"},
+		{"root request path", "http://host/api", "/", "", "http://host/api/"},
+		{"root request path, empty base", "http://host", "/", "", "http://host/"},
+		{"query", "http://host/api", "/echo", "a=1&b=2", "http://host/api/echo?a=1&b=2"},
+		{"no scheme", "host:8080/api", "/echo", "", "http://host:8080/api/echo"},
+		{"websocket scheme", "ws://host:8080", "/chat", "", "http://host:8080/chat"},
+		{"secure websocket scheme", "wss://host", "/chat", "", "https://host/chat"},
+		{"unix socket", "unix:///run/svc.sock", "/echo", "a=1", "http://" + unixHost("/run/svc.sock") + "/echo?a=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildForwardURL(tt.base, tt.path, tt.query)
+			if err != nil {
+				t.Fatalf("buildForwardURL: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
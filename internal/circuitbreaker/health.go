@@ -0,0 +1,55 @@
+package circuitbreaker
+
+import (
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// healthHook returns the OnStateChange for b that also reports its target's
+// health to Settings.OnHealthChange: unhealthy when the breaker opens,
+// healthy again when it half-opens to let probes through. An open breaker
+// only half-opens when asked for its state, which nobody would do for a
+// target no longer selected, so b's health timer asks once the open timeout
+// has passed. Without OnHealthChange next is returned unchanged.
+func (c *Client) healthHook(next func(target string, from, to gobreaker.State), b *breaker) func(target string, from, to gobreaker.State) {
+	report := c.settings.OnHealthChange
+	if report == nil {
+		return next
+	}
+	return func(target string, from, to gobreaker.State) {
+		if next != nil {
+			next(target, from, to)
+		}
+		b.stopHealthTimer()
+		switch to {
+		case gobreaker.StateOpen:
+			report(target, false)
+			b.mu.Lock()
+			b.healthTimer = time.AfterFunc(b.openFor+time.Millisecond, func() { b.cb.State() })
+			b.mu.Unlock()
+		case gobreaker.StateHalfOpen:
+			report(target, true)
+		}
+	}
+}
+
+// stopHealthTimer stops b's pending health timer, if any.
+func (b *breaker) stopHealthTimer() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.healthTimer != nil {
+		b.healthTimer.Stop()
+		b.healthTimer = nil
+	}
+}
+
+// Close stops the timers breakers keep to report health to
+// Settings.OnHealthChange. Call it once the Client is no longer used.
+func (c *Client) Close() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, b := range c.breakers {
+		b.stopHealthTimer()
+	}
+}
@@ -0,0 +1,70 @@
+package circuitbreaker
+
+import (
+	"net/http"
+	"time"
+)
+
+// Pool sizes the connection pool to targets. net/http's defaults keep only
+// two idle connections per host, so under load most requests to a busy
+// instance would dial a new connection.
+type Pool struct {
+	MaxIdleConns        int           // Idle connections kept across all targets; negative for no limit
+	MaxIdleConnsPerHost int           // Idle connections kept per target
+	MaxConnsPerHost     int           // Connections per target, dialing or in use; negative for no limit
+	IdleConnTimeout     time.Duration // How long an idle connection is kept
+}
+
+// DefaultPool returns pool sizes suited to a gateway forwarding a lot of
+// traffic to a modest number of instances.
+func DefaultPool() Pool {
+	return Pool{
+		MaxIdleConns:        1000,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// withPool returns a copy of c whose transport, a clone of c's own, pools
+// connections as p says. Zero fields of p keep what c's transport sets and,
+// where it sets nothing or c uses net/http's default transport, take the
+// values from DefaultPool (no limit for MaxConnsPerHost). c is returned
+// unchanged if its transport cannot be configured.
+func withPool(c *http.Client, p Pool) *http.Client {
+	t, ok := cloneTransport(c)
+	if !ok {
+		return c
+	}
+	if c.Transport == nil || c.Transport == http.DefaultTransport {
+		t.MaxIdleConns, t.MaxIdleConnsPerHost, t.MaxConnsPerHost, t.IdleConnTimeout = 0, 0, 0, 0
+	}
+	defaults := DefaultPool()
+	t.MaxIdleConns = poolSize(p.MaxIdleConns, t.MaxIdleConns, defaults.MaxIdleConns)
+	t.MaxIdleConnsPerHost = poolSize(p.MaxIdleConnsPerHost, t.MaxIdleConnsPerHost, defaults.MaxIdleConnsPerHost)
+	t.MaxConnsPerHost = poolSize(p.MaxConnsPerHost, t.MaxConnsPerHost, defaults.MaxConnsPerHost)
+	switch {
+	case p.IdleConnTimeout > 0:
+		t.IdleConnTimeout = p.IdleConnTimeout
+	case t.IdleConnTimeout <= 0:
+		t.IdleConnTimeout = defaults.IdleConnTimeout
+	}
+
+	clone := *c
+	clone.Transport = t
+	return &clone
+}
+
+// poolSize picks a pool limit: set if given, negative meaning no limit,
+// else the transport's own, else def.
+func poolSize(set, own, def int) int {
+	switch {
+	case set < 0:
+		return 0
+	case set > 0:
+		return set
+	case own > 0:
+		return own
+	default:
+		return def
+	}
+}
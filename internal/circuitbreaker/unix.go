@@ -0,0 +1,73 @@
+package circuitbreaker
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixHostSuffix ends the synthetic host that stands in for a UNIX socket in
+// forward URLs. The socket path is hex-encoded in front of it, so the dialer
+// can recover it and connections to different sockets are pooled apart.
+// Hosts under .invalid never resolve, so none is mistaken for a real one.
+const unixHostSuffix = ".unix.invalid"
+
+// unixHost returns the synthetic host for the socket at path.
+func unixHost(path string) string {
+	return hex.EncodeToString([]byte(path)) + unixHostSuffix
+}
+
+// unixSocket returns the socket path a synthetic host, with or without a
+// port, stands for.
+func unixSocket(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	encoded, ok := strings.CutSuffix(host, unixHostSuffix)
+	if !ok {
+		return "", false
+	}
+	path, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+// withUnixSockets returns a copy of c whose transport connects to synthetic
+// UNIX socket hosts through the socket, bypassing any proxy, and to other
+// hosts as before. c is returned unchanged if its transport cannot be
+// configured.
+func withUnixSockets(c *http.Client) *http.Client {
+	t, ok := cloneTransport(c)
+	if !ok {
+		return c
+	}
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := unixSocket(addr); ok {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return dial(ctx, network, addr)
+	}
+	if proxy := t.Proxy; proxy != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if _, ok := unixSocket(req.URL.Host); ok {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+	}
+
+	clone := *c
+	clone.Transport = t
+	return &clone
+}
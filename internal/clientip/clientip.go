@@ -0,0 +1,103 @@
+// Package clientip determines the address of the client behind a request.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver determines client IPs. X-Forwarded-For and X-Real-IP are only
+// honored when the request comes from a trusted proxy, so clients cannot
+// claim another address. A nil Resolver trusts no proxy.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver creates a Resolver trusting proxies within the given prefixes.
+func NewResolver(trustedProxies ...netip.Prefix) *Resolver {
+	return &Resolver{trusted: trustedProxies}
+}
+
+// ParsePrefixes parses a list of CIDRs such as "10.0.0.0/8". A bare address
+// stands for itself alone.
+func ParsePrefixes(s []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(s))
+	for _, v := range s {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", v, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", v, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// FromRequest returns the original client's IP. For requests from an
+// untrusted peer that is the host of RemoteAddr. From a trusted proxy it is
+// the rightmost X-Forwarded-For entry that is not itself a trusted proxy,
+// or else X-Real-IP. It returns "" for a nil request.
+func (r *Resolver) FromRequest(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		client = host
+	}
+	if !r.trusts(client) {
+		return client
+	}
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		// X-Forwarded-For: client, proxy1, proxy2 — each proxy appends the
+		// peer it received the request from, so walk back from the right
+		// until leaving the trusted hops.
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				break
+			}
+			client = hop
+			if !r.trusts(hop) {
+				break
+			}
+		}
+		return client
+	}
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+		if _, err := netip.ParseAddr(realIP); err == nil {
+			return realIP
+		}
+	}
+	return client
+}
+
+// trusts reports whether ip belongs to a trusted proxy.
+func (r *Resolver) trusts(ip string) bool {
+	if r == nil || len(r.trusted) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
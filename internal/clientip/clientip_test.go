@@ -0,0 +1,69 @@
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestResolver_FromRequest(t *testing.T) {
+	trusted, err := ParsePrefixes([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("ParsePrefixes: %v", err)
+	}
+	r := NewResolver(trusted...)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{"remote addr", "203.0.113.9:5000", "", "", "203.0.113.9"},
+		{"remote addr without port", "203.0.113.9", "", "", "203.0.113.9"},
+		{"spoofed XFF from untrusted peer", "203.0.113.9:5000", "198.51.100.1", "", "203.0.113.9"},
+		{"spoofed X-Real-IP from untrusted peer", "203.0.113.9:5000", "", "198.51.100.1", "203.0.113.9"},
+		{"XFF from trusted peer", "192.0.2.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"XFF through trusted hops", "10.0.0.1:5000", "198.51.100.1, 10.0.0.2 , 10.0.0.3", "", "198.51.100.1"},
+		{"client-supplied XFF prefix ignored", "10.0.0.1:5000", "1.2.3.4, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"only trusted hops", "10.0.0.1:5000", "10.0.0.2", "", "10.0.0.2"},
+		{"garbage hop", "10.0.0.1:5000", "198.51.100.1, not-an-ip, 10.0.0.2", "", "10.0.0.2"},
+		{"X-Real-IP from trusted peer", "10.0.0.1:5000", "", "198.51.100.1", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := r.FromRequest(req); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+	if got := r.FromRequest(nil); got != "" {
+		t.Errorf("nil request: expected empty, got %q", got)
+	}
+}
+
+func TestResolver_NilTrustsNoProxy(t *testing.T) {
+	var r *Resolver
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := r.FromRequest(req); got != "10.0.0.1" {
+		t.Errorf("expected the remote address, got %q", got)
+	}
+}
+
+func TestParsePrefixes_Invalid(t *testing.T) {
+	if _, err := ParsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+	if p, err := ParsePrefixes([]string{"::1"}); err != nil || p[0] != netip.MustParsePrefix("::1/128") {
+		t.Errorf("expected ::1/128, got %v, %v", p, err)
+	}
+}
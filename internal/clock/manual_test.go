@@ -0,0 +1,37 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManual_AdvanceFiresDueAfters(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewManual(start)
+	soon, later := c.After(time.Second), c.After(time.Minute)
+
+	c.Advance(time.Second)
+	select {
+	case got := <-soon:
+		if !got.Equal(start.Add(time.Second)) {
+			t.Errorf("expected %v, got %v", start.Add(time.Second), got)
+		}
+	default:
+		t.Fatal("expected After(1s) to fire once the clock moved 1s")
+	}
+	select {
+	case <-later:
+		t.Fatal("expected After(1m) not to fire yet")
+	default:
+	}
+
+	c.Advance(time.Minute)
+	select {
+	case <-later:
+	default:
+		t.Fatal("expected After(1m) to fire once the clock moved past it")
+	}
+	if got := c.Now(); !got.Equal(start.Add(time.Minute + time.Second)) {
+		t.Errorf("expected Now to be %v, got %v", start.Add(time.Minute+time.Second), got)
+	}
+}
@@ -0,0 +1,195 @@
+package dispatcher
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kerberos/internal/clock"
+)
+
+// Cache is an in-memory LRU cache of GET responses, for read-heavy services.
+// It stores 200 responses that carry a positive Cache-Control max-age, for
+// that long. Responses marked no-store, no-cache or private, or that set a
+// cookie, are never stored, and neither are requests with credentials. It is
+// safe for concurrent use.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64                    // sum of cached body sizes, guarded by mu
+	entries  map[string]*list.Element // key -> element holding *cacheEntry, guarded by mu
+	lru      *list.List               // most recently used at the front, guarded by mu
+	clock    clock.Clock
+}
+
+type cacheEntry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache creates a cache holding at most maxBytes of response bodies. The
+// least recently used responses are evicted to make room.
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		clock:    clock.Real,
+	}
+}
+
+// WithCache answers GET requests from c while a fresh response is cached, and
+// caches cacheable responses once their body has been read in full.
+func WithCache(c *Cache) Option {
+	return func(d *Dispatcher) {
+		d.cache = c
+	}
+}
+
+// Len returns the number of cached responses, including expired ones not yet
+// evicted.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// responseCacheKey identifies r's response within service.
+func responseCacheKey(service string, r *http.Request) string {
+	return service + " " + r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery
+}
+
+// cacheableRequest reports whether r's response may be served from or stored
+// in the cache.
+func cacheableRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Authorization") == ""
+}
+
+// get returns a copy of the fresh response cached under key, or nil.
+func (c *Cache) get(key string) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	now := c.clock.Now()
+	if !now.Before(e.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+	}
+}
+
+// fill wraps resp's body so that, if resp is cacheable, it is stored under
+// key once read to the end. Other responses are returned unchanged.
+func (c *Cache) fill(key string, resp *http.Response) io.ReadCloser {
+	ttl := freshness(resp)
+	if ttl <= 0 || resp.ContentLength > c.maxBytes {
+		return resp.Body
+	}
+	return &cacheFill{ReadCloser: resp.Body, cache: c, key: key, header: resp.Header.Clone(), ttl: ttl}
+}
+
+// freshness returns how long resp may be cached, or 0 if it must not be.
+// Responses that vary with request headers are not cached: the key does not
+// include them, so one client's negotiated response would reach others.
+func freshness(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusOK || len(resp.Header.Values("Set-Cookie")) > 0 ||
+		len(resp.Header.Values("Vary")) > 0 {
+		return 0
+	}
+	maxAge := -1
+	for _, v := range resp.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0
+			case "max-age":
+				if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					maxAge = n
+				}
+			}
+		}
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+	return time.Duration(maxAge) * time.Second
+}
+
+func (c *Cache) put(key string, header http.Header, body []byte, ttl time.Duration) {
+	size := int64(len(body))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	now := c.clock.Now()
+	e := &cacheEntry{key: key, header: header, body: body, stored: now, expires: now.Add(ttl)}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops el from the cache. Caller must hold c.mu.
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// cacheFill copies a response body as it is read and caches it at EOF. Bodies
+// that outgrow the cache are passed through without being kept.
+type cacheFill struct {
+	io.ReadCloser
+	cache    *Cache
+	key      string
+	header   http.Header
+	ttl      time.Duration
+	buf      bytes.Buffer
+	overflow bool
+	stored   bool
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.overflow {
+		if int64(f.buf.Len()+n) > f.cache.maxBytes {
+			f.overflow = true
+			f.buf = bytes.Buffer{}
+		} else {
+			f.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !f.overflow && !f.stored {
+		f.stored = true
+		f.cache.put(f.key, f.header, f.buf.Bytes(), f.ttl)
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package dispatcher
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/registry"
+)
+
+func TestDispatcher_Cache(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		setCookie    bool
+		vary         string
+		wantCalls    int
+	}{
+		{"max-age is cached", "public, max-age=60", false, "", 1},
+		{"no-store bypasses the cache", "no-store", false, "", 2},
+		{"no max-age is not cached", "", false, "", 2},
+		{"Set-Cookie is not cached", "max-age=60", true, "", 2},
+		{"Vary is not cached", "max-age=60", false, "Accept-Language", 2},
+		{"Vary: * is not cached", "max-age=60", false, "*", 2},
+	}
+	for _, tt := range tests {
+		calls := 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if tt.cacheControl != "" {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+			}
+			if tt.setCookie {
+				w.Header().Set("Set-Cookie", "session=abc")
+			}
+			if tt.vary != "" {
+				w.Header().Set("Vary", tt.vary)
+			}
+			w.Write([]byte("report"))
+		}))
+
+		r := registry.New()
+		r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+		b := balancer.New(balancer.RoundRobin, r)
+		cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+		disp := New(b, cb, WithCache(NewCache(1<<20)))
+
+		for i := 0; i < 2; i++ {
+			resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/reports?year=2026", nil))
+			if err != nil {
+				t.Fatalf("%s: Forward: %v", tt.name, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "report" {
+				t.Errorf("%s: request %d: got %d %q", tt.name, i, resp.StatusCode, body)
+			}
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("%s: expected %d backend calls, got %d", tt.name, tt.wantCalls, calls)
+		}
+		backend.Close()
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(10)
+	header := http.Header{}
+	c.put("a", header, []byte("aaaa"), time.Minute)
+	c.put("b", header, []byte("bbbb"), time.Minute)
+	c.get("a")
+	c.put("c", header, []byte("cccc"), time.Minute)
+
+	if c.get("b") != nil {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if c.get("a") == nil || c.get("c") == nil {
+		t.Error("expected the recently used entries to stay")
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", c.Len())
+	}
+}
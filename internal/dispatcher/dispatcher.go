@@ -2,42 +2,464 @@ package dispatcher
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"kerberos/internal/balancer"
 	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/latency"
+	"kerberos/internal/registry"
 )
 
+// ReasonHeader explains responses generated by the gateway itself rather
+// than a backend, e.g. "no-instances", so clients can back off sensibly.
+const ReasonHeader = "X-Gateway-Reason"
+
 // Dispatcher forwards incoming HTTP requests to backend services.
 type Dispatcher struct {
-	balancer *balancer.Balancer
-	client   *circuitbreaker.Client
+	balancer    *balancer.Balancer
+	client      *circuitbreaker.Client
+	loadHeader  string
+	failFast    bool
+	latency     *latency.Tracker
+	eject       registry.Store
+	known       registry.Store
+	noKeepAlive map[string]bool
+	events      chan<- Event
+	cache       *Cache
+
+	lastResort time.Duration // min interval between probes; 0 disables
+	probeMu    sync.Mutex
+	probes     map[string]time.Time // service -> last probe, guarded by probeMu
+}
+
+// Option configures a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithLoadHeader feeds the load backends report in the named response header
+// (e.g. "X-Backend-Load: 0.8") back to the balancer, so weighted strategies
+// shift traffic away from loaded instances.
+func WithLoadHeader(name string) Option {
+	return func(d *Dispatcher) {
+		d.loadHeader = name
+	}
+}
+
+// WithFailFast skips instances the circuit breaker reports as unavailable
+// (breaker open, or Settings.UnavailableAfter failures in a row, the last
+// within the breaker's timeout) instead of retrying into them. When no
+// other instance is left, the request fails fast with 503.
+func WithFailFast() Option {
+	return func(d *Dispatcher) {
+		d.failFast = true
+	}
+}
+
+// WithLatency records per-service in-flight requests and the time until
+// response headers arrive in t.
+func WithLatency(t *latency.Tracker) Option {
+	return func(d *Dispatcher) {
+		d.latency = t
+	}
+}
+
+// WithEjectInvalid unregisters instances from reg once their address turns
+// out to be unparseable, so later requests no longer select them. Without it
+// such instances are only skipped for the request that found them.
+func WithEjectInvalid(reg registry.Store) Option {
+	return func(d *Dispatcher) {
+		d.eject = registry.StoreOrNil(reg)
+	}
+}
+
+// WithUnknownServices answers requests routed to a service reg does not know
+// with 404 and reason "unknown-service", telling a name that was never
+// registered apart from a service that is only down. A known service left
+// without instances is still answered 503 with reason "no-instances". See
+// registry.Known for stores other than *registry.Registry.
+func WithUnknownServices(reg registry.Store) Option {
+	return func(d *Dispatcher) {
+		d.known = registry.StoreOrNil(reg)
+	}
+}
+
+// WithNoKeepAlive forwards requests for the named services without
+// keep-alive and without chunked bodies, for legacy backends that only
+// handle one request per connection and need a Content-Length. Requests are
+// still sent as HTTP/1.1.
+func WithNoKeepAlive(services ...string) Option {
+	return func(d *Dispatcher) {
+		if d.noKeepAlive == nil {
+			d.noKeepAlive = make(map[string]bool)
+		}
+		for _, s := range services {
+			d.noKeepAlive[s] = true
+		}
+	}
+}
+
+// WithLastResort lets one probe request per interval through when fail-fast
+// has ruled out every instance of a service, instead of answering 503. The
+// probe goes to the instance whose last failure is oldest, past its circuit
+// breaker even while that is open, so the gateway notices when a backend has
+// recovered.
+func WithLastResort(interval time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.lastResort = interval
+	}
 }
 
 // New creates a dispatcher.
-func New(b *balancer.Balancer, c *circuitbreaker.Client) *Dispatcher {
-	return &Dispatcher{
+func New(b *balancer.Balancer, c *circuitbreaker.Client, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
 		balancer: b,
 		client:   c,
+		probes:   make(map[string]time.Time),
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
 // Forward selects an instance for the service, forwards the request through
 // the circuit breaker, and streams the response back.
 // Returns the response and error. Caller is responsible for closing the response body.
 func (d *Dispatcher) Forward(serviceName string, r *http.Request) (*http.Response, error) {
-	instance := d.balancer.Select(serviceName, r)
-	if instance == nil {
+	return d.ForwardRoute(RouteResult{Service: serviceName}, r)
+}
+
+// ForwardRoute is like Forward but honors the tag constraints, path rewrite
+// and timeouts carried by the route.
+//
+// Every attempt, including retries, selects an instance anew and avoids the
+// instances already tried for the request while others are left. An instance
+// whose address cannot be parsed, that cannot be connected to, or whose
+// breaker is open is not tried again for the request; that costs no retry.
+// With WithEjectInvalid instances with unparseable addresses are also removed
+// from the registry. If every instance fails, the last error is returned.
+func (d *Dispatcher) ForwardRoute(route RouteResult, r *http.Request) (*http.Response, error) {
+	d.emit(Event{Type: EventRouted, Service: route.Service})
+	var cacheKey string
+	if d.cache != nil && cacheableRequest(r) {
+		cacheKey = responseCacheKey(route.Service, r)
+		if resp := d.cache.get(cacheKey); resp != nil {
+			d.emit(Event{Type: EventResponse, Service: route.Service, Status: resp.StatusCode})
+			return resp, nil
+		}
+	}
+	fwd := r
+	if route.Rewrite != nil {
+		fwd = r.Clone(r.Context())
+		fwd.URL.Path = route.Rewrite(fwd.URL.Path)
+		if !strings.HasPrefix(fwd.URL.Path, "/") {
+			// e.g. trimming "/echo" from "/echo" leaves an empty path.
+			fwd.URL.Path = "/" + fwd.URL.Path
+		}
+		fwd.URL.RawPath = ""
+	}
+
+	cancel := func() {}
+	if route.Timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(fwd.Context(), route.Timeout)
+		fwd = fwd.WithContext(ctx)
+	}
+	opts := circuitbreaker.RequestOptions{
+		NoKeepAlive:           d.noKeepAlive[route.Service],
+		ResponseHeaderTimeout: route.HeaderTimeout,
+	}
+	if opts != (circuitbreaker.RequestOptions{}) {
+		fwd = fwd.WithContext(circuitbreaker.WithRequestOptions(fwd.Context(), opts))
+	}
+	var probe string // address of a last-resort probe, sent past its open breaker
+	if d.failFast && d.lastResort > 0 {
+		fwd = fwd.WithContext(circuitbreaker.WithProbe(fwd.Context(), func(target string) bool {
+			return target == probe
+		}))
+	}
+
+	var instance *registry.Instance   // target of the current attempt
+	var failed string                 // ID of the instance that failed last
+	var attemptStart time.Time        // when the current attempt was sent
+	excluded := make(map[string]bool) // IDs of instances that could not be sent to
+	tried := make(map[string]bool)    // IDs of instances that failed an attempt
+	var unavailable string            // why the last selection found no instance
+	next := func(n int, lastErr error, untried bool) string {
+		if instance != nil {
+			failed = instance.ID
+			d.balancer.Done(route.Service, instance)
+			var badAddr *circuitbreaker.InvalidTargetError
+			var open *circuitbreaker.OpenError
+			switch {
+			case errors.As(lastErr, &badAddr):
+				excluded[instance.ID] = true
+				if d.eject != nil {
+					d.eject.Unregister(route.Service, instance.ID)
+				}
+			case errors.As(lastErr, &open):
+				excluded[instance.ID] = true
+			default:
+				tried[instance.ID] = true
+				d.reportFailure(route.Service, instance.ID, r)
+			}
+		}
+		var probing bool
+		instance, unavailable, probing = d.selectInstance(route, r, n, excluded, tried, untried)
+		if instance == nil {
+			return ""
+		}
+		probe = ""
+		if probing {
+			probe = instance.Addr
+		}
+		if lastErr != nil {
+			d.emit(Event{Type: EventRetry, Service: route.Service, Instance: failed, Attempt: n, Reason: lastErr.Error()})
+		}
+		d.emit(Event{Type: EventSelected, Service: route.Service, Instance: instance.ID})
+		d.emit(Event{Type: EventAttempt, Service: route.Service, Instance: instance.ID, Attempt: n})
+		attemptStart = time.Now()
+		return instance.Addr
+	}
+
+	if d.latency != nil {
+		d.latency.Begin(route.Service)
+	}
+	// done releases everything held for the request once it has completed.
+	done := func() {
+		cancel()
+		d.balancer.Done(route.Service, instance)
+		if d.latency != nil {
+			d.latency.End(route.Service)
+		}
+	}
+
+	start := time.Now()
+	resp, err := d.client.DoNext(fwd, next)
+	var badAddr *circuitbreaker.InvalidTargetError
+	if errors.Is(err, circuitbreaker.ErrNoTarget) || errors.As(err, &badAddr) {
+		// Nothing could be sent to any instance.
+		done()
+		status, reason := http.StatusServiceUnavailable, unavailable
+		if reason == "" {
+			reason = "no-instances"
+		}
+		if reason == "no-instances" && d.known != nil && !registry.Known(d.known, route.Service) {
+			status, reason = http.StatusNotFound, "unknown-service"
+		}
+		d.emit(Event{Type: EventError, Service: route.Service, Reason: reason})
 		return &http.Response{
-			StatusCode: http.StatusServiceUnavailable,
+			StatusCode: status,
+			Header:     http.Header{ReasonHeader: {reason}},
 			Body:       io.NopCloser(bytes.NewReader(nil)),
 		}, nil
 	}
+	if err != nil {
+		var open *circuitbreaker.OpenError
+		if instance != nil {
+			failed = instance.ID
+			if !errors.As(err, &open) {
+				d.reportFailure(route.Service, instance.ID, r)
+			}
+		}
+		done()
+		d.emit(Event{Type: EventError, Service: route.Service, Instance: failed, Reason: err.Error()})
+		return nil, err
+	}
+	if d.latency != nil {
+		d.latency.Observe(route.Service, time.Since(start))
+	}
+	d.emit(Event{Type: EventResponse, Service: route.Service, Instance: instance.ID, Status: resp.StatusCode})
+	d.balancer.ReportLatency(route.Service, instance.ID, time.Since(attemptStart))
+	d.balancer.ReportResult(route.Service, instance.ID, resp.StatusCode >= http.StatusInternalServerError)
+	if d.loadHeader != "" {
+		if load, err := strconv.ParseFloat(resp.Header.Get(d.loadHeader), 64); err == nil {
+			d.balancer.ReportLoad(route.Service, instance.ID, load)
+		}
+	}
+	if cacheKey != "" {
+		resp.Body = d.cache.fill(cacheKey, resp)
+	}
+	if c := d.balancer.AffinityCookie(route.Service, r, *instance); c != nil {
+		// Added after caching, so the cookie is not stored for other clients.
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+	// The request is complete, and any route deadline may be released, only
+	// once the caller has finished reading the body.
+	resp.Body = &closeHook{ReadCloser: resp.Body, fn: done, instance: instance.ID}
+	return resp, nil
+}
+
+// selectInstance picks the instance for attempt n of a request on route,
+// never one in excluded and one in tried only if nothing else is left and
+// untried is not set. Without an instance it returns the reason advertised
+// to the client: "instances-unavailable" if fail-fast ruled out an instance,
+// "at-capacity" if one was at its concurrency cap, "draining" or "unhealthy"
+// if every instance is, and "no-instances" otherwise. probe reports whether
+// the instance is a last-resort probe past its breaker (see WithLastResort).
+func (d *Dispatcher) selectInstance(route RouteResult, r *http.Request, n int, excluded, tried map[string]bool, untried bool) (instance *registry.Instance, reason string, probe bool) {
+	skipped, full := false, false
+	var oldest string // skipped instance whose last failure is oldest
+	var oldestAt time.Time
+	usable := func(inst registry.Instance) bool {
+		if excluded[inst.ID] || !inst.HasTags(route.Tags) {
+			return false
+		}
+		// A failure from this request's own attempt is no reason to skip.
+		if d.failFast && !tried[inst.ID] && d.client.Unavailable(inst.Addr) {
+			if at := d.client.LastFailure(inst.Addr); !skipped || at.Before(oldestAt) {
+				oldest, oldestAt = inst.ID, at
+			}
+			skipped = true
+			return false
+		}
+		if d.balancer.Full(route.Service, inst) {
+			full = true
+			return false
+		}
+		return true
+	}
+	instance, reason = d.balancer.SelectMatchingReason(route.Service, r, func(inst registry.Instance) bool {
+		return !tried[inst.ID] && usable(inst)
+	})
+	if instance == nil && len(tried) > 0 && !untried {
+		instance, reason = d.balancer.SelectMatchingReason(route.Service, r, usable)
+	}
+	if instance == nil && skipped && n == 1 && d.allowProbe(route.Service) {
+		instance = d.balancer.SelectMatching(route.Service, r, func(inst registry.Instance) bool {
+			return inst.ID == oldest
+		})
+		probe = instance != nil
+	}
+	switch {
+	case instance != nil:
+		return instance, "", probe
+	case skipped:
+		return nil, "instances-unavailable", false
+	case full:
+		return nil, "at-capacity", false
+	case reason == "draining" || reason == "unhealthy":
+		return nil, reason, false
+	}
+	return nil, "no-instances", false
+}
+
+// reportFailure tells outlier detection that an attempt on the instance
+// failed, unless it failed because the client went away.
+func (d *Dispatcher) reportFailure(service, id string, r *http.Request) {
+	if r.Context().Err() == nil {
+		d.balancer.ReportResult(service, id, true)
+	}
+}
+
+// InFlight returns the number of requests forwarded to the instance that have
+// not completed yet.
+func (d *Dispatcher) InFlight(serviceName, instanceID string) int {
+	return d.balancer.InFlight(serviceName, instanceID)
+}
+
+// Stats returns the request counters of every instance address the
+// dispatcher has forwarded to, keyed by address. See circuitbreaker.Stats.
+func (d *Dispatcher) Stats() map[string]circuitbreaker.Stats {
+	return d.client.Stats()
+}
+
+// allowProbe reports whether a last-resort probe may be sent to service now,
+// and if so records it.
+func (d *Dispatcher) allowProbe(service string) bool {
+	if d.lastResort <= 0 {
+		return false
+	}
+	d.probeMu.Lock()
+	defer d.probeMu.Unlock()
+	if time.Since(d.probes[service]) < d.lastResort {
+		return false
+	}
+	d.probes[service] = time.Now()
+	return true
+}
+
+// closeHook runs fn once when the body is closed.
+type closeHook struct {
+	io.ReadCloser
+	once     sync.Once
+	fn       func()
+	instance string // ID of the instance that sent the response
+}
+
+func (c *closeHook) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.fn)
+	return err
+}
 
-	return d.client.Do(instance.Addr, r)
+// Write sends p over the connection of an upgraded (101) response, whose body
+// is writable. Other bodies refuse writes.
+func (c *closeHook) Write(p []byte) (int, error) {
+	w, ok := c.ReadCloser.(io.Writer)
+	if !ok {
+		return 0, errors.New("response body is not writable")
+	}
+	return w.Write(p)
+}
+
+// InstanceOf returns the ID of the instance that produced a response returned
+// by Forward or ForwardRoute, or "" for responses the dispatcher generated
+// itself.
+func InstanceOf(resp *http.Response) string {
+	if h, ok := resp.Body.(*closeHook); ok {
+		return h.instance
+	}
+	return ""
 }
 
 // RouteFunc maps an incoming request to a service name.
 // Return empty string to indicate no match (404).
 type RouteFunc func(r *http.Request) string
+
+// RouteResult is the outcome of routing a request.
+type RouteResult struct {
+	Service string                   // Target service; empty means no match (404)
+	Rewrite func(path string) string // Optional; transforms the path sent to the backend
+	Tags    map[string]string        // Optional; only instances carrying all tags are eligible
+	Timeout time.Duration            // Optional; deadline for this request (0 = client default)
+	Deny    bool                     // Reject the request (403) without forwarding
+
+	// HeaderTimeout optionally bounds the wait for the backend's response
+	// headers (time to first byte), independently of Timeout.
+	HeaderTimeout time.Duration
+}
+
+// StripPrefix returns a RouteResult.Rewrite that removes prefix from the
+// path, so "/echo/foo" reaches the backend as "/foo" and "/echo" as "/".
+// Paths that don't start with the prefix at a segment boundary, like
+// "/echoes", are left unchanged.
+func StripPrefix(prefix string) func(path string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(path string) string {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			return path
+		}
+		if rest == "" {
+			return "/"
+		}
+		return rest
+	}
+}
+
+// RouteResultFunc maps an incoming request to a RouteResult.
+type RouteResultFunc func(r *http.Request) RouteResult
+
+// Result adapts a string-returning RouteFunc to a RouteResultFunc.
+func (f RouteFunc) Result() RouteResultFunc {
+	return func(r *http.Request) RouteResult {
+		return RouteResult{Service: f(r)}
+	}
+}
@@ -2,16 +2,25 @@ package dispatcher
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/sony/gobreaker"
 	"kerberos/internal/balancer"
 	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/clientip"
+	"kerberos/internal/clock"
+	"kerberos/internal/latency"
 	"kerberos/internal/registry"
 	"kerberos/internal/retry"
 )
@@ -186,3 +195,1253 @@ func TestDispatcher_Forward_RetriesOnConnectionError(t *testing.T) {
 		t.Errorf("expected at least 3 attempts (fail twice then succeed), got %d", attempt)
 	}
 }
+
+func TestDispatcher_ForwardRoute_RewriteAndTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{MaxRetries: 0}
+	cb := circuitbreaker.New(backend.Client(), cbSettings)
+	disp := New(b, cb)
+
+	route := RouteResult{
+		Service: "svc",
+		Rewrite: func(path string) string { return strings.TrimPrefix(path, "/api") },
+		Timeout: 50 * time.Millisecond,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/fast", nil)
+	resp, err := disp.ForwardRoute(route, req)
+	if err != nil {
+		t.Fatalf("ForwardRoute: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/fast" {
+		t.Errorf("expected rewritten path /fast, got %q", string(body))
+	}
+	if req.URL.Path != "/api/fast" {
+		t.Errorf("rewrite must not modify the incoming request, got %s", req.URL.Path)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/slow", nil)
+	_, err = disp.ForwardRoute(route, req)
+	if err == nil {
+		t.Fatal("expected route timeout error, got nil")
+	}
+	if !isTimeoutError(err) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestDispatcher_ForwardRoute_StripPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	tests := []struct {
+		name    string
+		rewrite func(string) string
+		path    string
+		want    string
+	}{
+		{"strip prefix", StripPrefix("/echo"), "/echo/foo?x=1", "/foo?x=1"},
+		{"strip to root", StripPrefix("/echo/"), "/echo", "/"},
+		{"strip leaves empty", func(p string) string { return strings.TrimPrefix(p, "/echo") }, "/echo", "/"},
+		{"not at segment boundary", StripPrefix("/echo"), "/echoes", "/echoes"},
+		{"no rewrite", nil, "/echo/foo", "/echo/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := RouteResult{Service: "svc", Rewrite: tt.rewrite}
+			resp, err := disp.ForwardRoute(route, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if err != nil {
+				t.Fatalf("ForwardRoute: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("backend got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatcher_ForwardRoute_TagsConstrainInstances(t *testing.T) {
+	var hits []string
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	us := newBackend("us")
+	defer us.Close()
+	eu := newBackend("eu")
+	defer eu.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "us", Addr: us.URL, Tags: map[string]string{"region": "us"}})
+	r.Register("svc", registry.Instance{ID: "eu", Addr: eu.URL, Tags: map[string]string{"region": "eu"}})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	disp := New(b, cb)
+
+	route := RouteResult{Service: "svc", Tags: map[string]string{"region": "eu"}}
+	for i := 0; i < 3; i++ {
+		resp, err := disp.ForwardRoute(route, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("ForwardRoute: %v", err)
+		}
+		resp.Body.Close()
+	}
+	for i, h := range hits {
+		if h != "eu" {
+			t.Errorf("request %d: expected eu backend, got %s", i, h)
+		}
+	}
+
+	route.Tags = map[string]string{"region": "ap"}
+	resp, err := disp.ForwardRoute(route, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("ForwardRoute: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when no instance matches tags, got %d", resp.StatusCode)
+	}
+}
+
+func TestDispatcher_Forward_PreservesChunkedFramingOnRetry(t *testing.T) {
+	type seen struct {
+		chunked bool
+		length  int64
+		body    string
+	}
+	var attempts []seen
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		attempts = append(attempts, seen{
+			chunked: len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked",
+			length:  r.ContentLength,
+			body:    string(b),
+		})
+		if len(attempts) == 1 {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{
+		MaxRetries:     1,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}
+	cb := circuitbreaker.New(backend.Client(), cbSettings)
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	// A body of unknown length, as received from a chunked upload.
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader("chunked payload")))
+	req.TransferEncoding = []string{"chunked"}
+	if req.ContentLength != -1 {
+		t.Fatalf("test setup: expected unknown content length, got %d", req.ContentLength)
+	}
+
+	resp, err := disp.Forward("svc", req)
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(attempts))
+	}
+	for i, a := range attempts {
+		if !a.chunked || a.length != -1 {
+			t.Errorf("attempt %d: expected chunked framing, got chunked=%v length=%d", i, a.chunked, a.length)
+		}
+		if a.body != "chunked payload" {
+			t.Errorf("attempt %d: body %q", i, a.body)
+		}
+	}
+}
+
+func TestDispatcher_LoadHeader_ShiftsTrafficFromLoadedInstance(t *testing.T) {
+	counts := make(map[string]int)
+	newBackend := func(name, load string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[name]++
+			w.Header().Set("X-Backend-Load", load)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	busy := newBackend("busy", "0.9")
+	defer busy.Close()
+	idle := newBackend("idle", "0.1")
+	defer idle.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "busy", Addr: busy.URL, Weight: 1})
+	r.Register("svc", registry.Instance{ID: "idle", Addr: idle.URL, Weight: 1})
+	b := balancer.New(balancer.WeightedRoundRobin, r)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	disp := New(b, cb, WithLoadHeader("X-Backend-Load"))
+
+	forward := func(n int) {
+		for i := 0; i < n; i++ {
+			resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+			if err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// Equal registered weights; only the reported load tells them apart.
+	forward(100)
+	if counts["busy"]*4 > counts["idle"] {
+		t.Errorf("expected the loaded instance's share to drop, got %v", counts)
+	}
+}
+
+func TestDispatcher_PeakEWMA_PrefersFasterInstance(t *testing.T) {
+	counts := make(map[string]int)
+	newBackend := func(name string, delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[name]++
+			time.Sleep(delay)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	slow := newBackend("slow", 10*time.Millisecond)
+	defer slow.Close()
+	fast := newBackend("fast", 0)
+	defer fast.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "slow", Addr: slow.URL})
+	r.Register("svc", registry.Instance{ID: "fast", Addr: fast.URL})
+	b := balancer.New(balancer.PowerOfTwoChoices, r)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	disp := New(b, cb)
+
+	for i := 0; i < 40; i++ {
+		resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if counts["fast"] < 30 {
+		t.Errorf("expected the faster instance to get most requests, got %v", counts)
+	}
+}
+
+func TestDispatcher_FailFast_SingleFailingInstance(t *testing.T) {
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	}))
+	defer backend.Close()
+
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithFailFast())
+
+	// A single failure is not enough to rule the instance out;
+	// UnavailableAfter (3) in a row are.
+	for i := 0; i < 3; i++ {
+		if _, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+			t.Fatalf("Forward %d: expected the request to fail", i)
+		}
+		if n := attempts.Load(); n != int32(i+1) {
+			t.Fatalf("Forward %d: expected the request to reach the instance, got %d attempts in total", i, n)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Forward %d: expected a fast 503, got error %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Forward %d: expected 503, got %d", i, resp.StatusCode)
+		}
+		if got := resp.Header.Get(ReasonHeader); got != "instances-unavailable" {
+			t.Errorf("Forward %d: expected reason instances-unavailable, got %q", i, got)
+		}
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("expected no further attempts against the failing instance, got %d total", n)
+	}
+}
+
+func TestDispatcher_Latency_TracksInFlightUntilBodyClosed(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	tracker := latency.NewTracker()
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithLatency(tracker))
+
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if got := tracker.Snapshot()["svc"].InFlight; got != 1 {
+		t.Errorf("expected 1 in flight before the body is closed, got %d", got)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	s := tracker.Snapshot()["svc"]
+	if s.InFlight != 0 {
+		t.Errorf("expected 0 in flight after close, got %d", s.InFlight)
+	}
+	if s.Count != 1 || s.P50 <= 0 {
+		t.Errorf("expected one observed latency, got %+v", s)
+	}
+}
+
+func TestDispatcher_InvalidAddr_FallsBackAndEjects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("good"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	// Register skips validation, as a bad entry loaded from elsewhere would.
+	r.Register("svc", registry.Instance{ID: "bad", Addr: "http://[::1"})
+	r.Register("svc", registry.Instance{ID: "good", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithEjectInvalid(r))
+
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "good" {
+		t.Fatalf("expected the good instance to answer, got %d %q", resp.StatusCode, body)
+	}
+
+	instances := r.GetInstances("svc")
+	if len(instances) != 1 || instances[0].ID != "good" {
+		t.Errorf("expected the bad instance to be ejected, got %+v", instances)
+	}
+	if _, ok := cb.Stats()["http://[::1"]; ok {
+		t.Error("expected no breaker to be created for the invalid address")
+	}
+}
+
+func TestDispatcher_InvalidAddr_OnlyInstanceReturns503(t *testing.T) {
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "bad", Addr: "http://[::1"})
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.StatusCode)
+	}
+	if len(r.GetInstances("svc")) != 1 {
+		t.Error("expected the instance to stay registered without WithEjectInvalid")
+	}
+}
+
+func TestDispatcher_NoKeepAlive_DisablesKeepAliveAndChunking(t *testing.T) {
+	type seen struct {
+		proto   string
+		close   bool
+		chunked bool
+		length  int64
+		body    string
+	}
+	got := map[string]seen{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got[r.URL.Path] = seen{
+			proto:   r.Proto,
+			close:   r.Close,
+			chunked: len(r.TransferEncoding) > 0,
+			length:  r.ContentLength,
+			body:    string(b),
+		}
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("legacy", registry.Instance{ID: "1", Addr: backend.URL})
+	r.Register("modern", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithNoKeepAlive("legacy"))
+
+	for _, service := range []string{"legacy", "modern"} {
+		req := httptest.NewRequest(http.MethodPost, "/"+service, io.NopCloser(strings.NewReader("payload")))
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Connection", "keep-alive")
+		resp, err := disp.Forward(service, req)
+		if err != nil {
+			t.Fatalf("Forward %s: %v", service, err)
+		}
+		resp.Body.Close()
+	}
+
+	legacy := got["/legacy"]
+	if !legacy.close || legacy.chunked || legacy.length != int64(len("payload")) || legacy.body != "payload" {
+		t.Errorf("legacy: expected no keep-alive and a Content-Length, got %+v", legacy)
+	}
+	if legacy.proto != "HTTP/1.1" {
+		t.Errorf("legacy: expected the request to still be HTTP/1.1, got %q", legacy.proto)
+	}
+	modern := got["/modern"]
+	if modern.close || !modern.chunked {
+		t.Errorf("modern: expected keep-alive and chunked framing, got %+v", modern)
+	}
+}
+
+func TestDispatcher_ConnectFailure_FallsOverToHealthyInstance(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.DialTimeout = 100 * time.Millisecond
+	cb := circuitbreaker.New(backend.Client(), cbSettings)
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "dead", Addr: "http://127.0.0.1:1"})
+	r.Register("svc", registry.Instance{ID: "alive", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	start := time.Now()
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "payload" {
+		t.Errorf("expected the healthy instance to receive the body, got %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a fast failover, took %v", elapsed)
+	}
+}
+
+func TestDispatcher_ConnectFailure_AllInstancesReturnsError(t *testing.T) {
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "dead", Addr: "http://127.0.0.1:1"})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	_, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if !circuitbreaker.IsConnectError(err) {
+		t.Errorf("expected the connect error to be returned, got %v", err)
+	}
+}
+
+func TestDispatcher_RetrySelectsAnotherInstance(t *testing.T) {
+	var brokenHits, healthyHits atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenHits.Add(1)
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	cb := circuitbreaker.New(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}, cbSettings)
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "broken", Addr: broken.URL})
+	r.Register("svc", registry.Instance{ID: "healthy", Addr: healthy.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if brokenHits.Load() != 1 || healthyHits.Load() != 1 {
+		t.Errorf("expected one attempt on each instance, got broken=%d healthy=%d", brokenHits.Load(), healthyHits.Load())
+	}
+}
+
+func TestDispatcher_RetriesPOSTOnlyWithIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	keys := map[string][]string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		keys[r.URL.Path] = append(keys[r.URL.Path], r.Header.Get("Idempotency-Key"))
+		first := attempts[r.URL.Path] == 1
+		mu.Unlock()
+		if first {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{
+		MaxRetries:          2,
+		InitialBackoff:      time.Millisecond,
+		MaxBackoff:          time.Millisecond,
+		IdempotentOnly:      true,
+		RetryIdempotencyKey: true,
+	}
+	cb := circuitbreaker.New(backend.Client(), cbSettings)
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	req := httptest.NewRequest(http.MethodPost, "/keyed", strings.NewReader("order"))
+	req.Header.Set("Idempotency-Key", "order-42")
+	resp, err := disp.Forward("svc", req)
+	if err != nil {
+		t.Fatalf("keyed POST: %v", err)
+	}
+	resp.Body.Close()
+	// seen returns the attempts at path and the idempotency keys they had.
+	seen := func(path string) (int, []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[path], append([]string(nil), keys[path]...)
+	}
+	n, keyed := seen("/keyed")
+	if resp.StatusCode != http.StatusCreated || n != 2 {
+		t.Errorf("keyed POST: expected success on the retry, got %d after %d attempts", resp.StatusCode, n)
+	}
+	for i, k := range keyed {
+		if k != "order-42" {
+			t.Errorf("attempt %d: expected the idempotency key to be forwarded, got %q", i, k)
+		}
+	}
+
+	_, err = disp.Forward("svc", httptest.NewRequest(http.MethodPost, "/unkeyed", strings.NewReader("order")))
+	if err == nil {
+		t.Error("unkeyed POST: expected the failed attempt not to be retried")
+	}
+	if n, _ := seen("/unkeyed"); n != 1 {
+		t.Errorf("unkeyed POST: expected 1 attempt, got %d", n)
+	}
+}
+
+func TestDispatcher_LastResort_OneProbePerInterval(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	failing := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+				}
+			}
+		}))
+	}
+	a, b := failing("a"), failing("b")
+	defer a.Close()
+	defer b.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.UnavailableAfter = 1
+	cb := circuitbreaker.New(http.DefaultClient, cbSettings)
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: a.URL})
+	r.Register("svc", registry.Instance{ID: "b", Addr: b.URL})
+	const interval = 100 * time.Millisecond
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithFailFast(), WithLastResort(interval))
+
+	// counts returns a copy of hits.
+	counts := func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		return map[string]int{"a": hits["a"], "b": hits["b"]}
+	}
+	forward := func() {
+		resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	forward() // fails on a
+	forward() // fails on b
+	if got := counts(); got["a"] != 1 || got["b"] != 1 {
+		t.Fatalf("setup: expected one request to each instance, got %v", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		forward()
+	}
+	if got := counts(); got["a"] != 2 || got["b"] != 1 {
+		t.Errorf("expected exactly one probe, to the least recently failed instance, got %v", got)
+	}
+
+	time.Sleep(interval)
+	for i := 0; i < 5; i++ {
+		forward()
+	}
+	got := counts()
+	if got["a"]+got["b"] != 4 {
+		t.Errorf("expected one more probe after the interval, got %v", got)
+	}
+	if got["b"] != 2 {
+		t.Errorf("expected the second probe to go to b, which failed longer ago, got %v", got)
+	}
+}
+
+func TestDispatcher_LastResort_ProbesPastOpenBreaker(t *testing.T) {
+	var recovered atomic.Bool
+	var hits atomic.Int32
+	backend := func(heal bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			if heal && recovered.Load() {
+				io.WriteString(w, "ok")
+				return
+			}
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+				}
+			}
+		}))
+	}
+	a, b := backend(true), backend(false)
+	defer a.Close()
+	defer b.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Timeout = 60
+	cbSettings.ReadyToTrip = func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 1 }
+	cb := circuitbreaker.New(http.DefaultClient, cbSettings)
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: a.URL})
+	r.Register("svc", registry.Instance{ID: "b", Addr: b.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithFailFast(), WithLastResort(time.Hour))
+
+	forward := func() (*http.Response, error) {
+		return disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	for i := 0; i < 2; i++ { // trips a, then b
+		if resp, err := forward(); err == nil {
+			resp.Body.Close()
+		}
+	}
+	for addr, state := range cb.States() {
+		if state != gobreaker.StateOpen {
+			t.Fatalf("setup: expected the breaker of %s to be open, got %s", addr, state)
+		}
+	}
+
+	recovered.Store(true)
+	resp, err := forward()
+	if err != nil {
+		t.Fatalf("expected the probe to reach a past its open breaker, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" || InstanceOf(resp) != "a" {
+		t.Errorf("expected the probe to be answered by a, got %d %q from %q", resp.StatusCode, body, InstanceOf(resp))
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("expected one probe after the two failures, got %d requests", n)
+	}
+	if s := cb.Stats()[a.URL]; s.Successes != 1 {
+		t.Errorf("expected the probe's success to be counted for a, got %+v", s)
+	}
+
+	resp, err = forward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || hits.Load() != 3 {
+		t.Errorf("expected no second probe within the interval, got %d after %d requests", resp.StatusCode, hits.Load())
+	}
+}
+
+func TestDispatcher_ForwardRoute_HeaderTimeout(t *testing.T) {
+	// Slow to send headers, then streams its body over a longer period.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	tests := []struct {
+		name          string
+		headerTimeout time.Duration
+		wantErr       bool
+	}{
+		{"shorter than time to first byte", 30 * time.Millisecond, true},
+		{"longer than time to first byte but shorter than the body", 150 * time.Millisecond, false},
+		{"unset", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := RouteResult{Service: "svc", HeaderTimeout: tt.headerTimeout}
+			resp, err := disp.ForwardRoute(route, httptest.NewRequest(http.MethodGet, "/", nil))
+			if tt.wantErr {
+				if err == nil || !isTimeoutError(err) {
+					t.Fatalf("expected a timeout error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ForwardRoute: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != strings.Repeat("chunk", 4) {
+				t.Errorf("expected the full body, got %q (%v)", body, err)
+			}
+		})
+	}
+}
+
+func TestDispatcher_Forward_IPHashIsStickyPerClient(t *testing.T) {
+	newBackend := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(id))
+		}))
+	}
+	b1, b2 := newBackend("1"), newBackend("2")
+	defer b1.Close()
+	defer b2.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: b1.URL})
+	r.Register("svc", registry.Instance{ID: "2", Addr: b2.URL})
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+
+	forward := func(disp *Dispatcher, remoteAddr, xff string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		resp, err := disp.Forward("svc", req)
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	proxy := clientip.NewResolver(netip.MustParsePrefix("192.0.2.1/32"))
+	disp := New(balancer.New(balancer.IPHash, r, balancer.WithClientIP(proxy)), cb)
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:%d", i, 40000+i)
+		first := forward(disp, addr, "")
+		for j := 0; j < 3; j++ {
+			if got := forward(disp, fmt.Sprintf("10.0.0.%d:%d", i, 50000+j), ""); got != first {
+				t.Fatalf("client 10.0.0.%d: expected backend %s on every request, got %s", i, first, got)
+			}
+		}
+		if got := forward(disp, "192.0.2.1:1234", fmt.Sprintf("10.0.0.%d", i)); got != first {
+			t.Errorf("client 10.0.0.%d via X-Forwarded-For: expected backend %s, got %s", i, first, got)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected clients to be spread over both backends, got %v", seen)
+	}
+
+	// Strategies that ignore the request still rotate regardless of client.
+	rr := New(balancer.New(balancer.RoundRobin, r), cb)
+	if a, b := forward(rr, "10.0.0.1:1", ""), forward(rr, "10.0.0.1:1", ""); a == b {
+		t.Errorf("round-robin: expected consecutive requests to alternate, got %s twice", a)
+	}
+}
+
+func TestDispatcher_ForwardRoute_TimeoutCancelsRetries(t *testing.T) {
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	}))
+	defer backend.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{MaxRetries: 5, InitialBackoff: 200 * time.Millisecond, MaxBackoff: time.Second}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	cb := circuitbreaker.New(client, cbSettings)
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	// The first retry would wait 200ms, past the 50ms route timeout, so the
+	// deadline rather than the 10s client timeout or the retry limit ends the
+	// request, after the one attempt; without it there would be 6.
+	_, err := disp.ForwardRoute(RouteResult{Service: "svc", Timeout: 50 * time.Millisecond}, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("expected no attempts after the deadline, got %d", n)
+	}
+}
+
+func TestDispatcher_RetriesRetryableStatusCodes(t *testing.T) {
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 2 || r.URL.Path == "/always" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("busy"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{
+		MaxRetries:           3,
+		InitialBackoff:       time.Millisecond,
+		MaxBackoff:           time.Millisecond,
+		RetryableStatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+	}
+	cb := circuitbreaker.New(backend.Client(), cbSettings)
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+	disp := New(balancer.New(balancer.RoundRobin, r), cb)
+
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" || attempts.Load() != 3 {
+		t.Errorf("expected 200 on the third attempt, got %d %q after %d attempts", resp.StatusCode, body, attempts.Load())
+	}
+
+	attempts.Store(0)
+	resp, err = disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/always", nil))
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "busy" || attempts.Load() != 4 {
+		t.Errorf("expected the last 503 to be passed through after 4 attempts, got %d %q after %d", resp.StatusCode, body, attempts.Load())
+	}
+}
+
+func TestDispatcher_OutlierDetection_EjectsAndReadmits(t *testing.T) {
+	counts := make(map[string]int)
+	newBackend := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[name]++
+			w.WriteHeader(status)
+		}))
+	}
+	bad := newBackend("bad", http.StatusInternalServerError)
+	defer bad.Close()
+	good := newBackend("good", http.StatusOK)
+	defer good.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "bad", Addr: bad.URL})
+	r.Register("svc", registry.Instance{ID: "good", Addr: good.URL})
+	clk := clock.NewManual(time.Unix(1000, 0))
+	b := balancer.New(balancer.RoundRobin, r, balancer.WithClock(clk), balancer.WithOutlierDetection(balancer.OutlierDetection{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    30 * time.Second,
+	}))
+	disp := New(b, circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings()))
+
+	forward := func(n int) {
+		for i := 0; i < n; i++ {
+			resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+			if err != nil {
+				t.Fatalf("Forward: %v", err)
+			}
+			resp.Body.Close()
+		}
+	}
+	// ejectBad forwards until the bad instance is ejected.
+	ejectBad := func() {
+		for i := 0; !b.Ejected("svc", "bad"); i++ {
+			if i == 20 {
+				t.Fatal("failing instance never ejected")
+			}
+			forward(1)
+		}
+	}
+
+	ejectBad()
+	before := counts["bad"]
+	if before != 3 {
+		t.Errorf("expected ejection after 3 failures, got %d", before)
+	}
+	forward(10)
+	if counts["bad"] != before {
+		t.Errorf("ejected instance got %d requests", counts["bad"]-before)
+	}
+
+	clk.Advance(30 * time.Second)
+	forward(4)
+	if counts["bad"] == before {
+		t.Fatal("expected the instance to be re-admitted after the ejection time")
+	}
+
+	// A second ejection lasts twice as long.
+	ejectBad()
+	clk.Advance(30 * time.Second)
+	if !b.Ejected("svc", "bad") {
+		t.Error("expected the second ejection to outlast the first")
+	}
+	clk.Advance(30 * time.Second)
+	if b.Ejected("svc", "bad") {
+		t.Error("expected the instance to be re-admitted after twice the ejection time")
+	}
+}
+
+func TestDispatcher_MaxConcurrency_RejectsExcessWith503(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: backend.URL, MaxConcurrency: 2})
+	r.Register("svc", registry.Instance{ID: "b", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r, balancer.WithMaxConcurrency(3))
+	disp := New(b, circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings()))
+
+	// a takes 2 and b 3 requests at once; the rest are turned away.
+	const total = 10
+	statuses := make(chan int, total)
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+			if err != nil {
+				t.Errorf("Forward: %v", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+			if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get(ReasonHeader) != "at-capacity" {
+				t.Errorf("expected reason at-capacity, got %q", resp.Header.Get(ReasonHeader))
+			}
+		}()
+	}
+	// The 5 admitted requests hold their slots until released, so the
+	// other 5 must have been rejected by then.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(statuses) < total-5 {
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatalf("expected %d rejections within 5s, got %d", total-5, len(statuses))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := disp.InFlight("svc", "a") + disp.InFlight("svc", "b"); got != 5 {
+		t.Errorf("expected 5 requests in flight, got %d", got)
+	}
+	close(release)
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for s := range statuses {
+		counts[s]++
+	}
+	if counts[http.StatusOK] != 5 || counts[http.StatusServiceUnavailable] != 5 {
+		t.Errorf("expected 5 successes and 5 rejections, got %v", counts)
+	}
+	if p := peak.Load(); p > 5 {
+		t.Errorf("expected at most 5 concurrent requests at the backend, got %d", p)
+	}
+
+	resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected slots to be freed after completion, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestDispatcher_OnHealthChange_DropsOpenInstancesFromSelection(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+	steady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer steady.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "flaky", Addr: flaky.URL})
+	r.Register("svc", registry.Instance{ID: "steady", Addr: steady.URL})
+	s := circuitbreaker.DefaultSettings()
+	s.Timeout = 1
+	s.IsFailure = circuitbreaker.FailureStatus(http.StatusInternalServerError)
+	s.OnHealthChange = r.SetHealthyAddr
+	b := balancer.New(balancer.RoundRobin, r)
+	disp := New(b, circuitbreaker.New(http.DefaultClient, s))
+
+	forward := func() {
+		resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		resp.Body.Close()
+	}
+	// Five consecutive failures trip the default breaker.
+	for i := 0; i < 10; i++ {
+		forward()
+	}
+	for i := 0; i < 4; i++ {
+		inst := b.Select("svc", nil)
+		b.Done("svc", inst)
+		if inst.ID != "steady" {
+			t.Fatalf("expected the instance with an open breaker to be dropped, got %s", inst.ID)
+		}
+	}
+
+	// Once the open timeout passes the breaker lets a probe through, and a
+	// successful one closes it.
+	failing.Store(false)
+	deadline := time.Now().Add(3 * time.Second)
+	for healthy := false; !healthy; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the instance to be restored after the open timeout")
+		}
+		time.Sleep(50 * time.Millisecond)
+		healthy = true
+		for _, inst := range r.GetInstances("svc") {
+			healthy = healthy && !inst.Unhealthy
+		}
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		inst := b.Select("svc", nil)
+		b.Done("svc", inst)
+		seen[inst.ID] = true
+	}
+	if !seen["flaky"] {
+		t.Errorf("expected the recovered instance to be selected again, got %v", seen)
+	}
+}
+
+func TestDispatcher_StickyCookie(t *testing.T) {
+	newBackend := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(id))
+		}))
+	}
+	backendA, backendB := newBackend("a"), newBackend("b")
+	defer backendA.Close()
+	defer backendB.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: backendA.URL})
+	r.Register("svc", registry.Instance{ID: "b", Addr: backendB.URL})
+	b := balancer.New(balancer.StickyCookie, r, balancer.WithStickyCookie(balancer.StickyCookieConfig{Secret: []byte("s3cret")}))
+	disp := New(b, circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings()))
+
+	// forward returns the backend that answered and the cookies it was sent.
+	forward := func(cookies ...*http.Cookie) (string, []*http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := disp.Forward("svc", req)
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.Cookies()
+	}
+
+	first, cookies := forward()
+	if len(cookies) != 1 || cookies[0].Name != "kerberos-sticky-svc" || !cookies[0].HttpOnly {
+		t.Fatalf("expected the first response to set the sticky cookie, got %v", cookies)
+	}
+	sticky := cookies[0]
+	for i := 0; i < 4; i++ {
+		got, set := forward(sticky)
+		if got != first {
+			t.Fatalf("request %d: expected to stick to %s, got %s", i, first, got)
+		}
+		if len(set) != 0 {
+			t.Errorf("request %d: expected no new cookie for a sticky request, got %v", i, set)
+		}
+	}
+
+	// A forged cookie is ignored and replaced.
+	other := "b"
+	if first == "b" {
+		other = "a"
+	}
+	forged := &http.Cookie{Name: sticky.Name, Value: base64.RawURLEncoding.EncodeToString([]byte(other)) + "." + strings.SplitN(sticky.Value, ".", 2)[1]}
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got, set := forward(forged)
+		seen[got] = true
+		if len(set) != 1 {
+			t.Errorf("expected a fresh cookie for the forged one, got %v", set)
+		}
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("expected a forged cookie to fall back to round-robin, got %v", seen)
+	}
+
+	// Once the instance is gone, the client moves on and gets a new cookie.
+	r.Unregister("svc", first)
+	got, set := forward(sticky)
+	if got == first || len(set) != 1 || set[0].Value == sticky.Value {
+		t.Errorf("expected a new instance and cookie once %s was gone, got %s and %v", first, got, set)
+	}
+}
+
+func TestDispatcher_Stats_CountsRetries(t *testing.T) {
+	// Every other request fails with a retryable 503.
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "a", Addr: backend.URL})
+	settings := circuitbreaker.DefaultSettings()
+	settings.Retry = retry.Config{
+		MaxRetries:           2,
+		InitialBackoff:       time.Millisecond,
+		MaxBackoff:           time.Millisecond,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+	}
+	disp := New(balancer.New(balancer.RoundRobin, r), circuitbreaker.New(http.DefaultClient, settings))
+
+	for i := 0; i < 3; i++ {
+		resp, err := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the retry to succeed, got %d", resp.StatusCode)
+		}
+	}
+
+	stats, ok := disp.Stats()[backend.URL]
+	if !ok {
+		t.Fatalf("no stats for %s in %v", backend.URL, disp.Stats())
+	}
+	if stats.Requests != 6 || stats.Successes != 3 || stats.Failures != 3 || stats.Retries != 3 {
+		t.Errorf("expected 6 requests, 3 successes, 3 failures and 3 retries, got %+v", stats)
+	}
+	if stats.Counts.Requests != 6 || stats.Counts.ConsecutiveFailures != 0 || stats.State != "closed" {
+		t.Errorf("expected the breaker's counts to cover all 6 attempts, got %+v", stats)
+	}
+}
@@ -0,0 +1,45 @@
+package dispatcher
+
+import "time"
+
+// EventType identifies a step in a request's lifecycle.
+type EventType string
+
+const (
+	EventRouted   EventType = "routed"   // The dispatcher received the request for Service
+	EventSelected EventType = "selected" // Instance was chosen
+	EventAttempt  EventType = "attempt"  // Attempt number Attempt is being sent to Instance
+	EventRetry    EventType = "retry"    // The previous attempt failed with Reason; trying again
+	EventResponse EventType = "response" // Instance answered with Status
+	EventError    EventType = "error"    // The request failed with Reason
+)
+
+// Event describes one step in forwarding a request.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Service  string
+	Instance string // Instance ID, when one has been selected
+	Attempt  int    // For EventAttempt and EventRetry
+	Status   int    // For EventResponse
+	Reason   string // For EventRetry and EventError
+}
+
+// WithEvents sends an Event to ch for each step of every request. Sends never
+// block: events are dropped while ch is full.
+func WithEvents(ch chan<- Event) Option {
+	return func(d *Dispatcher) {
+		d.events = ch
+	}
+}
+
+func (d *Dispatcher) emit(e Event) {
+	if d.events == nil {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case d.events <- e:
+	default:
+	}
+}
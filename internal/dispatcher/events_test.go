@@ -0,0 +1,116 @@
+package dispatcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/registry"
+	"kerberos/internal/retry"
+)
+
+func TestDispatcher_Events(t *testing.T) {
+	failFirst := false
+	attempts := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if failFirst && attempts == 1 {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	// Fresh connections, so the transport never retries a reused one itself.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	cb := circuitbreaker.New(client, cbSettings)
+	r := registry.New()
+	r.Register("svc", registry.Instance{ID: "1", Addr: backend.URL})
+
+	sequence := func(events []Event) string {
+		var parts []string
+		for _, e := range events {
+			s := string(e.Type)
+			switch e.Type {
+			case EventSelected:
+				s += "(" + e.Instance + ")"
+			case EventAttempt, EventRetry:
+				s += "(" + string(rune('0'+e.Attempt)) + ")"
+			case EventResponse:
+				s += "(" + http.StatusText(e.Status) + ")"
+			case EventError:
+				s += "(" + e.Reason + ")"
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, " ")
+	}
+	run := func(service string) string {
+		t.Helper()
+		ch := make(chan Event, 16)
+		disp := New(balancer.New(balancer.RoundRobin, r), cb, WithEvents(ch))
+		resp, err := disp.Forward(service, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+		resp.Body.Close()
+		close(ch)
+		var events []Event
+		for e := range ch {
+			if e.Service != service || e.Time.IsZero() {
+				t.Errorf("event %+v: expected service %q and a timestamp", e, service)
+			}
+			events = append(events, e)
+		}
+		return sequence(events)
+	}
+
+	tests := []struct {
+		name      string
+		service   string
+		failFirst bool
+		want      string
+	}{
+		{"success", "svc", false, "routed selected(1) attempt(1) response(Accepted)"},
+		{"retry then success", "svc", true, "routed selected(1) attempt(1) retry(2) selected(1) attempt(2) response(Accepted)"},
+		{"no instances", "missing", false, "routed error(no-instances)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failFirst, attempts = tt.failFirst, 0
+			if got := run(tt.service); got != tt.want {
+				t.Errorf("events:\ngot  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatcher_Events_DropWhenFull(t *testing.T) {
+	r := registry.New()
+	ch := make(chan Event) // never read
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	disp := New(balancer.New(balancer.RoundRobin, r), cb, WithEvents(ch))
+
+	done := make(chan struct{})
+	go func() {
+		resp, _ := disp.Forward("svc", httptest.NewRequest(http.MethodGet, "/", nil))
+		resp.Body.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Forward blocked on a full event channel")
+	}
+}
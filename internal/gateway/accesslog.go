@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry describes one completed request.
+type AccessLogEntry struct {
+	Time           time.Time // When the request was received
+	RemoteAddr     string
+	User           string // Basic auth user, if any
+	Method         string
+	URI            string
+	Proto          string
+	Status         int
+	Bytes          int64 // Response body bytes written to the client
+	Referer        string
+	UserAgent      string
+	RequestID      string // Correlation ID, from X-Request-ID or generated
+	Service        string // Matched service; empty if the request was not routed
+	UpstreamStatus int    // Status returned by the backend; 0 if none
+	Duration       time.Duration
+}
+
+// AccessLogFormatter renders an entry as a single log line (without newline).
+type AccessLogFormatter func(e AccessLogEntry) string
+
+// CommonLogFormat renders the entry in Apache Common Log Format.
+func CommonLogFormat(e AccessLogEntry) string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		orDash(host), orDash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Proto, e.Status, bytes)
+}
+
+// CombinedLogFormat renders the entry in Apache Combined Log Format, followed
+// by the matched service and upstream status as extension fields.
+func CombinedLogFormat(e AccessLogEntry) string {
+	upstream := "-"
+	if e.UpstreamStatus != 0 {
+		upstream = strconv.Itoa(e.UpstreamStatus)
+	}
+	return fmt.Sprintf("%s %q %q %q %s",
+		CommonLogFormat(e), orDash(e.Referer), orDash(e.UserAgent), orDash(e.Service), upstream)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLog writes one formatted line per request.
+type accessLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format AccessLogFormatter
+}
+
+func newAccessLog(out io.Writer, format AccessLogFormatter) *accessLog {
+	if format == nil {
+		format = CombinedLogFormat
+	}
+	return &accessLog{out: out, format: format}
+}
+
+type accessEntryKey struct{}
+
+// entryFromContext returns the entry being recorded for the request, so
+// handlers can fill in routing details. Returns nil when logging is off.
+func entryFromContext(ctx context.Context) *AccessLogEntry {
+	e, _ := ctx.Value(accessEntryKey{}).(*AccessLogEntry)
+	return e
+}
+
+func (l *accessLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		entry := &AccessLogEntry{
+			Time:       time.Now(),
+			RemoteAddr: r.RemoteAddr,
+			User:       user,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RequestID:  RequestIDFromContext(r.Context()),
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		entry.Status = rec.status()
+		entry.Bytes = rec.bytes
+		entry.Duration = time.Since(entry.Time)
+		line := l.format(*entry)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		io.WriteString(l.out, line+"\n")
+	})
+}
+
+// statusRecorder captures the status code and body size written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	// Interim responses such as 103 Early Hints precede the status to log.
+	if r.code == 0 && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestCombinedLogFormat(t *testing.T) {
+	e := AccessLogEntry{
+		Time:           time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteAddr:     "127.0.0.1:51234",
+		User:           "frank",
+		Method:         http.MethodGet,
+		URI:            "/echo/apache_pb.gif?x=1",
+		Proto:          "HTTP/1.0",
+		Status:         http.StatusOK,
+		Bytes:          2326,
+		Referer:        "http://www.example.com/start.html",
+		UserAgent:      "Mozilla/4.08",
+		Service:        "echo",
+		UpstreamStatus: http.StatusOK,
+	}
+
+	want := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /echo/apache_pb.gif?x=1 HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08" "echo" 200`
+	if got := CombinedLogFormat(e); got != want {
+		t.Errorf("CombinedLogFormat:\nwant %s\ngot  %s", want, got)
+	}
+
+	e.Bytes, e.User = 0, ""
+	want = `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /echo/apache_pb.gif?x=1 HTTP/1.0" 200 -`
+	if got := CommonLogFormat(e); got != want {
+		t.Errorf("CommonLogFormat:\nwant %s\ngot  %s", want, got)
+	}
+}
+
+func TestGateway_AccessLog_ProxiedAndUnroutedRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	// The line is written once the handler returns, which may be after the
+	// client has read the response, so lines are handed over on a channel.
+	logged := make(chan string, 2)
+	gw := New(Config{
+		Dispatcher: dispatcher.New(b, cb),
+		Route: func(req *http.Request) string {
+			if strings.HasPrefix(req.URL.Path, "/echo") {
+				return "echo"
+			}
+			return ""
+		},
+		AccessLog: lineWriter(logged),
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	var lines []string
+	for _, path := range []string{"/echo/foo", "/nowhere"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+		select {
+		case line := <-logged:
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a log line for %s", path)
+		}
+	}
+	proxied := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "GET /echo/foo HTTP/1\.1" 202 5 "-" "Go-http-client/1\.1" "echo" 202$`)
+	if !proxied.MatchString(lines[0]) {
+		t.Errorf("unexpected proxied line: %s", lines[0])
+	}
+	unrouted := regexp.MustCompile(`"GET /nowhere HTTP/1\.1" 404 \d+ "-" "Go-http-client/1\.1" "-" -$`)
+	if !unrouted.MatchString(lines[1]) {
+		t.Errorf("unexpected unrouted line: %s", lines[1])
+	}
+}
+
+// lineWriter hands every write, one log line each, to lines.
+type lineWriter chan<- string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// adminOnly guards an admin endpoint with the configured bearer token.
+// Admin endpoints are disabled when no token is configured.
+func (g *Gateway) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if g.adminToken == "" {
+			http.Error(w, "admin endpoints not enabled", http.StatusNotImplemented)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(g.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// RuntimeStats is the body of GET /admin/runtime.
+type RuntimeStats struct {
+	Goroutines      int         `json:"goroutines"`
+	OpenConnections int64       `json:"open_connections"`
+	Memory          MemoryStats `json:"memory"`
+	GC              GCStats     `json:"gc"`
+}
+
+// MemoryStats is a subset of runtime.MemStats, in bytes.
+type MemoryStats struct {
+	Alloc       uint64 `json:"alloc"`
+	TotalAlloc  uint64 `json:"total_alloc"`
+	Sys         uint64 `json:"sys"`
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapObjects uint64 `json:"heap_objects"`
+	Mallocs     uint64 `json:"mallocs"`
+	Frees       uint64 `json:"frees"`
+}
+
+// GCStats summarizes garbage collection.
+type GCStats struct {
+	NumGC        uint32        `json:"num_gc"`
+	PauseTotal   time.Duration `json:"pause_total_ns"`
+	LastPause    time.Duration `json:"last_pause_ns"`
+	LastGC       time.Time     `json:"last_gc"` // Zero if no GC has run
+	NextGCTarget uint64        `json:"next_gc_target"`
+}
+
+func (g *Gateway) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := RuntimeStats{
+		Goroutines:      runtime.NumGoroutine(),
+		OpenConnections: g.conns.Load(),
+		Memory: MemoryStats{
+			Alloc:       m.Alloc,
+			TotalAlloc:  m.TotalAlloc,
+			Sys:         m.Sys,
+			HeapAlloc:   m.HeapAlloc,
+			HeapInuse:   m.HeapInuse,
+			HeapObjects: m.HeapObjects,
+			Mallocs:     m.Mallocs,
+			Frees:       m.Frees,
+		},
+		GC: GCStats{
+			NumGC:        m.NumGC,
+			PauseTotal:   time.Duration(m.PauseTotalNs),
+			NextGCTarget: m.NextGC,
+		},
+	}
+	if m.NumGC > 0 {
+		stats.GC.LastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+		stats.GC.LastGC = time.Unix(0, int64(m.LastGC))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// trackConn counts open client connections; set as http.Server.ConnState.
+func (g *Gateway) trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		g.conns.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		g.conns.Add(-1)
+	}
+}
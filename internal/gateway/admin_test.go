@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGateway_AdminRuntime(t *testing.T) {
+	gw := New(Config{AdminToken: "secret"})
+	srv := httptest.NewUnstartedServer(gw.Handler())
+	srv.Config.ConnState = gw.trackConn
+	srv.Start()
+	defer srv.Close()
+
+	get := func(token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/runtime", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return resp
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		resp := get(token)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, resp.StatusCode)
+		}
+	}
+
+	resp := get("secret")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var stats RuntimeStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if stats.Goroutines <= 0 {
+		t.Errorf("expected a positive goroutine count, got %d", stats.Goroutines)
+	}
+	if stats.OpenConnections < 1 {
+		t.Errorf("expected at least this request's connection to be open, got %d", stats.OpenConnections)
+	}
+	if stats.Memory.Sys == 0 || stats.Memory.HeapAlloc == 0 || stats.Memory.Sys < stats.Memory.HeapInuse {
+		t.Errorf("implausible memory stats: %+v", stats.Memory)
+	}
+}
+
+func TestGateway_AdminDisabledWithoutToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	New(Config{}).Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/runtime", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501, got %d", rec.Code)
+	}
+}
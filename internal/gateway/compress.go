@@ -0,0 +1,297 @@
+package gateway
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compression gzips responses for clients that send Accept-Encoding: gzip.
+// Responses that are already encoded, too small to benefit, or of a type
+// that is compressed already, such as images, are sent as they are.
+type Compression struct {
+	// MinSize is the smallest body, in bytes, worth compressing. Defaults
+	// to 1024.
+	MinSize int
+
+	// Level is the gzip compression level, from gzip.BestSpeed to
+	// gzip.BestCompression. Zero means gzip.DefaultCompression.
+	Level int
+}
+
+// incompressibleTypes lists media types whose content is compressed already,
+// besides images, audio and video.
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+	"text/event-stream":            true, // streamed event by event
+}
+
+// wrap compresses the responses of next for clients accepting gzip. A nil
+// configuration returns next unchanged.
+func (c *Compression) wrap(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	minSize := c.MinSize
+	if minSize <= 0 {
+		minSize = 1024
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, minSize: minSize, level: level}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "gzip") && coding != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressibleType reports whether content of the media type in ct is worth
+// compressing. An empty ct is, until the content is sniffed.
+func compressibleType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return !incompressibleTypes[mediaType]
+}
+
+// gzipState tracks whether a gzipWriter has settled on compressing.
+type gzipState int
+
+const (
+	gzipPending gzipState = iota // Header held back, body buffered
+	gzipPlain                    // Passing the response through
+	gzipActive                   // Compressing the body
+)
+
+// gzipWriter holds back the response header and buffers up to minSize bytes
+// of the body, then decides whether to compress: only bodies of at least
+// minSize bytes are, or ones that are flushed before they are complete.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	level   int
+	state   gzipState
+	code    int
+	buf     []byte
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.state != gzipPending || code < http.StatusOK {
+		// Informational responses such as 103 Early Hints pass through.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.code != 0 {
+		return
+	}
+	w.code = code
+	h := w.Header()
+	// Byte ranges are of the uncompressed body and must stay that way.
+	if code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent || h.Get("Content-Range") != "" ||
+		h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+		w.plain()
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < w.minSize {
+		w.plain()
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.state {
+	case gzipPlain:
+		return w.ResponseWriter.Write(p)
+	case gzipActive:
+		return w.gz.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide settles a pending response on compressing, once enough of the body
+// is known to sniff its type if the backend did not name one.
+func (w *gzipWriter) decide() error {
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if !compressibleType(h.Get("Content-Type")) {
+		return w.plain()
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	h.Add("Vary", "Accept-Encoding")
+	weakenETag(h)
+	w.state = gzipActive
+	w.ResponseWriter.WriteHeader(w.code)
+	w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+	buf := w.buf
+	w.buf = nil
+	_, err := w.gz.Write(buf)
+	return err
+}
+
+// plain sends the held back header and buffered body unchanged.
+func (w *gzipWriter) plain() error {
+	w.state = gzipPlain
+	w.ResponseWriter.WriteHeader(w.code)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// FlushError sends what has been written so far to the client. A response
+// still pending is being streamed before minSize bytes are known: it is
+// compressed unless its type is unknown and nothing is left to sniff.
+func (w *gzipWriter) FlushError() error {
+	if w.state == gzipPending {
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		var err error
+		if w.Header().Get("Content-Type") == "" && len(w.buf) == 0 {
+			err = w.plain()
+		} else {
+			err = w.decide()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if w.state == gzipActive {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// close completes the response once the handler has returned.
+func (w *gzipWriter) close() {
+	switch w.state {
+	case gzipPending:
+		if w.code != 0 {
+			w.plain()
+		}
+	case gzipActive:
+		w.gz.Close()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// weakenETag marks a strong ETag in h weak: a body that is compressed or
+// decompressed on the way is no longer byte-for-byte the tagged one.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// gunzipResponse decodes a gzip-encoded backend response for a client that
+// does not accept gzip, and fixes up its headers to match.
+func gunzipResponse(r *http.Request, resp *http.Response) {
+	if r.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || acceptsGzip(r) {
+		return
+	}
+	coding := strings.TrimSpace(resp.Header.Get("Content-Encoding"))
+	if !strings.EqualFold(coding, "gzip") && !strings.EqualFold(coding, "x-gzip") {
+		return
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	weakenETag(resp.Header)
+	resp.Body = &gunzipBody{body: resp.Body}
+}
+
+// gunzipBody decompresses a gzip-encoded body as it is read. The gzip header
+// is only read on the first Read, so an empty body fails then rather than
+// before the response header is sent.
+type gunzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *gunzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gunzipBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,165 @@
+package gateway
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_Compression(t *testing.T) {
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("short"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(text))
+		case "/partial":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(text)-1, 2*len(text)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(text))
+		case "/unsatisfiable":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(text)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			w.Write([]byte(strings.Repeat("range not satisfiable\n", 100)))
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(text))
+		}
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher:  dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:       func(*http.Request) string { return "echo" },
+		Compression: &Compression{MinSize: 512},
+	})
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/text", "br, gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected a gzipped response, got Content-Encoding %q", got)
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Errorf("expected no Content-Length, got %q", rec.Header().Get("Content-Length"))
+	}
+	if got := rec.Header().Get("ETag"); got != `W/"v1"` {
+		t.Errorf("expected the ETag to be weakened, got %q", got)
+	}
+	if rec.Body.Len() >= len(text) {
+		t.Errorf("expected the body to shrink, got %d bytes for %d", rec.Body.Len(), len(text))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || string(body) != text {
+		t.Errorf("expected the decompressed body to match, got %d bytes (err %v)", len(body), err)
+	}
+
+	for _, tt := range []struct {
+		name, path, acceptEncoding string
+	}{
+		{"client without gzip", "/text", ""},
+		{"gzip refused", "/text", "gzip;q=0"},
+		{"small body", "/small", "gzip"},
+		{"image", "/image", "gzip"},
+		{"partial content", "/partial", "gzip"},
+		{"range not satisfiable", "/unsatisfiable", "gzip"},
+	} {
+		rec := get(tt.path, tt.acceptEncoding)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected no compression, got Content-Encoding %q", tt.name, got)
+		}
+		if tt.path != "/small" && tt.path != "/unsatisfiable" && rec.Body.String() != text {
+			t.Errorf("%s: expected the body unchanged, got %d bytes", tt.name, rec.Body.Len())
+		}
+	}
+}
+
+func TestCompression_LeavesEncodedResponsesAlone(t *testing.T) {
+	h := (&Compression{MinSize: 1}).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("already compressed"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "br" || rec.Body.String() != "already compressed" {
+		t.Errorf("expected the response unchanged, got %q %q", got, rec.Body.String())
+	}
+}
+
+func TestGateway_DecompressesForClientsWithoutGzip(t *testing.T) {
+	const text = "hello from a backend that always compresses"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"v1"`)
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(text))
+		zw.Close()
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+	})
+
+	for _, acceptEncoding := range []string{"", "identity", "br", "gzip;q=0"} {
+		req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("Accept-Encoding %q: expected no Content-Encoding, got %q", acceptEncoding, got)
+		}
+		if rec.Body.String() != text {
+			t.Errorf("Accept-Encoding %q: expected plaintext, got %q", acceptEncoding, rec.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected gzip to reach a client accepting it, got Content-Encoding %q", got)
+	}
+	if got := rec.Header().Get("ETag"); got != `"v1"` {
+		t.Errorf("expected the ETag unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browser clients on other origins call the gateway. Preflight
+// requests are answered by the gateway itself and never reach a backend.
+type CORS struct {
+	// AllowedOrigins lists origins such as "https://app.example.com" that
+	// may call the gateway; "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedMethods lists the methods cross-origin requests may use.
+	// Defaults to GET, HEAD and POST.
+	AllowedMethods []string
+
+	// AllowedHeaders lists request headers cross-origin requests may set
+	// beyond the CORS-safelisted ones, e.g. "Authorization"; "*" allows any.
+	AllowedHeaders []string
+
+	// AllowCredentials lets browsers send cookies and credentials. The
+	// requesting origin is then echoed even where "*" allowed it.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight result. Zero leaves
+	// it to the browser.
+	MaxAge time.Duration
+}
+
+// corsPolicy applies a CORS configuration.
+type corsPolicy struct {
+	cfg         CORS
+	anyOrigin   bool
+	anyHeader   bool
+	methods     string // for Access-Control-Allow-Methods
+	allowMethod map[string]bool
+	allowHeader map[string]bool // canonical header names
+}
+
+func newCORSPolicy(cfg *CORS) *corsPolicy {
+	if cfg == nil {
+		return nil
+	}
+	p := &corsPolicy{cfg: *cfg, allowMethod: make(map[string]bool), allowHeader: make(map[string]bool)}
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			p.anyOrigin = true
+		}
+	}
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	for _, m := range methods {
+		p.allowMethod[strings.ToUpper(m)] = true
+	}
+	p.methods = strings.ToUpper(strings.Join(methods, ", "))
+	for _, h := range cfg.AllowedHeaders {
+		if h == "*" {
+			p.anyHeader = true
+		}
+		p.allowHeader[http.CanonicalHeaderKey(h)] = true
+	}
+	return p
+}
+
+// wrap answers preflight requests and adds CORS headers to the responses of
+// next for allowed origins. A nil policy returns next unchanged.
+func (p *corsPolicy) wrap(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			p.preflight(w, r, origin)
+			return
+		}
+		if !p.allowOrigin(origin) {
+			w.Header().Add("Vary", "Origin")
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, policy: p, origin: origin}, r)
+	})
+}
+
+// preflight answers a preflight request with 204, with CORS headers only if
+// the origin, method and headers requested are all allowed.
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	requested := requestedHeaders(r)
+	if p.allowOrigin(origin) && p.allowMethod[strings.ToUpper(method)] && p.allowHeaders(requested) {
+		p.setOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", p.methods)
+		if len(requested) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if p.cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.cfg.MaxAge/time.Second)))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *corsPolicy) allowOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	for _, o := range p.cfg.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *corsPolicy) allowHeaders(requested []string) bool {
+	if p.anyHeader {
+		return true
+	}
+	for _, name := range requested {
+		if !p.allowHeader[http.CanonicalHeaderKey(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin sets the headers granting origin access.
+func (p *corsPolicy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin && !p.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// requestedHeaders returns the header names a preflight request asks for.
+func requestedHeaders(r *http.Request) []string {
+	var names []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// corsWriter adds CORS headers just before the response header is written,
+// so they replace any a backend sent.
+type corsWriter struct {
+	http.ResponseWriter
+	policy *corsPolicy
+	origin string
+	wrote  bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *corsWriter) setHeaders() {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	h := w.Header()
+	h.Del("Access-Control-Allow-Origin")
+	h.Del("Access-Control-Allow-Credentials")
+	w.policy.setOrigin(h, w.origin)
+	h.Add("Vary", "Origin")
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
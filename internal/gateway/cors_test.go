@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_CORS(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+		CORS: &CORS{
+			AllowedOrigins: []string{"https://app.example.com"},
+			AllowedMethods: []string{http.MethodGet, http.MethodPut},
+			AllowedHeaders: []string{"Authorization", "Content-Type"},
+			MaxAge:         10 * time.Minute,
+		},
+	})
+	h := gw.Handler()
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/echo", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := preflight("https://app.example.com")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("permitted preflight: expected 204, got %d", rec.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "authorization, content-type",
+		"Access-Control-Max-Age":       "600",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("permitted preflight: expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	rec = preflight("https://evil.example.com")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("disallowed preflight: expected 204, got %d", rec.Code)
+	}
+	for name := range want {
+		if got := rec.Header().Get(name); got != "" {
+			t.Errorf("disallowed preflight: expected no %s, got %q", name, got)
+		}
+	}
+	if backendCalls != 0 {
+		t.Errorf("expected preflights to be answered by the gateway, backend saw %d", backendCalls)
+	}
+
+	get := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = get("https://app.example.com")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); rec.Code != http.StatusOK || got != "https://app.example.com" {
+		t.Errorf("permitted request: expected 200 with the origin allowed, got %d %q", rec.Code, got)
+	}
+	rec = get("https://evil.example.com")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); rec.Code != http.StatusOK || got != "" {
+		t.Errorf("disallowed request: expected 200 without CORS headers, got %d %q", rec.Code, got)
+	}
+}
@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollInterval is how often a draining instance's in-flight requests
+// are checked.
+const drainPollInterval = 50 * time.Millisecond
+
+// finishDrain unregisters a draining instance once its in-flight requests
+// have completed, the drain grace period has passed or ctx is done, whichever
+// is first.
+func (g *Gateway) finishDrain(ctx context.Context, service, id string) {
+	deadline := time.Now().Add(g.drainGrace)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for g.dispatcher.InFlight(service, id) > 0 && time.Now().Before(deadline) && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+	if store, ok := g.registry.(drainStore); ok {
+		store.FinishDrain(service, id)
+	}
+}
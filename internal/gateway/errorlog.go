@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxErrorKeys bounds how many distinct errors the sampler remembers.
+const maxErrorKeys = 1024
+
+// errorLog logs forwarding errors, collapsing repeats: each distinct
+// service, reason and kind of error is logged at most once per interval, and
+// how many were suppressed in between is reported with the next one or,
+// if none follows, once the interval is over. This keeps an outage from
+// flooding the log with one line per request.
+type errorLog struct {
+	mu       sync.Mutex
+	out      *log.Logger
+	interval time.Duration
+	now      func() time.Time
+	after    func(time.Duration, func()) // schedules the report of suppressed errors
+	seen     map[errorKey]*errorSample
+}
+
+type errorKey struct {
+	service string
+	reason  string
+	class   string
+}
+
+type errorSample struct {
+	logged     time.Time // When the error was last written
+	suppressed int       // Occurrences since then
+	last       string    // Message of the latest suppressed occurrence
+}
+
+func newErrorLog(out *log.Logger, interval time.Duration) *errorLog {
+	return &errorLog{
+		out:      out,
+		interval: interval,
+		now:      time.Now,
+		after:    func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		seen:     make(map[errorKey]*errorSample),
+	}
+}
+
+// errorClass names the kind of err for collapsing repeats, leaving out the
+// URL a request error mentions, so failures of requests for different paths
+// count as the same error.
+func errorClass(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Err != nil {
+			return opErr.Op + ": " + opErr.Err.Error()
+		}
+		return opErr.Op
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return errorClass(urlErr.Err)
+	}
+	return err.Error()
+}
+
+// log records an error from forwarding to service.
+func (l *errorLog) log(service, reason string, err error) {
+	key := errorKey{service: service, reason: reason, class: errorClass(err)}
+	msg := reason + ": " + err.Error()
+	now := l.now()
+
+	l.mu.Lock()
+	s := l.seen[key]
+	if s != nil && now.Sub(s.logged) < l.interval {
+		s.suppressed++
+		s.last = msg
+		if s.suppressed == 1 {
+			l.after(s.logged.Add(l.interval).Sub(now), func() { l.flush(key, s) })
+		}
+		l.mu.Unlock()
+		return
+	}
+	var evicted []string
+	suppressed := 0
+	if s == nil {
+		if len(l.seen) >= maxErrorKeys {
+			evicted = l.prune(now)
+		}
+		s = &errorSample{}
+		l.seen[key] = s
+	} else {
+		suppressed = s.suppressed
+	}
+	s.logged = now
+	s.suppressed = 0
+	l.mu.Unlock()
+
+	for _, line := range evicted {
+		l.out.Print(line)
+	}
+	if suppressed > 0 {
+		l.out.Printf("service %q: %s (%d more in the last %v)", service, msg, suppressed, l.interval)
+		return
+	}
+	l.out.Printf("service %q: %s", service, msg)
+}
+
+// flush reports the errors suppressed for key since s was logged, unless
+// they have been reported or s forgotten meanwhile.
+func (l *errorLog) flush(key errorKey, s *errorSample) {
+	l.mu.Lock()
+	if l.seen[key] != s || s.suppressed == 0 {
+		l.mu.Unlock()
+		return
+	}
+	line := suppressedLine(key, s, l.interval)
+	s.logged = l.now()
+	s.suppressed = 0
+	l.mu.Unlock()
+	l.out.Print(line)
+}
+
+// prune makes room for another error: it forgets errors not seen for an
+// interval and, if that frees nothing, the one logged longest ago. It returns
+// the lines reporting what the forgotten errors had suppressed. Caller must
+// hold l.mu.
+func (l *errorLog) prune(now time.Time) []string {
+	for key, s := range l.seen {
+		if now.Sub(s.logged) >= l.interval && s.suppressed == 0 {
+			delete(l.seen, key)
+		}
+	}
+	if len(l.seen) < maxErrorKeys {
+		return nil
+	}
+	var oldest errorKey
+	var oldestSample *errorSample
+	for key, s := range l.seen {
+		if oldestSample == nil || s.logged.Before(oldestSample.logged) {
+			oldest, oldestSample = key, s
+		}
+	}
+	delete(l.seen, oldest)
+	if oldestSample.suppressed == 0 {
+		return nil
+	}
+	return []string{suppressedLine(oldest, oldestSample, l.interval)}
+}
+
+// suppressedLine reports the occurrences s suppressed for key.
+func suppressedLine(key errorKey, s *errorSample, interval time.Duration) string {
+	return fmt.Sprintf("service %q: %s (%d times in the last %v)", key.service, s.last, s.suppressed, interval)
+}
@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestErrorLog_CollapsesRepeatedErrors(t *testing.T) {
+	var buf bytes.Buffer
+	l := newErrorLog(log.New(&buf, "", 0), time.Second)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	l.after = func(time.Duration, func()) {}
+
+	refused := errors.New("connection refused")
+	for i := 0; i < 500; i++ {
+		l.log("echo", "upstream-error", refused)
+		l.log("users", "upstream-error", refused)
+	}
+	l.log("echo", "timeout", errors.New("deadline exceeded"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected one line per distinct service+error, got %d:\n%s", len(lines), buf.String())
+	}
+
+	buf.Reset()
+	now = now.Add(time.Second)
+	l.log("echo", "upstream-error", refused)
+	want := `service "echo": upstream-error: connection refused (499 more in the last 1s)`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestErrorLog_CollapsesAcrossPaths(t *testing.T) {
+	var buf bytes.Buffer
+	l := newErrorLog(log.New(&buf, "", 0), time.Second)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	var flush func()
+	l.after = func(_ time.Duration, f func()) { flush = f }
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		l.log("echo", "upstream-error", &url.Error{
+			Op:  "Get",
+			URL: "http://127.0.0.1:1" + path,
+			Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+		})
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("expected requests for different paths to collapse into one line, got:\n%s", buf.String())
+	}
+
+	// Without another occurrence, the suppressed ones are reported once the
+	// interval is over.
+	buf.Reset()
+	now = now.Add(time.Second)
+	flush()
+	want := `service "echo": upstream-error: Get "http://127.0.0.1:1/c": dial tcp: connection refused (2 times in the last 1s)`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestErrorLog_BoundsKeys(t *testing.T) {
+	var buf bytes.Buffer
+	l := newErrorLog(log.New(&buf, "", 0), time.Minute)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	l.after = func(time.Duration, func()) {}
+
+	for i := 0; i < 2*maxErrorKeys; i++ {
+		l.log("echo", "upstream-error", fmt.Errorf("error %d", i))
+		now = now.Add(time.Millisecond)
+	}
+	if n := len(l.seen); n > maxErrorKeys {
+		t.Errorf("expected at most %d keys, got %d", maxErrorKeys, n)
+	}
+}
+
+func TestGateway_ErrorLog_BoundsLinesDuringOutage(t *testing.T) {
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: "http://127.0.0.1:1"})
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	var buf bytes.Buffer
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route: func(req *http.Request) string {
+			return "echo"
+		},
+		ErrorLog:         log.New(&buf, "", 0),
+		ErrorLogInterval: time.Hour,
+	})
+
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo/", nil))
+		// 503 once the breaker has opened.
+		if rec.Code != http.StatusBadGateway && rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 502 or 503, got %d", rec.Code)
+		}
+	}
+	// The refused connection and, once the breaker opens, circuit-open.
+	if n := strings.Count(buf.String(), "\n"); n == 0 || n > 2 {
+		t.Errorf("expected at most 2 log lines for 20 failures, got %d:\n%s", n, buf.String())
+	}
+}
+
+func TestGateway_ErrorBody_HidesBackendDetails(t *testing.T) {
+	const addr = "http://127.0.0.1:1"
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: addr})
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	var buf bytes.Buffer
+	capture := &captureHandler{}
+	gw := New(Config{
+		Dispatcher:   dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:        func(*http.Request) string { return "echo" },
+		ErrorLog:     log.New(&buf, "", 0),
+		Logger:       slog.New(capture),
+		ErrorMessage: "upstream unavailable",
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/echo/", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	gw.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON body, got Content-Type %q", ct)
+	}
+	if strings.Contains(rec.Body.String(), "127.0.0.1") {
+		t.Errorf("expected the body not to reveal the backend, got %q", rec.Body.String())
+	}
+	var body errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if body.Error != "upstream unavailable" || body.RequestID != "req-42" {
+		t.Errorf("unexpected body: %+v", body)
+	}
+
+	if !strings.Contains(buf.String(), "127.0.0.1:1") {
+		t.Errorf("expected the error log to name the backend, got %q", buf.String())
+	}
+	if len(capture.records) != 1 || !strings.Contains(capture.records[0]["error"].String(), "127.0.0.1:1") {
+		t.Errorf("expected the request record to carry the error, got %v", capture.records)
+	}
+}
+
+func TestGateway_ErrorBody_DefaultsToStatusText(t *testing.T) {
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: "http://127.0.0.1:1"})
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+	})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo/", nil))
+	var body errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if body.Error != "Bad Gateway" || body.RequestID == "" {
+		t.Errorf("unexpected body: %+v", body)
+	}
+}
@@ -2,63 +2,348 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sony/gobreaker"
+	"kerberos/internal/admission"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/clientip"
+	"kerberos/internal/clock"
 	"kerberos/internal/dispatcher"
+	"kerberos/internal/hopbyhop"
+	"kerberos/internal/latency"
+	"kerberos/internal/metrics"
 	"kerberos/internal/registry"
 )
 
 // Gateway is the HTTP gateway that receives requests and dispatches them.
 type Gateway struct {
 	addr       string
-	registry   *registry.Registry
+	registry   registry.Store
 	dispatcher *dispatcher.Dispatcher
-	route      dispatcher.RouteFunc
+	resolve    dispatcher.RouteResultFunc
+	admission  *admission.Controller
+	accessLog  *accessLog
+	errorLog   *errorLog
+	logger     *slog.Logger
+	limits     map[string]*routeLimiter
+	middleware []func(http.Handler) http.Handler
+	root       Root
+	latency    *latency.Tracker
+	metrics    *metrics.Collector
+	breakers   *circuitbreaker.Client
 	server     *http.Server
+	baseServer *http.Server
+	tlsConfig  *tls.Config
+	certFile   string
+	keyFile    string
+	tracer     Tracer
+
+	adminToken         string
+	clientLimit        *clientLimiter
+	clientIP           *clientip.Resolver
+	drainGrace         time.Duration
+	maxRequestBody     int64
+	maxResponseBody    int64
+	retryAfter         time.Duration
+	shutdownRetryAfter time.Duration
+	responseHeaders    HeaderRules
+	errorMessage       string
+	cors               *corsPolicy
+	paths              *PathNormalization
+	compression        *Compression
+	shuttingDown       atomic.Bool
+	background         context.Context // canceled by Shutdown
+	stopBackground     context.CancelFunc
+	tasks              sync.WaitGroup // tasks started with Go
+	conns              atomic.Int64   // open client connections
 }
 
 // Config for the gateway.
 type Config struct {
 	Addr       string
-	Registry   *registry.Registry // optional, enables POST/DELETE /register
+	Registry   registry.Store // optional, enables POST/PATCH/DELETE /register
 	Dispatcher *dispatcher.Dispatcher
 	Route      dispatcher.RouteFunc
+	Resolve    dispatcher.RouteResultFunc // optional; takes precedence over Route
+	Admission  *admission.Controller      // optional; throttles services whose upstreams return 503
+
+	// TLSConfig, or CertFile and KeyFile, make Start serve HTTPS, with
+	// HTTP/2 negotiated automatically. Without them Start serves plain HTTP.
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+
+	// Server optionally provides the settings of the http.Server to run, e.g.
+	// to override its timeouts. The gateway runs a copy with its own Handler
+	// and, when empty, its Addr; Server itself is left unchanged.
+	Server *http.Server
+
+	// Middleware wraps every endpoint, proxied and built-in alike; the first
+	// entry is outermost. The access log, if any, sits outside all of them.
+	// Requests reach them with an X-Request-ID, see RequestIDFromContext.
+	Middleware []func(http.Handler) http.Handler
+
+	// CORS, when set, lets browsers on the allowed origins call every
+	// endpoint. It sits outside Middleware, so preflight requests are
+	// answered without reaching authentication or a backend.
+	CORS *CORS
+
+	// NormalizePaths, when set, collapses duplicate slashes and applies a
+	// trailing slash policy to the paths of requests for backends before
+	// they are routed; the gateway's own endpoints, such as /health, are
+	// left alone. It sits outside Middleware, so authentication sees the
+	// normalized path.
+	NormalizePaths *PathNormalization
+
+	// Tracer, when set, gets a server span for each routed request and a
+	// client span for forwarding it, continuing any incoming W3C trace
+	// context and passing the client span's on to the backend.
+	Tracer Tracer
+
+	// Latency enables GET /latency reporting per-service percentiles. Pass
+	// the same tracker to dispatcher.WithLatency.
+	Latency *latency.Tracker
+
+	// Root selects how the bare root path "/" is answered: routed like any
+	// other path (default), a status JSON, a redirect, or a default service.
+	Root Root
+
+	// MetricsEnabled serves Prometheus metrics at GET /metrics: request
+	// counts, status codes and durations per service and, when Breakers is
+	// set, the state and request counters of each target's circuit breaker.
+	// Breakers also enables GET /breakers.
+	MetricsEnabled bool
+	Breakers       *circuitbreaker.Client // optional; the client the dispatcher forwards through
+
+	// RouteLimits caps concurrency and request rate per routed service.
+	RouteLimits map[string]RouteLimit
+
+	// RateLimit caps the rate of proxied requests from each client IP,
+	// whatever the service. Built-in endpoints are not limited.
+	RateLimit RateLimit
+
+	// ClientIP determines the client IP for RateLimit. Without it forwarding
+	// headers are ignored; pass the same resolver to balancer.WithClientIP.
+	ClientIP *clientip.Resolver
+
+	// Clock drives the rate limiters; it defaults to the wall clock.
+	Clock clock.Clock
+
+	// Compression, when set, gzips responses for clients that accept it.
+	Compression *Compression
+
+	// ResponseHeaders adds, replaces and removes headers of every proxied
+	// response before it is sent to the client.
+	ResponseHeaders HeaderRules
+
+	// AccessLog receives one line per request when set. AccessLogFormat
+	// selects the format; it defaults to CombinedLogFormat.
+	AccessLog       io.Writer
+	AccessLogFormat AccessLogFormatter
+
+	// Logger, when set, receives one structured record per routed request
+	// once it completes: method, path, service, instance, status, bytes and
+	// duration.
+	Logger *slog.Logger
+
+	// ErrorLog receives forwarding errors when set. Identical errors for a
+	// service are logged at most once per ErrorLogInterval (default 1s),
+	// with a count of the repeats.
+	ErrorLog         *log.Logger
+	ErrorLogInterval time.Duration
+
+	// ErrorMessage is sent to clients when forwarding fails, in a JSON body
+	// {"error": ..., "request_id": ...}. The error itself, which may name
+	// backend addresses, only goes to ErrorLog and Logger. Defaults to the
+	// status text, e.g. "Bad Gateway".
+	ErrorMessage string
+
+	// AdminToken enables the /admin/ endpoints, which require it as a bearer
+	// token (Authorization: Bearer <token>). Empty disables them.
+	AdminToken string
+
+	// MaxRequestBodyBytes rejects requests with larger bodies with 413.
+	// MaxResponseBodyBytes cuts backend responses off after that many bytes.
+	// Zero means unlimited.
+	MaxRequestBodyBytes  int64
+	MaxResponseBodyBytes int64
+
+	// DrainGrace bounds how long DELETE /register?drain=true waits for an
+	// instance's in-flight requests before unregistering it. Defaults to 30s.
+	DrainGrace time.Duration
+
+	// RetryAfter is advertised in Retry-After on 502/503 responses the
+	// gateway generates itself, unless a circuit breaker knows better.
+	// Defaults to 1s.
+	RetryAfter time.Duration
+
+	// ShutdownRetryAfter is advertised in Retry-After on requests refused
+	// while shutting down. Defaults to 5s.
+	ShutdownRetryAfter time.Duration
 }
 
 // New creates a new gateway.
 func New(cfg Config) *Gateway {
+	retryAfter := cfg.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	shutdownRetryAfter := cfg.ShutdownRetryAfter
+	if shutdownRetryAfter <= 0 {
+		shutdownRetryAfter = 5 * time.Second
+	}
+	drainGrace := cfg.DrainGrace
+	if drainGrace <= 0 {
+		drainGrace = 30 * time.Second
+	}
+	resolve := cfg.Resolve
+	if resolve == nil && cfg.Route != nil {
+		resolve = cfg.Route.Result()
+	}
+	if cfg.Root.Mode == RootService {
+		resolve = resolveRoot(resolve, cfg.Root.Service)
+	}
+	var accessLog *accessLog
+	if cfg.AccessLog != nil {
+		accessLog = newAccessLog(cfg.AccessLog, cfg.AccessLogFormat)
+	}
+	var errorLog *errorLog
+	if cfg.ErrorLog != nil {
+		interval := cfg.ErrorLogInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		errorLog = newErrorLog(cfg.ErrorLog, interval)
+	}
+	limits := make(map[string]*routeLimiter, len(cfg.RouteLimits))
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+	for service, l := range cfg.RouteLimits {
+		limits[service] = newRouteLimiter(l, clk)
+	}
+	var clientLimit *clientLimiter
+	if cfg.RateLimit.Rate > 0 {
+		clientLimit = newClientLimiter(cfg.RateLimit, clk)
+	}
+	background, stopBackground := context.WithCancel(context.Background())
+	var collector *metrics.Collector
+	if cfg.MetricsEnabled {
+		collector = metrics.New()
+	}
 	return &Gateway{
-		addr:       cfg.Addr,
-		registry:   cfg.Registry,
-		dispatcher: cfg.Dispatcher,
-		route:      cfg.Route,
+		addr:               cfg.Addr,
+		registry:           registry.StoreOrNil(cfg.Registry),
+		dispatcher:         cfg.Dispatcher,
+		resolve:            resolve,
+		admission:          cfg.Admission,
+		accessLog:          accessLog,
+		errorLog:           errorLog,
+		logger:             cfg.Logger,
+		limits:             limits,
+		clientLimit:        clientLimit,
+		clientIP:           cfg.ClientIP,
+		middleware:         cfg.Middleware,
+		baseServer:         cfg.Server,
+		tlsConfig:          cfg.TLSConfig,
+		certFile:           cfg.CertFile,
+		keyFile:            cfg.KeyFile,
+		tracer:             cfg.Tracer,
+		root:               cfg.Root,
+		latency:            cfg.Latency,
+		metrics:            collector,
+		breakers:           cfg.Breakers,
+		adminToken:         cfg.AdminToken,
+		drainGrace:         drainGrace,
+		maxRequestBody:     cfg.MaxRequestBodyBytes,
+		maxResponseBody:    cfg.MaxResponseBodyBytes,
+		retryAfter:         retryAfter,
+		shutdownRetryAfter: shutdownRetryAfter,
+		responseHeaders:    cfg.ResponseHeaders,
+		errorMessage:       cfg.ErrorMessage,
+		cors:               newCORSPolicy(cfg.CORS),
+		paths:              cfg.NormalizePaths,
+		compression:        cfg.Compression,
+		background:         background,
+		stopBackground:     stopBackground,
 	}
 }
 
 // registerRequest for POST /register.
 type registerRequest struct {
+	Service string            `json:"service"`
+	ID      string            `json:"id"`
+	Addr    string            `json:"addr"`
+	Weight  int               `json:"weight,omitempty"` // optional; >= 1 for weighted LB, < 1 falls back to unweighted
+	Tags    map[string]string `json:"tags,omitempty"`   // optional; matched against route tag constraints
+	Zone    string            `json:"zone,omitempty"`   // optional; availability zone for zone-aware balancing
+	TTL     int               `json:"ttl,omitempty"`    // optional; seconds without a heartbeat before the instance is removed
+
+	// optional; requests in flight the instance accepts at once, 0 for the balancer's default
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+}
+
+// unregisterRequest for DELETE /register and POST /register/heartbeat.
+type unregisterRequest struct {
 	Service string `json:"service"`
 	ID      string `json:"id"`
-	Addr    string `json:"addr"`
-	Weight  int    `json:"weight,omitempty"` // optional; >= 1 for weighted LB, < 1 falls back to unweighted
 }
 
-// unregisterRequest for DELETE /register.
-type unregisterRequest struct {
+// weightRequest for PATCH /register.
+type weightRequest struct {
 	Service string `json:"service"`
 	ID      string `json:"id"`
+	Weight  *int   `json:"weight"`
 }
 
 // Handler returns the HTTP handler for the gateway. Useful for testing.
 func (g *Gateway) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", g.handleRegister)
+	mux.HandleFunc("/register/batch", g.handleRegisterBatch)
+	mux.HandleFunc("/register/heartbeat", g.handleHeartbeat)
+	mux.HandleFunc("/register/all", g.handleUnregisterService)
 	mux.HandleFunc("/services", g.handleServices)
-	mux.HandleFunc("/", g.handleRequest)
-	return mux
+	mux.HandleFunc("/latency", g.handleLatency)
+	mux.HandleFunc("/breakers", g.handleBreakers)
+	mux.HandleFunc("/registry/diff", g.handleRegistryDiff)
+	mux.HandleFunc("/admin/runtime", g.adminOnly(g.handleRuntime))
+	mux.HandleFunc("/metrics", g.handleMetrics)
+	mux.HandleFunc("/health", g.handleHealth)
+	mux.HandleFunc("/ready", g.handleReady)
+	mux.Handle("/", g.limitClients(http.HandlerFunc(g.handleRequest)))
+	var h http.Handler = mux
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		h = g.middleware[i](h)
+	}
+	h = g.compression.wrap(h)
+	h = g.paths.wrap(h, func(r *http.Request) bool {
+		// The gateway's own endpoints keep their paths.
+		_, pattern := mux.Handler(r)
+		return pattern == "/"
+	})
+	h = g.cors.wrap(h)
+	if g.accessLog != nil {
+		h = g.accessLog.wrap(h)
+	}
+	return withRequestID(h)
 }
 
 func (g *Gateway) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -74,11 +359,35 @@ func (g *Gateway) handleRegister(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "invalid JSON", http.StatusBadRequest)
 			return
 		}
-		if req.Service == "" || req.ID == "" || req.Addr == "" {
-			http.Error(w, "service, id, and addr are required", http.StatusBadRequest)
+		if req.TTL < 0 {
+			http.Error(w, "ttl must not be negative", http.StatusBadRequest)
+			return
+		}
+		store, ok := g.registry.(ttlStore)
+		if req.TTL > 0 && !ok {
+			http.Error(w, "registry does not support TTLs", http.StatusNotImplemented)
+			return
+		}
+		inst := registry.Instance{ID: req.ID, Addr: req.Addr, Weight: req.Weight, Tags: req.Tags, Zone: req.Zone, MaxConcurrency: req.MaxConcurrency}
+		err := registry.Validate(req.Service, inst)
+		if err == nil {
+			if req.TTL > 0 {
+				err = store.RegisterWithTTL(req.Service, inst, time.Duration(req.TTL)*time.Second)
+			} else {
+				err = g.registry.Register(req.Service, inst)
+			}
+		}
+		switch {
+		case errors.Is(err, registry.ErrInvalidInstance):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, registry.ErrDuplicateID):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		g.registry.Register(req.Service, registry.Instance{ID: req.ID, Addr: req.Addr, Weight: req.Weight})
 		w.WriteHeader(http.StatusNoContent)
 
 	case http.MethodDelete:
@@ -91,14 +400,167 @@ func (g *Gateway) handleRegister(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "service and id are required", http.StatusBadRequest)
 			return
 		}
+		if r.URL.Query().Get("drain") == "true" {
+			store, ok := g.registry.(drainStore)
+			if !ok {
+				http.Error(w, "registry does not support draining", http.StatusNotImplemented)
+				return
+			}
+			if store.Drain(req.Service, req.ID) {
+				g.Go(func(ctx context.Context) { g.finishDrain(ctx, req.Service, req.ID) })
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
 		g.registry.Unregister(req.Service, req.ID)
 		w.WriteHeader(http.StatusNoContent)
 
+	case http.MethodPatch:
+		var req weightRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Service == "" || req.ID == "" || req.Weight == nil {
+			http.Error(w, "service, id and weight are required", http.StatusBadRequest)
+			return
+		}
+		if *req.Weight < 0 {
+			http.Error(w, "weight must not be negative", http.StatusBadRequest)
+			return
+		}
+		store, ok := g.registry.(weightStore)
+		if !ok {
+			http.Error(w, "registry does not support changing weights", http.StatusNotImplemented)
+			return
+		}
+		if !store.SetWeight(req.Service, req.ID, *req.Weight) {
+			http.Error(w, "instance not registered", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// handleHeartbeat renews the TTL of an instance registered with one.
+func (g *Gateway) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if g.registry == nil {
+		http.Error(w, "registration not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := g.registry.(ttlStore)
+	if !ok {
+		http.Error(w, "registry does not support TTLs", http.StatusNotImplemented)
+		return
+	}
+	var req unregisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !store.Renew(req.Service, req.ID) {
+		http.Error(w, "instance not registered", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unregisterServiceRequest for DELETE /register/all.
+type unregisterServiceRequest struct {
+	Service string `json:"service"`
+}
+
+// handleUnregisterService removes every instance of a service. Clearing a
+// service without instances succeeds without changing anything.
+func (g *Gateway) handleUnregisterService(w http.ResponseWriter, r *http.Request) {
+	if g.registry == nil {
+		http.Error(w, "registration not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req unregisterServiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Service == "" {
+		http.Error(w, "service is required", http.StatusBadRequest)
+		return
+	}
+	if store, ok := g.registry.(serviceStore); ok {
+		store.UnregisterService(req.Service)
+	} else {
+		for _, inst := range g.registry.GetInstances(req.Service) {
+			g.registry.Unregister(req.Service, inst.ID)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchItemError reports a rejected entry of a POST /register/batch.
+type batchItemError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// handleRegisterBatch registers every instance in a JSON array of
+// registrations, or none of them if any is invalid.
+func (g *Gateway) handleRegisterBatch(w http.ResponseWriter, r *http.Request) {
+	if g.registry == nil {
+		http.Error(w, "registration not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := g.registry.(batchStore)
+	if !ok {
+		http.Error(w, "registry does not support batch registration", http.StatusNotImplemented)
+		return
+	}
+	var reqs []registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	regs := make([]registry.Registration, len(reqs))
+	for i, req := range reqs {
+		regs[i] = registry.Registration{
+			Service:  req.Service,
+			Instance: registry.Instance{ID: req.ID, Addr: req.Addr, Weight: req.Weight, Tags: req.Tags, Zone: req.Zone, MaxConcurrency: req.MaxConcurrency},
+		}
+	}
+	var batchErr *registry.BatchError
+	err := store.RegisterBatch(regs)
+	if errors.As(err, &batchErr) {
+		var items []batchItemError
+		for i, err := range batchErr.Items {
+			if err != nil {
+				items = append(items, batchItemError{Index: i, Error: err.Error()})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string][]batchItemError{"errors": items})
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (g *Gateway) handleServices(w http.ResponseWriter, r *http.Request) {
 	if g.registry == nil {
 		http.Error(w, "registry not enabled", http.StatusNotImplemented)
@@ -109,49 +571,526 @@ func (g *Gateway) handleServices(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	services := g.registry.ListServices()
+	sort.Strings(services)
+	if q := r.URL.Query(); q.Get("detail") == "true" {
+		match, err := parseInstanceFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.serviceDetails(services, match))
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(services)
 }
 
-// Start begins listening for HTTP requests. Blocks until the server stops.
+// parseInstanceFilter builds the filter for GET /services?detail=true from
+// the query: healthy=true|false, draining=true|false, and any number of
+// tag=key:value, all of which an instance must satisfy.
+func parseInstanceFilter(q url.Values) (func(instanceDetail) bool, error) {
+	healthy, err := boolParam(q, "healthy")
+	if err != nil {
+		return nil, err
+	}
+	draining, err := boolParam(q, "draining")
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, tag := range q["tag"] {
+		k, v, ok := strings.Cut(tag, ":")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid tag %q: want key:value", tag)
+		}
+		tags[k] = v
+	}
+	return func(d instanceDetail) bool {
+		return (healthy == nil || d.Healthy == *healthy) &&
+			(draining == nil || d.Draining == *draining) &&
+			d.HasTags(tags)
+	}, nil
+}
+
+// boolParam parses the query parameter name as a boolean, returning nil if it
+// is not set.
+func boolParam(q url.Values, name string) (*bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: want true or false", name, v)
+	}
+	return &b, nil
+}
+
+// serviceDetail is one service in the GET /services?detail=true response.
+type serviceDetail struct {
+	Name      string           `json:"name"`
+	Instances []instanceDetail `json:"instances"`
+}
+
+// instanceDetail is a registered instance with its health as the gateway
+// sees it: Healthy is false while the instance is marked unhealthy or its
+// breaker is open. Breaker is only reported with Config.Breakers set.
+type instanceDetail struct {
+	registry.Instance
+	Healthy bool   `json:"healthy"`
+	Breaker string `json:"breaker,omitempty"`
+}
+
+// serviceDetails returns the instances of the named services for which match
+// returns true.
+func (g *Gateway) serviceDetails(services []string, match func(instanceDetail) bool) []serviceDetail {
+	var states map[string]gobreaker.State
+	if g.breakers != nil {
+		states = g.breakers.States()
+	}
+	details := make([]serviceDetail, 0, len(services))
+	for _, name := range services {
+		d := serviceDetail{Name: name, Instances: []instanceDetail{}}
+		for _, inst := range g.registry.GetInstances(name) {
+			// Targets without traffic yet have no breaker and count as
+			// closed, the zero State.
+			state := states[inst.Addr]
+			detail := instanceDetail{
+				Instance: inst,
+				Healthy:  !inst.Unhealthy && state != gobreaker.StateOpen,
+			}
+			if g.breakers != nil {
+				detail.Breaker = state.String()
+			}
+			if match(detail) {
+				d.Instances = append(d.Instances, detail)
+			}
+		}
+		details = append(details, d)
+	}
+	return details
+}
+
+// handleRegistryDiff previews replacing the registry with the proposed
+// snapshot in the request body. Nothing is applied.
+func (g *Gateway) handleRegistryDiff(w http.ResponseWriter, r *http.Request) {
+	if g.registry == nil {
+		http.Error(w, "registry not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var proposed registry.Snapshot
+	if err := json.NewDecoder(r.Body).Decode(&proposed); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registry.Compare(registry.SnapshotOf(g.registry), proposed))
+}
+
+func (g *Gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if g.metrics == nil {
+		http.Error(w, "metrics not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	g.metrics.WriteText(w)
+	if g.breakers != nil {
+		metrics.WriteBreakerStats(w, g.breakers.Stats())
+	}
+}
+
+func (g *Gateway) handleLatency(w http.ResponseWriter, r *http.Request) {
+	if g.latency == nil {
+		http.Error(w, "latency tracking not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g.latency.Snapshot())
+}
+
+// handleBreakers reports each target's circuit breaker stats, keyed by
+// target. See circuitbreaker.Stats.
+func (g *Gateway) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	if g.breakers == nil {
+		http.Error(w, "breaker reporting not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g.breakers.Stats())
+}
+
+// Start begins listening for HTTP requests, or HTTPS ones when TLS is
+// configured. Blocks until the server stops.
 func (g *Gateway) Start() error {
-	g.server = &http.Server{
-		Addr:         g.addr,
-		Handler:      g.Handler(),
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	g.server = g.newServer()
+	if g.useTLS() {
+		return g.server.ListenAndServeTLS(g.certFile, g.keyFile)
 	}
 	return g.server.ListenAndServe()
 }
 
+// Serve is like Start but accepts connections on ln.
+func (g *Gateway) Serve(ln net.Listener) error {
+	g.server = g.newServer()
+	if g.useTLS() {
+		return g.server.ServeTLS(ln, g.certFile, g.keyFile)
+	}
+	return g.server.Serve(ln)
+}
+
+func (g *Gateway) useTLS() bool {
+	return g.tlsConfig != nil || g.certFile != ""
+}
+
+// newServer returns a copy of Config.Server set up to serve the gateway, or
+// a server with default timeouts when none was given.
+func (g *Gateway) newServer() *http.Server {
+	var srv *http.Server
+	if base := g.baseServer; base != nil {
+		srv = &http.Server{
+			Addr:                         base.Addr,
+			DisableGeneralOptionsHandler: base.DisableGeneralOptionsHandler,
+			TLSConfig:                    base.TLSConfig,
+			ReadTimeout:                  base.ReadTimeout,
+			ReadHeaderTimeout:            base.ReadHeaderTimeout,
+			WriteTimeout:                 base.WriteTimeout,
+			IdleTimeout:                  base.IdleTimeout,
+			MaxHeaderBytes:               base.MaxHeaderBytes,
+			TLSNextProto:                 base.TLSNextProto,
+			ConnState:                    base.ConnState,
+			ErrorLog:                     base.ErrorLog,
+			BaseContext:                  base.BaseContext,
+			ConnContext:                  base.ConnContext,
+		}
+	} else {
+		srv = &http.Server{
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 60 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		}
+	}
+	if srv.Addr == "" {
+		srv.Addr = g.addr
+	}
+	srv.Handler = g.Handler()
+	if g.tlsConfig != nil {
+		srv.TLSConfig = g.tlsConfig
+	}
+	if connState := srv.ConnState; connState != nil {
+		srv.ConnState = func(c net.Conn, state http.ConnState) {
+			g.trackConn(c, state)
+			connState(c, state)
+		}
+	} else {
+		srv.ConnState = g.trackConn
+	}
+	return srv
+}
+
+// Go runs task in the background for the lifetime of the gateway. Shutdown
+// cancels ctx and waits for task to return, so work such as health checks or
+// a registry reaper does not outlive the gateway.
+func (g *Gateway) Go(task func(ctx context.Context)) {
+	g.tasks.Add(1)
+	go func() {
+		defer g.tasks.Done()
+		task(g.background)
+	}()
+}
+
 // Shutdown gracefully stops the gateway. Waits for in-flight requests to complete
-// up to the context deadline.
+// up to the context deadline. Requests not yet dispatched are refused with 503.
+// Then it stops the tasks started with Go, ends the registry's watch
+// subscriptions and waits, again up to the deadline, for the tasks to return.
 func (g *Gateway) Shutdown(ctx context.Context) error {
-	if g.server == nil {
-		return nil
+	g.shuttingDown.Store(true)
+	var err error
+	if g.server != nil {
+		err = g.server.Shutdown(ctx)
+	}
+	g.stopBackground()
+	if store, ok := g.registry.(interface{ CloseWatches() }); ok {
+		store.CloseWatches()
 	}
-	return g.server.Shutdown(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		g.tasks.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
 }
 
 func (g *Gateway) handleRequest(w http.ResponseWriter, r *http.Request) {
-	serviceName := g.route(r)
-	if serviceName == "" {
+	if g.serveRoot(w, r) {
+		return
+	}
+	route := g.resolve(r)
+	if route.Deny {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if route.Service == "" {
 		http.NotFound(w, r)
 		return
 	}
+	entry := entryFromContext(r.Context())
+	if entry != nil {
+		entry.Service = route.Service
+	}
+	if g.tracer != nil {
+		ctx, span := g.tracer.Start(g.tracer.Extract(r.Context(), r.Header), "gateway "+route.Service, SpanKindServer)
+		r = r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			span.SetStatus(rec.status())
+			span.End()
+		}()
+		w = rec
+	}
+	var instance string // set once an instance has answered
+	var fwdErr error    // set if forwarding failed
+	if g.metrics != nil || g.logger != nil {
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			if g.metrics != nil {
+				g.metrics.Observe(route.Service, rec.status(), elapsed)
+			}
+			if g.logger != nil {
+				g.logRequest(r, route.Service, instance, rec, elapsed, fwdErr)
+			}
+		}()
+		w = rec
+	}
+	if g.shuttingDown.Load() {
+		g.refuseShuttingDown(w)
+		return
+	}
+
+	if limit := g.limits[route.Service]; limit != nil {
+		// Concurrency first, so a request turned away for it does not
+		// spend a token of the rate.
+		if !limit.acquire() {
+			setAdvice(w.Header(), "concurrency-limit", g.retryAfter)
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer limit.release()
+		if ok, wait := limit.allowRate(); !ok {
+			setAdvice(w.Header(), "rate-limited", wait)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if g.admission != nil {
+		if ok, wait := g.admission.Admit(route.Service); !ok {
+			setAdvice(w.Header(), "overloaded", wait)
+			http.Error(w, "service overloaded", http.StatusServiceUnavailable)
+			return
+		}
+	}
 
-	resp, err := g.dispatcher.Forward(serviceName, r)
+	if g.maxRequestBody > 0 {
+		if r.ContentLength > g.maxRequestBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, g.maxRequestBody)
+		}
+	}
+
+	fwd := r
+	var forwardSpan Span
+	if g.tracer != nil {
+		fwd, forwardSpan = g.startForwardSpan(r, route.Service)
+		defer forwardSpan.End()
+	}
+	fwd, stopRelay := relayInformational(w, fwd)
+	resp, err := g.dispatcher.ForwardRoute(route, fwd)
+	stopRelay()
+	if forwardSpan != nil {
+		if err != nil {
+			forwardSpan.RecordError(err)
+		} else {
+			forwardSpan.SetStatus(resp.StatusCode)
+		}
+	}
+	if g.admission != nil && err == nil && resp.Header.Get(dispatcher.ReasonHeader) == "" {
+		g.admission.Observe(route.Service, resp.StatusCode)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		status, reason, retryAfter := g.classify(err)
+		if g.errorLog != nil {
+			g.errorLog.log(route.Service, reason, err)
+		}
+		fwdErr = err
+		setAdvice(w.Header(), reason, retryAfter)
+		g.writeError(w, r, status)
 		return
 	}
 	defer resp.Body.Close()
+	instance = dispatcher.InstanceOf(resp)
+	if entry != nil && resp.Header.Get(dispatcher.ReasonHeader) == "" {
+		entry.UpstreamStatus = resp.StatusCode
+	}
+	if reason := resp.Header.Get(dispatcher.ReasonHeader); reason != "" && instance == "" {
+		// The dispatcher found no instance to send the request to.
+		if resp.StatusCode == http.StatusNotFound {
+			// Retrying will not make an unknown service appear.
+			w.Header().Set(dispatcher.ReasonHeader, reason)
+		} else {
+			setAdvice(w.Header(), reason, g.retryAfter)
+		}
+		g.writeErrorMessage(w, r, resp.StatusCode, unavailableMessage(reason))
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		g.serveUpgrade(w, resp)
+		return
+	}
+	gunzipResponse(r, resp)
 
 	// Copy response headers
+	hopbyhop.Remove(resp.Header)
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
+	if w.Header().Get(dispatcher.ReasonHeader) != "" && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", retryAfterSeconds(g.retryAfter))
+	}
+	g.responseHeaders.apply(w.Header())
+	var body io.Reader = resp.Body
+	if g.maxResponseBody > 0 {
+		body = io.LimitReader(resp.Body, g.maxResponseBody)
+		if resp.ContentLength < 0 || resp.ContentLength > g.maxResponseBody {
+			// The body may be cut off, so its declared length cannot be
+			// promised to the client.
+			w.Header().Del("Content-Length")
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	var out io.Writer = w
+	if streaming(resp) {
+		out = streamWriter(w, resp)
+	}
+	io.Copy(out, body)
+}
+
+// errorBody is the JSON body of responses to failed forwards.
+type errorBody struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError answers a request that could not be forwarded with status and
+// a generic errorBody.
+func (g *Gateway) writeError(w http.ResponseWriter, r *http.Request, status int) {
+	msg := g.errorMessage
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	g.writeErrorMessage(w, r, status, msg)
+}
+
+// writeErrorMessage answers a request with status and an errorBody holding
+// msg.
+func (g *Gateway) writeErrorMessage(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: msg, RequestID: RequestIDFromContext(r.Context())})
+}
+
+// unavailableMessage explains in a response body why the dispatcher had no
+// instance for a request, telling a service that is only temporarily
+// unavailable apart from an unknown one or one without instances.
+func unavailableMessage(reason string) string {
+	switch reason {
+	case "unknown-service":
+		return "unknown service"
+	case "no-instances":
+		return "service unavailable: no instances are registered"
+	case "draining":
+		return "service temporarily unavailable: all instances are draining"
+	case "unhealthy":
+		return "service temporarily unavailable: all instances are unhealthy"
+	case "at-capacity":
+		return "service temporarily unavailable: all instances are at capacity"
+	default:
+		return "service temporarily unavailable"
+	}
+}
+
+// refuseShuttingDown tells the client to retry elsewhere rather than
+// returning a generic 502 while the gateway drains.
+func (g *Gateway) refuseShuttingDown(w http.ResponseWriter) {
+	setAdvice(w.Header(), "shutting-down", g.shutdownRetryAfter)
+	w.Header().Set("Connection", "close")
+	http.Error(w, "gateway shutting down", http.StatusServiceUnavailable)
+}
+
+// classify maps a dispatch error to the status, reason and back-off
+// advertised to the client: 503 for an open breaker, 504 for a timeout and
+// 502 for anything else.
+func (g *Gateway) classify(err error) (status int, reason string, retryAfter time.Duration) {
+	var openErr *circuitbreaker.OpenError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &openErr):
+		return http.StatusServiceUnavailable, "circuit-open", openErr.RetryAfter
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "timeout", g.retryAfter
+	case errors.Is(err, circuitbreaker.ErrRetriesExhausted):
+		return http.StatusBadGateway, "retries-exhausted", g.retryAfter
+	default:
+		return http.StatusBadGateway, "upstream-error", g.retryAfter
+	}
+}
+
+// setAdvice sets the advisory headers telling clients why the gateway
+// answered and when to try again.
+func setAdvice(h http.Header, reason string, retryAfter time.Duration) {
+	h.Set(dispatcher.ReasonHeader, reason)
+	h.Set("Retry-After", retryAfterSeconds(retryAfter))
+}
+
+// retryAfterSeconds formats d for Retry-After, rounding up to whole seconds,
+// and at least 1.
+func retryAfterSeconds(d time.Duration) string {
+	secs := d / time.Second
+	if d%time.Second != 0 {
+		secs++
+	}
+	return strconv.FormatInt(max(int64(secs), 1), 10)
 }
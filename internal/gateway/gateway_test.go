@@ -4,19 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"kerberos/internal/admission"
 	"kerberos/internal/balancer"
 	"kerberos/internal/circuitbreaker"
 	"kerberos/internal/dispatcher"
+	"kerberos/internal/latency"
 	"kerberos/internal/registry"
+	"kerberos/internal/retry"
+
+	"github.com/sony/gobreaker"
 )
 
 func gwWithRegistry(t *testing.T) (*Gateway, *registry.Registry, *httptest.Server) {
@@ -248,6 +258,89 @@ func TestGateway_DELETE_Register(t *testing.T) {
 	}
 }
 
+func TestGateway_DELETE_Register_Drain(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "old")
+	}))
+	defer old.Close()
+	replacement := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	defer replacement.Close()
+
+	gw, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+	gw.drainGrace = 5 * time.Second
+	r.Register("echo", registry.Instance{ID: "old", Addr: old.URL})
+
+	inFlight := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/echo/slow")
+		if err != nil {
+			t.Errorf("slow Get: %v", err)
+			close(inFlight)
+			return
+		}
+		inFlight <- resp
+	}()
+	<-started
+	r.Register("echo", registry.Instance{ID: "new", Addr: replacement.URL})
+
+	jsonBody, _ := json.Marshal(unregisterRequest{Service: "echo", ID: "old"})
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/register?drain=true", bytes.NewReader(jsonBody))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(srv.URL + "/echo/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "new" {
+			t.Errorf("request %d: expected the draining instance to get no new requests, got %q", i, body)
+		}
+	}
+	if len(r.GetInstances("echo")) != 2 {
+		t.Error("expected the draining instance to stay registered while a request is in flight")
+	}
+
+	close(release)
+	slow, ok := <-inFlight
+	if !ok {
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(slow.Body)
+	slow.Body.Close()
+	if slow.StatusCode != http.StatusOK || string(body) != "old" {
+		t.Errorf("expected the in-flight request to complete, got %d %q", slow.StatusCode, body)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.GetInstances("echo")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the drained instance to be unregistered once idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := r.GetInstances("echo")[0].ID; got != "new" {
+		t.Errorf("expected only the new instance to remain, got %q", got)
+	}
+}
+
 func TestGateway_GET_Services(t *testing.T) {
 	_, r, srv := gwWithRegistry(t)
 	defer srv.Close()
@@ -273,6 +366,119 @@ func TestGateway_GET_Services(t *testing.T) {
 	}
 }
 
+func TestGateway_GET_Services_Detail(t *testing.T) {
+	r := registry.New()
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Registry:   r,
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "" },
+		Breakers:   cb,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	r.Register("echo", registry.Instance{ID: "1", Addr: "http://a", Weight: 2})
+	r.Register("echo", registry.Instance{ID: "2", Addr: "http://b"})
+	r.Register("users", registry.Instance{ID: "1", Addr: "http://c"})
+	r.SetHealthyAddr("http://b", false)
+
+	resp, err := http.Get(srv.URL + "/services?detail=true")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var services []struct {
+		Name      string `json:"name"`
+		Instances []struct {
+			ID      string `json:"id"`
+			Addr    string `json:"addr"`
+			Weight  int    `json:"weight"`
+			Healthy bool   `json:"healthy"`
+			Breaker string `json:"breaker"`
+		} `json:"instances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(services) != 2 || services[0].Name != "echo" || len(services[0].Instances) != 2 {
+		t.Fatalf("expected echo with 2 instances and users, got %+v", services)
+	}
+	a, b := services[0].Instances[0], services[0].Instances[1]
+	if a.ID != "1" || a.Addr != "http://a" || a.Weight != 2 || !a.Healthy || a.Breaker != "closed" {
+		t.Errorf("unexpected details for inst 1: %+v", a)
+	}
+	if b.ID != "2" || b.Healthy {
+		t.Errorf("expected inst 2 to be reported unhealthy, got %+v", b)
+	}
+}
+
+func TestGateway_GET_Services_DetailFilters(t *testing.T) {
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	r.Register("echo", registry.Instance{ID: "1", Addr: "http://a", Tags: map[string]string{"region": "eu"}})
+	r.Register("echo", registry.Instance{ID: "2", Addr: "http://b", Tags: map[string]string{"region": "us"}})
+	r.Register("echo", registry.Instance{ID: "3", Addr: "http://c", Tags: map[string]string{"region": "eu"}})
+	r.Register("users", registry.Instance{ID: "1", Addr: "http://d", Tags: map[string]string{"region": "eu", "tier": "gold"}})
+	r.SetHealthyAddr("http://b", false)
+	r.Drain("echo", "3")
+
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{"", "echo/1 echo/2 echo/3 users/1"},
+		{"&healthy=true", "echo/1 echo/3 users/1"},
+		{"&healthy=false", "echo/2"},
+		{"&draining=true", "echo/3"},
+		{"&draining=false", "echo/1 echo/2 users/1"},
+		{"&tag=region:eu", "echo/1 echo/3 users/1"},
+		{"&tag=region:eu&tag=tier:gold", "users/1"},
+		{"&healthy=true&draining=false&tag=region:eu", "echo/1 users/1"},
+		{"&healthy=false&tag=region:eu", ""},
+	} {
+		resp, err := http.Get(srv.URL + "/services?detail=true" + tt.query)
+		if err != nil {
+			t.Fatalf("%q: Get: %v", tt.query, err)
+		}
+		var services []struct {
+			Name      string `json:"name"`
+			Instances []struct {
+				ID string `json:"id"`
+			} `json:"instances"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&services)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%q: Decode: %v", tt.query, err)
+		}
+		var got []string
+		for _, s := range services {
+			for _, inst := range s.Instances {
+				got = append(got, s.Name+"/"+inst.ID)
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+
+	for _, query := range []string{"&healthy=maybe", "&draining=1x", "&tag=region"} {
+		resp, err := http.Get(srv.URL + "/services?detail=true" + query)
+		if err != nil {
+			t.Fatalf("%q: Get: %v", query, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
 func TestGateway_Register_InvalidJSON(t *testing.T) {
 	_, _, srv := gwWithRegistry(t)
 	defer srv.Close()
@@ -305,6 +511,42 @@ func TestGateway_Register_MissingFields(t *testing.T) {
 	}
 }
 
+func TestGateway_Register_ValidatesAddr(t *testing.T) {
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	register := func(addr string) (int, string) {
+		jsonBody, _ := json.Marshal(registerRequest{Service: "echo", ID: "inst-1", Addr: addr})
+		resp, err := http.Post(srv.URL+"/register", "application/json", bytes.NewReader(jsonBody))
+		if err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(msg)
+	}
+
+	for _, tt := range []struct{ addr, want string }{
+		{"ftp://localhost:8081", "unsupported scheme"},
+		{"http:///echo", "no host"},
+	} {
+		code, msg := register(tt.addr)
+		if code != http.StatusBadRequest || !strings.Contains(msg, tt.want) {
+			t.Errorf("%s: expected 400 mentioning %q, got %d %q", tt.addr, tt.want, code, msg)
+		}
+	}
+	if len(r.ListServices()) != 0 {
+		t.Fatal("invalid addresses must not be registered")
+	}
+
+	if code, msg := register("http://localhost:8081/"); code != http.StatusNoContent {
+		t.Fatalf("expected a valid address to be accepted, got %d %q", code, msg)
+	}
+	if got := r.GetInstances("echo")[0].Addr; got != "http://localhost:8081" {
+		t.Errorf("expected the trailing slash to be trimmed, got %q", got)
+	}
+}
+
 func TestGateway_GracefulShutdown(t *testing.T) {
 	// Backend that delays response
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -376,3 +618,1006 @@ func TestGateway_GracefulShutdown(t *testing.T) {
 		t.Errorf("expected 200, got %d", statusCode)
 	}
 }
+
+func TestGateway_RefusesWithRetryAfterDuringShutdown(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("backend should not be called during shutdown")
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(b, cb),
+		Route: func(req *http.Request) string {
+			return "echo"
+		},
+		ShutdownRetryAfter: 7 * time.Second,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	if err := gw.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	resp, err := http.Get(srv.URL + "/echo/")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "7" {
+		t.Errorf("expected Retry-After 7, got %q", got)
+	}
+	if !resp.Close {
+		t.Error("expected Connection: close")
+	}
+}
+
+func TestGateway_Resolve_DenyReturns403(t *testing.T) {
+	r := registry.New()
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(b, cb),
+		Resolve: func(req *http.Request) dispatcher.RouteResult {
+			return dispatcher.RouteResult{Service: "echo", Deny: strings.HasPrefix(req.URL.Path, "/echo/admin")}
+		},
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/echo/admin")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_Register_GlobalIDConflictReturns409(t *testing.T) {
+	r := registry.New(registry.WithGlobalIDs())
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: "http://a"})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{Registry: r, Dispatcher: dispatcher.New(b, cb)})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	jsonBody, _ := json.Marshal(registerRequest{Service: "users", ID: "inst-1", Addr: "http://b"})
+	resp, err := http.Post(srv.URL+"/register", "application/json", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_AdvisoryHeaders(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	r := registry.New()
+	r.Register("slow", registry.Instance{ID: "1", Addr: slow.URL})
+	r.Register("down", registry.Instance{ID: "1", Addr: down.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.Retry = retry.Config{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	cb := circuitbreaker.New(&http.Client{Timeout: 50 * time.Millisecond}, cbSettings)
+	gw := New(Config{
+		Dispatcher: dispatcher.New(b, cb),
+		Route: func(req *http.Request) string {
+			return strings.TrimPrefix(req.URL.Path, "/")
+		},
+		RetryAfter: 2 * time.Second,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantReason string
+	}{
+		{"/slow", http.StatusGatewayTimeout, "timeout"},
+		{"/down", http.StatusBadGateway, "retries-exhausted"},
+		{"/empty", http.StatusServiceUnavailable, "no-instances"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatalf("%s: Get: %v", tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.wantStatus, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Gateway-Reason"); got != tt.wantReason {
+			t.Errorf("%s: expected reason %q, got %q", tt.path, tt.wantReason, got)
+		}
+		if got := resp.Header.Get("Retry-After"); got != "2" {
+			t.Errorf("%s: expected Retry-After 2, got %q", tt.path, got)
+		}
+	}
+}
+
+func TestGateway_NoInstances_ExplainsReason(t *testing.T) {
+	r := registry.New()
+	r.Register("draining", registry.Instance{ID: "1", Addr: "http://a"})
+	r.Drain("draining", "1")
+	r.Register("unhealthy", registry.Instance{ID: "1", Addr: "http://b"})
+	r.SetHealthyAddr("http://b", false)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route: func(req *http.Request) string {
+			return strings.TrimPrefix(req.URL.Path, "/")
+		},
+		RetryAfter: 5 * time.Second,
+	})
+
+	tests := []struct {
+		path, wantReason, wantError string
+	}{
+		{"/unknown", "no-instances", "service unavailable: no instances"},
+		{"/draining", "draining", "service temporarily unavailable"},
+		{"/unhealthy", "unhealthy", "service temporarily unavailable"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503, got %d", tt.path, rec.Code)
+		}
+		if got := rec.Header().Get(dispatcher.ReasonHeader); got != tt.wantReason {
+			t.Errorf("%s: expected reason %q, got %q", tt.path, tt.wantReason, got)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "5" {
+			t.Errorf("%s: expected Retry-After 5, got %q", tt.path, got)
+		}
+		var body errorBody
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: Decode: %v", tt.path, err)
+		}
+		if !strings.HasPrefix(body.Error, tt.wantError) {
+			t.Errorf("%s: expected an error starting %q, got %q", tt.path, tt.wantError, body.Error)
+		}
+	}
+}
+
+func TestGateway_UnknownService_NotFound(t *testing.T) {
+	r := registry.New()
+	r.Register("emptied", registry.Instance{ID: "1", Addr: "http://a"})
+	r.Unregister("emptied", "1")
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb, dispatcher.WithUnknownServices(r)),
+		Route: func(req *http.Request) string {
+			return strings.TrimPrefix(req.URL.Path, "/")
+		},
+		RetryAfter: 5 * time.Second,
+	})
+
+	tests := []struct {
+		path, wantReason, wantRetryAfter string
+		wantStatus                       int
+	}{
+		{"/never-registered", "unknown-service", "", http.StatusNotFound},
+		{"/emptied", "no-instances", "5", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.wantStatus, rec.Code)
+		}
+		if got := rec.Header().Get(dispatcher.ReasonHeader); got != tt.wantReason {
+			t.Errorf("%s: expected reason %q, got %q", tt.path, tt.wantReason, got)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+			t.Errorf("%s: expected Retry-After %q, got %q", tt.path, tt.wantRetryAfter, got)
+		}
+	}
+}
+
+func TestGateway_Classify_BreakerOpenUsesBreakerTimeout(t *testing.T) {
+	gw := New(Config{})
+	err := fmt.Errorf("forward: %w", &circuitbreaker.OpenError{
+		Target:     "http://a",
+		RetryAfter: 30 * time.Second,
+		Err:        errors.New("circuit breaker is open"),
+	})
+
+	status, reason, retryAfter := gw.classify(err)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", status)
+	}
+	if reason != "circuit-open" {
+		t.Errorf("expected reason circuit-open, got %q", reason)
+	}
+	if !errors.Is(err, circuitbreaker.ErrOpen) {
+		t.Error("expected the error to match ErrOpen")
+	}
+	if retryAfter != 30*time.Second {
+		t.Errorf("expected Retry-After of the breaker timeout, got %v", retryAfter)
+	}
+}
+
+func TestGateway_OpenBreakerReturns503(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+
+	r := registry.New()
+	r.Register("down", registry.Instance{ID: "1", Addr: backend.URL})
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.ReadyToTrip = func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 1 }
+	cb := circuitbreaker.New(http.DefaultClient, cbSettings)
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "down" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	want := []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	for i, status := range want {
+		resp, err := http.Get(srv.URL + "/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("request %d: expected %d, got %d", i, status, resp.StatusCode)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1"},
+		{-time.Second, "1"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Duration(math.MaxInt64), strconv.FormatInt(int64(math.MaxInt64/time.Second)+1, 10)},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.d); got != tt.want {
+			t.Errorf("retryAfterSeconds(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestGateway_Admission_ThrottlesOverloadedService(t *testing.T) {
+	var calls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	now := time.Unix(0, 0)
+	gw := New(Config{
+		Dispatcher: dispatcher.New(b, cb),
+		Route: func(req *http.Request) string {
+			return "echo"
+		},
+		Admission: admission.New(admission.Config{MaxRate: 4, MinRate: 1, Increase: 1, Decrease: 0.5, Now: func() time.Time { return now }}),
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	overloaded := 0
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(srv.URL + "/echo/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Gateway-Reason") == "overloaded" {
+			overloaded++
+		}
+	}
+	if overloaded == 0 {
+		t.Error("expected sustained upstream 503s to throttle admission")
+	}
+	if calls+overloaded != 10 {
+		t.Errorf("expected throttled requests not to reach the backend: %d calls, %d throttled", calls, overloaded)
+	}
+}
+
+func TestGateway_GET_Latency(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	tracker := latency.NewTracker()
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb, dispatcher.WithLatency(tracker)),
+		Route: func(req *http.Request) string {
+			return "echo"
+		},
+		Latency: tracker,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL + "/echo/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/latency")
+	if err != nil {
+		t.Fatalf("Get /latency: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var got map[string]latency.Summary
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if s := got["echo"]; s.Count != 3 || s.InFlight != 0 || s.P99 < s.P50 {
+		t.Errorf("unexpected summary for echo: %+v", s)
+	}
+}
+
+func TestGateway_POST_RegistryDiff(t *testing.T) {
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	r.Register("echo", registry.Instance{ID: "1", Addr: "http://a", Weight: 1})
+	r.Register("echo", registry.Instance{ID: "2", Addr: "http://b"})
+
+	body := `{"echo":[{"id":"1","addr":"http://a","weight":3},{"id":"3","addr":"http://c"},{"id":"4","addr":""}]}`
+	resp, err := http.Post(srv.URL+"/registry/diff", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var d registry.Diff
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(d.Added) != 1 || len(d.Removed) != 1 || len(d.Changed) != 1 || len(d.Errors) != 1 {
+		t.Errorf("unexpected diff: %+v", d)
+	}
+	if len(r.GetInstances("echo")) != 2 || r.GetInstances("echo")[0].Weight != 1 {
+		t.Error("diff must not be applied to the registry")
+	}
+}
+
+func TestGateway_StripsHopByHopHeaders(t *testing.T) {
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Header().Set("Connection", "X-Custom")
+		w.Header().Set("X-Custom", "per-connection")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End-To-End", "kept")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/echo/", nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic abc")
+	req.Header.Set("X-Request-Id", "42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Get("X-Custom"); got != "" {
+		t.Errorf("expected X-Custom, named in Connection, to be dropped, got %q", got)
+	}
+	if got := resp.Header.Get("Keep-Alive"); got != "" {
+		t.Errorf("expected Keep-Alive to be dropped, got %q", got)
+	}
+	if got := resp.Header.Get("X-End-To-End"); got != "kept" {
+		t.Errorf("expected end-to-end headers to be kept, got %q", got)
+	}
+	for _, name := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+		if got := upstream.Get(name); got != "" {
+			t.Errorf("expected %s not to be forwarded upstream, got %q", name, got)
+		}
+	}
+	if upstream.Get("X-Request-Id") != "42" {
+		t.Error("expected end-to-end request headers to be forwarded")
+	}
+}
+
+func TestGateway_GET_Metrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route: func(req *http.Request) string {
+			if strings.HasPrefix(req.URL.Path, "/echo") {
+				return "echo"
+			}
+			return ""
+		},
+		MetricsEnabled: true,
+		Breakers:       cb,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	for _, path := range []string{"/echo/a", "/echo/b", "/echo/missing"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`kerberos_requests_total{service="echo"} 3`,
+		`kerberos_responses_total{service="echo",code="200"} 2`,
+		`kerberos_responses_total{service="echo",code="404"} 1`,
+		`kerberos_request_duration_seconds_count{service="echo"} 3`,
+		fmt.Sprintf(`kerberos_breaker_state{target=%q} 0`, backend.URL),
+		fmt.Sprintf(`kerberos_breaker_requests_total{target=%q} 3`, backend.URL),
+		fmt.Sprintf(`kerberos_breaker_successes_total{target=%q} 3`, backend.URL),
+		fmt.Sprintf(`kerberos_breaker_failures_total{target=%q} 0`, backend.URL),
+		fmt.Sprintf(`kerberos_breaker_consecutive_failures{target=%q} 0`, backend.URL),
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestGateway_MaxRequestBodyBytes(t *testing.T) {
+	hits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher:          dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:               func(*http.Request) string { return "echo" },
+		MaxRequestBodyBytes: 16,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{"known length", strings.NewReader(strings.Repeat("x", 17))},
+		{"chunked", io.MultiReader(strings.NewReader(strings.Repeat("x", 17)))},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(srv.URL+"/echo", "text/plain", tt.body)
+		if err != nil {
+			t.Fatalf("%s: Post: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected 413, got %d", tt.name, resp.StatusCode)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("expected oversized bodies not to be forwarded, backend saw %d", hits)
+	}
+
+	resp, err := http.Post(srv.URL+"/echo", "text/plain", strings.NewReader("small"))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected a body within the limit to pass, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_MaxResponseBodyBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher:           dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:                func(*http.Request) string { return "echo" },
+		MaxResponseBodyBytes: 10,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/echo")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("expected a well-formed cut off response, got %v", err)
+	}
+	if len(body) != 10 {
+		t.Errorf("expected the response to be cut off after 10 bytes, got %d", len(body))
+	}
+}
+
+func TestGateway_Middleware(t *testing.T) {
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, fmt.Sprint(r.Header.Values("X-Chain")))
+	}))
+	defer backend.Close()
+
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Add("X-Chain", name)
+				w.Header().Add("X-Chain", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Registry:   r,
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route: func(req *http.Request) string {
+			if strings.HasPrefix(req.URL.Path, "/echo") {
+				return "echo"
+			}
+			return ""
+		},
+		Middleware: []func(http.Handler) http.Handler{mark("outer"), mark("inner")},
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	for _, path := range []string{"/echo/", "/services"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: Get: %v", path, err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Values("X-Chain"); fmt.Sprint(got) != "[outer inner]" {
+			t.Errorf("%s: expected both middleware outermost-first, got %v", path, got)
+		}
+	}
+	if len(seen) != 1 || seen[0] != "[outer inner]" {
+		t.Errorf("expected the backend to see the injected headers, got %q", seen)
+	}
+}
+
+func TestGateway_GET_Breakers(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	const dead = "http://127.0.0.1:1"
+
+	r := registry.New()
+	r.Register("up", registry.Instance{ID: "1", Addr: healthy.URL})
+	r.Register("down", registry.Instance{ID: "1", Addr: dead})
+	cbSettings := circuitbreaker.DefaultSettings()
+	cbSettings.ReadyToTrip = func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 1 }
+	cb := circuitbreaker.New(http.DefaultClient, cbSettings)
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(req *http.Request) string { return strings.TrimPrefix(req.URL.Path, "/") },
+		Breakers:   cb,
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	for _, path := range []string{"/up", "/up", "/down", "/down"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: Get: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/breakers")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats map[string]circuitbreaker.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	// The second request to the dead target is rejected by its open breaker,
+	// which counts as a failure too.
+	want := circuitbreaker.Stats{Requests: 2, Failures: 2, ConsecutiveFailures: 2, State: "open"}
+	if got := stats[dead]; got.Requests != want.Requests || got.Successes != want.Successes || got.Failures != want.Failures || got.ConsecutiveFailures != want.ConsecutiveFailures || got.State != want.State {
+		t.Errorf("expected the failing target's stats to be %+v, got %+v", want, got)
+	}
+	want = circuitbreaker.Stats{Requests: 2, Successes: 2, State: "closed"}
+	if got := stats[healthy.URL]; got.Requests != want.Requests || got.Successes != want.Successes || got.Failures != want.Failures || got.ConsecutiveFailures != want.ConsecutiveFailures || got.State != want.State {
+		t.Errorf("expected the healthy target's stats to be %+v, got %+v", want, got)
+	}
+}
+
+func TestGateway_POST_RegisterBatch(t *testing.T) {
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	post := func(body string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/register/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		return resp
+	}
+
+	resp := post(`[{"service":"echo","id":"inst-1","addr":"http://localhost:8081"},{"service":"echo","id":"inst-2"}]`)
+	var result struct {
+		Errors []struct {
+			Index int    `json:"index"`
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("mixed batch: expected 400, got %d", resp.StatusCode)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Index != 1 {
+		t.Errorf("mixed batch: expected an error for item 1 only, got %+v", result.Errors)
+	}
+	if r.GetInstances("echo") != nil {
+		t.Error("mixed batch: expected nothing to be registered")
+	}
+
+	resp = post(`[{"service":"echo","id":"inst-1","addr":"http://localhost:8081"},{"service":"echo","id":"inst-2","addr":"http://localhost:8082","weight":2}]`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("valid batch: expected 204, got %d", resp.StatusCode)
+	}
+	if len(r.GetInstances("echo")) != 2 {
+		t.Errorf("valid batch: expected 2 instances, got %v", r.GetInstances("echo"))
+	}
+}
+
+func TestGateway_POST_RegisterHeartbeat(t *testing.T) {
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	post := func(path, body string) int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := post("/register", `{"service":"echo","id":"inst-1","addr":"http://localhost:8081","ttl":-1}`); got != http.StatusBadRequest {
+		t.Errorf("negative ttl: expected 400, got %d", got)
+	}
+	if got := post("/register", `{"service":"echo","id":"inst-1","addr":"http://localhost:8081","ttl":30}`); got != http.StatusNoContent {
+		t.Fatalf("register: expected 204, got %d", got)
+	}
+	if len(r.GetInstances("echo")) != 1 {
+		t.Fatal("expected the instance to be registered")
+	}
+	if got := post("/register/heartbeat", `{"service":"echo","id":"inst-1"}`); got != http.StatusNoContent {
+		t.Errorf("heartbeat: expected 204, got %d", got)
+	}
+	if got := post("/register/heartbeat", `{"service":"echo","id":"unknown"}`); got != http.StatusNotFound {
+		t.Errorf("heartbeat for unknown instance: expected 404, got %d", got)
+	}
+}
+
+func TestGateway_ShutdownStopsBackgroundTasks(t *testing.T) {
+	gw, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	checkerDone := make(chan struct{})
+	gw.Go(func(ctx context.Context) {
+		// A health checker probing until the gateway shuts down.
+		defer close(checkerDone)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	reaperDone := make(chan struct{})
+	gw.Go(func(ctx context.Context) {
+		defer close(reaperDone)
+		r.RunReaper(ctx, time.Millisecond)
+	})
+	events, _ := r.Watch()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := gw.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for name, done := range map[string]chan struct{}{"health checker": checkerDone, "reaper": reaperDone} {
+		select {
+		case <-done:
+		default:
+			t.Errorf("expected the %s to have stopped when Shutdown returned", name)
+		}
+	}
+	if _, ok := <-events; ok {
+		t.Error("expected the watch channel to be closed")
+	}
+}
+
+func TestGateway_PATCH_Register_ShiftsWeightedTraffic(t *testing.T) {
+	counts := make(map[string]int)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[name]++
+		}))
+	}
+	stable := newBackend("stable")
+	defer stable.Close()
+	canary := newBackend("canary")
+	defer canary.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "stable", Addr: stable.URL, Weight: 3})
+	r.Register("echo", registry.Instance{ID: "canary", Addr: canary.URL, Weight: 1})
+	b := balancer.New(balancer.WeightedRoundRobin, r)
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Registry:   r,
+		Dispatcher: dispatcher.New(b, cb),
+		Route:      func(*http.Request) string { return "echo" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	patch := func(body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/register", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PATCH: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	forward := func(n int) {
+		t.Helper()
+		for k := range counts {
+			delete(counts, k)
+		}
+		for i := 0; i < n; i++ {
+			resp, err := http.Get(srv.URL + "/echo")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	forward(40)
+	if counts["stable"] != 30 || counts["canary"] != 10 {
+		t.Fatalf("expected a 3:1 split, got %v", counts)
+	}
+	if got := patch(`{"service":"echo","id":"canary","weight":3}`); got != http.StatusNoContent {
+		t.Fatalf("PATCH: expected 204, got %d", got)
+	}
+	forward(40)
+	if counts["stable"] != 20 || counts["canary"] != 20 {
+		t.Errorf("expected an even split after ramping the canary up, got %v", counts)
+	}
+
+	if got := patch(`{"service":"echo","id":"nonexistent","weight":2}`); got != http.StatusNotFound {
+		t.Errorf("unknown instance: expected 404, got %d", got)
+	}
+	if got := patch(`{"service":"echo","id":"canary"}`); got != http.StatusBadRequest {
+		t.Errorf("missing weight: expected 400, got %d", got)
+	}
+	if got := patch(`{"service":"echo","id":"canary","weight":-1}`); got != http.StatusBadRequest {
+		t.Errorf("negative weight: expected 400, got %d", got)
+	}
+}
+
+func TestGateway_DELETE_RegisterAll(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	r.Register("echo", registry.Instance{ID: "inst-2", Addr: backend.URL})
+	r.Register("other", registry.Instance{ID: "inst-1", Addr: backend.URL})
+
+	clearService := func(body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/register/all", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := clearService(`{"service":"echo"}`); got != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", got)
+	}
+	if r.GetInstances("echo") != nil || len(r.GetInstances("other")) != 1 {
+		t.Error("expected only the cleared service to lose its instances")
+	}
+	resp, err := http.Get(srv.URL + "/echo/")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after clearing the service, got %d", resp.StatusCode)
+	}
+
+	if got := clearService(`{"service":"echo"}`); got != http.StatusNoContent {
+		t.Errorf("service without instances: expected 204, got %d", got)
+	}
+	if got := clearService(`{}`); got != http.StatusBadRequest {
+		t.Errorf("missing service: expected 400, got %d", got)
+	}
+}
+
+func TestGateway_UnixSocketBackend(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "echo.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("UNIX sockets unavailable: %v", err)
+	}
+	var gotHost, gotPath string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotPath = r.Host, r.URL.RequestURI()
+		w.Write([]byte("over the socket"))
+	}))
+	backend.Listener = ln
+	backend.Start()
+	defer backend.Close()
+
+	r := registry.New()
+	if err := r.RegisterValidated("echo", registry.Instance{ID: "1", Addr: "unix://" + socket}); err != nil {
+		t.Fatalf("RegisterValidated: %v", err)
+	}
+	cb := circuitbreaker.New(&http.Client{}, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+	})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo/foo?x=1", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "over the socket" {
+		t.Fatalf("expected the backend's response, got %d %q", rec.Code, rec.Body.String())
+	}
+	if gotPath != "/echo/foo?x=1" || gotHost != "localhost" {
+		t.Errorf("expected /echo/foo?x=1 for host localhost, got %q for %q", gotPath, gotHost)
+	}
+}
+
+func TestGateway_ClientDisconnect_AbortsBackendCall(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("slow", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.Settings{
+		ReadyToTrip: func(gobreaker.Counts) bool { return false },
+		Retry:       retry.Config{MaxRetries: 2},
+	})
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "slow" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/slow", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		done <- err
+	}()
+
+	<-arrived
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the client request to be canceled, got %v", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the backend call to be aborted when the client went away")
+	}
+	select {
+	case <-arrived:
+		t.Error("expected no retry after the client went away")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,31 @@
+package gateway
+
+import "net/http"
+
+// HeaderRules edits the headers of proxied responses, e.g. to add security
+// headers and strip ones that reveal the backend's software. Remove is
+// applied first, then Set, then Add, so a header that is removed and also
+// set or added keeps the configured values.
+type HeaderRules struct {
+	Remove []string    // e.g. "Server", "X-Powered-By"
+	Set    http.Header // Replace the backend's values, e.g. Strict-Transport-Security
+	Add    http.Header // Appended to the backend's values
+}
+
+// apply edits h according to the rules.
+func (rules HeaderRules) apply(h http.Header) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, values := range rules.Set {
+		h.Del(name)
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+	for name, values := range rules.Add {
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+}
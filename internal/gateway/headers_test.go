@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_ResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.18.0")
+		w.Header().Set("X-Powered-By", "PHP/7.4")
+		w.Header().Set("Strict-Transport-Security", "max-age=0")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+		ResponseHeaders: HeaderRules{
+			Remove: []string{"server", "X-Powered-By", "Cache-Control"},
+			Set:    http.Header{"Strict-Transport-Security": {"max-age=63072000; includeSubDomains"}},
+			Add: http.Header{
+				"X-Content-Type-Options": {"nosniff"},
+				"Cache-Control":          {"no-store"},
+				"Vary":                   {"Accept-Encoding"},
+			},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+	h := rec.Header()
+	if h.Get("Server") != "" || h.Get("X-Powered-By") != "" {
+		t.Errorf("expected Server and X-Powered-By to be removed, got %q and %q", h.Get("Server"), h.Get("X-Powered-By"))
+	}
+	if got := h.Values("Strict-Transport-Security"); len(got) != 1 || got[0] != "max-age=63072000; includeSubDomains" {
+		t.Errorf("expected Strict-Transport-Security to be replaced, got %q", got)
+	}
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("expected X-Content-Type-Options to be added, got %q", got)
+	}
+	if got := h.Values("Cache-Control"); len(got) != 1 || got[0] != "no-store" {
+		t.Errorf("expected the added Cache-Control to win over its removal, got %q", got)
+	}
+	if got := h.Values("Vary"); len(got) != 2 {
+		t.Errorf("expected Vary to be appended to, got %q", got)
+	}
+}
@@ -0,0 +1,41 @@
+package gateway
+
+import "net/http"
+
+// handleHealth answers liveness probes: the process is up and serving.
+func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady answers readiness probes: 200 while at least one service has a
+// healthy instance to forward to, 503 otherwise and while shutting down.
+func (g *Gateway) handleReady(w http.ResponseWriter, r *http.Request) {
+	if g.shuttingDown.Load() || !g.hasHealthyInstance() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ready\n"))
+}
+
+// hasHealthyInstance reports whether any registered instance is neither
+// draining, marked unhealthy, nor, when Breakers is set, unavailable behind
+// its circuit breaker.
+func (g *Gateway) hasHealthyInstance() bool {
+	if g.registry == nil {
+		return false
+	}
+	for _, service := range g.registry.ListServices() {
+		for _, inst := range g.registry.GetInstances(service) {
+			if inst.Draining || inst.Unhealthy {
+				continue
+			}
+			if g.breakers != nil && g.breakers.Unavailable(inst.Addr) {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
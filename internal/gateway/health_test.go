@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kerberos/internal/registry"
+)
+
+func TestGateway_Health(t *testing.T) {
+	_, _, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_Ready(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	ready := func() int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/ready")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("empty registry: expected 503, got %d", got)
+	}
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("with an instance: expected 200, got %d", got)
+	}
+	r.Drain("echo", "inst-1")
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("only a draining instance: expected 503, got %d", got)
+	}
+}
+
+func TestGateway_Ready_UnhealthyInstance(t *testing.T) {
+	_, r, srv := gwWithRegistry(t)
+	defer srv.Close()
+
+	ready := func() int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/ready")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: "http://echo-1"})
+	r.SetHealthyAddr("http://echo-1", false)
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("only an unhealthy instance: expected 503, got %d", got)
+	}
+	r.SetHealthyAddr("http://echo-1", true)
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("once healthy again: expected 200, got %d", got)
+	}
+}
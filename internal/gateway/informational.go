@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+
+	"kerberos/internal/hopbyhop"
+)
+
+// relayInformational returns fwd with a client trace that relays the
+// informational (1xx) responses the backend sends ahead of its final one,
+// such as 103 Early Hints, to the client. The returned stop function must be
+// called once the request has been forwarded: a late 1xx must not reach w
+// after the gateway has started on the final response.
+//
+// 100 Continue is not relayed: net/http answers a client's Expect:
+// 100-continue itself once the request body is first read, which forwarding
+// does, and the forwarded request keeps its Expect header so the backend
+// gets to accept or refuse the body in turn. 101 Switching Protocols is a
+// final response and is handled by serveUpgrade. HTTP/1.0 clients cannot
+// take interim responses and get none.
+func relayInformational(w http.ResponseWriter, fwd *http.Request) (*http.Request, func()) {
+	if !fwd.ProtoAtLeast(1, 1) {
+		return fwd, func() {}
+	}
+	var (
+		mu   sync.Mutex
+		done bool
+	)
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue || code == http.StatusSwitchingProtocols {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !done {
+				writeInformational(w, code, http.Header(header))
+			}
+			return nil
+		},
+	}
+	ctx := httptrace.WithClientTrace(fwd.Context(), trace)
+	return fwd.WithContext(ctx), func() {
+		mu.Lock()
+		done = true
+		mu.Unlock()
+	}
+}
+
+// writeInformational sends an interim response with the header of the
+// backend's, then restores w's header for the final response.
+func writeInformational(w http.ResponseWriter, code int, header http.Header) {
+	header = header.Clone()
+	hopbyhop.Remove(header)
+	h := w.Header()
+	saved := make(http.Header, len(header))
+	for k, v := range header {
+		saved[k] = h[k]
+		h[k] = v
+	}
+	w.WriteHeader(code)
+	for k, v := range saved {
+		if v == nil {
+			delete(h, k)
+		} else {
+			h[k] = v
+		}
+	}
+}
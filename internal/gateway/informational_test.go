@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_ExpectContinue_UploadCompletes(t *testing.T) {
+	upload := strings.Repeat("x", 64<<10)
+	var gotExpect string
+	var gotBody int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotExpect = r.Header.Get("Expect")
+		n, _ := io.Copy(io.Discard, r.Body)
+		gotBody = int(n)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("upload", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "upload" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	// A client waiting long for 100 Continue would stall if the gateway never
+	// sent one, so the upload must finish well before the timeout.
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/files/a", bytes.NewReader([]byte(upload)))
+	req.Header.Set("Expect", "100-continue")
+	var gotContinue bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got100Continue: func() { gotContinue = true },
+	}))
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected 201, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the upload not to wait for the continue timeout, took %v", elapsed)
+	}
+	if !gotContinue {
+		t.Error("expected the client to get 100 Continue")
+	}
+	if gotBody != len(upload) {
+		t.Errorf("expected the backend to get %d bytes, got %d", len(upload), gotBody)
+	}
+	if gotExpect != "100-continue" {
+		t.Errorf("expected the Expect header to be forwarded, got %q", gotExpect)
+	}
+}
+
+func TestGateway_RelaysEarlyHints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("page"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("web", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "web" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	var hints []string
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header.Get("Link"))
+			}
+			return nil
+		},
+	}))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(hints) != 1 || hints[0] != "</style.css>; rel=preload; as=style" {
+		t.Errorf("expected the early hint to be relayed, got %q", hints)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "page" {
+		t.Errorf("expected 200 page, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Link") != "" {
+		t.Errorf("expected the hint's header not to leak into the final response, got %q", resp.Header.Get("Link"))
+	}
+}
+
+func TestStatusRecorder_SkipsInformational(t *testing.T) {
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.WriteHeader(http.StatusEarlyHints)
+	rec.WriteHeader(http.StatusNotFound)
+	if got := rec.status(); got != http.StatusNotFound {
+		t.Errorf("expected the final status to be recorded, got %d", got)
+	}
+}
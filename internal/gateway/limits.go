@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"kerberos/internal/clock"
+	"kerberos/internal/ratelimit"
+)
+
+// RouteLimit caps traffic to one routed service, independently of others.
+type RouteLimit struct {
+	MaxConcurrent int     // Max in-flight requests; 0 = unlimited. Excess gets 503
+	Rate          float64 // Requests per second; 0 = unlimited. Excess gets 429
+	Burst         int     // Requests allowed at once under Rate; defaults to ceil(Rate)
+}
+
+// routeLimiter enforces a RouteLimit.
+type routeLimiter struct {
+	slots  chan struct{} // nil when concurrency is unlimited
+	bucket *ratelimit.Bucket
+}
+
+func newRouteLimiter(l RouteLimit, c clock.Clock) *routeLimiter {
+	rl := &routeLimiter{}
+	if l.MaxConcurrent > 0 {
+		rl.slots = make(chan struct{}, l.MaxConcurrent)
+	}
+	if l.Rate > 0 {
+		rl.bucket = ratelimit.NewBucket(l.Rate, burstFor(l.Rate, l.Burst), c.Now)
+	}
+	return rl
+}
+
+// allowRate takes a token; when none is left it returns how long to wait.
+func (rl *routeLimiter) allowRate() (bool, time.Duration) {
+	if rl.bucket == nil {
+		return true, 0
+	}
+	return rl.bucket.Allow()
+}
+
+// acquire takes a concurrency slot without blocking. Callers that succeed
+// must call release.
+func (rl *routeLimiter) acquire() bool {
+	if rl.slots == nil {
+		return true
+	}
+	select {
+	case rl.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rl *routeLimiter) release() {
+	if rl.slots != nil {
+		<-rl.slots
+	}
+}
+
+// burstFor defaults an unset burst to one second's worth of requests.
+func burstFor(rate float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return int(math.Ceil(rate))
+}
+
+// RateLimit caps the request rate of each client IP, as determined by
+// Config.ClientIP.
+type RateLimit struct {
+	Rate  float64 // Requests per second per client; 0 = unlimited. Excess gets 429
+	Burst int     // Requests a client may send at once; defaults to ceil(Rate)
+}
+
+// clientLimiter keeps a token bucket per client IP.
+type clientLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	clock   clock.Clock
+	buckets map[string]*clientBucket
+	refill  time.Duration // time for an empty bucket to fill up again
+	swept   time.Time
+}
+
+type clientBucket struct {
+	bucket   *ratelimit.Bucket
+	lastSeen time.Time
+}
+
+func newClientLimiter(l RateLimit, c clock.Clock) *clientLimiter {
+	burst := burstFor(l.Rate, l.Burst)
+	return &clientLimiter{
+		rate:    l.Rate,
+		burst:   burst,
+		clock:   c,
+		buckets: make(map[string]*clientBucket),
+		refill:  time.Duration(float64(burst) / l.Rate * float64(time.Second)),
+		swept:   c.Now(),
+	}
+}
+
+// allow takes a token from ip's bucket; when none is left it returns how
+// long to wait.
+func (cl *clientLimiter) allow(ip string) (bool, time.Duration) {
+	cl.mu.Lock()
+	now := cl.clock.Now()
+	cl.sweep(now)
+	b, ok := cl.buckets[ip]
+	if !ok {
+		b = &clientBucket{bucket: ratelimit.NewBucket(cl.rate, cl.burst, cl.clock.Now)}
+		cl.buckets[ip] = b
+	}
+	b.lastSeen = now
+	cl.mu.Unlock()
+	return b.bucket.Allow()
+}
+
+// sweep drops buckets idle long enough to have refilled completely, which
+// are no different from new ones, so the map doesn't grow with every client
+// ever seen. Caller must hold cl.mu.
+func (cl *clientLimiter) sweep(now time.Time) {
+	if now.Sub(cl.swept) < cl.refill {
+		return
+	}
+	for ip, b := range cl.buckets {
+		if now.Sub(b.lastSeen) >= cl.refill {
+			delete(cl.buckets, ip)
+		}
+	}
+	cl.swept = now
+}
+
+// limitClients answers 429 to clients over the per-IP rate limit.
+func (g *Gateway) limitClients(next http.Handler) http.Handler {
+	if g.clientLimit == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := g.clientLimit.allow(g.clientIP.FromRequest(r)); !ok {
+			setAdvice(w.Header(), "rate-limited", wait)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/clientip"
+	"kerberos/internal/clock"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_RouteLimits_EnforcedPerRoute(t *testing.T) {
+	reached := make(chan struct{})
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/reports/slow") {
+			reached <- struct{}{}
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("reports", registry.Instance{ID: "1", Addr: backend.URL})
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(b, cb),
+		Route: func(req *http.Request) string {
+			return strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")[0]
+		},
+		RouteLimits: map[string]RouteLimit{
+			"reports": {MaxConcurrent: 1, Rate: 0.001, Burst: 2},
+		},
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(srv.URL + "/reports/slow")
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-reached
+
+	if resp := get("/reports/fast"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second concurrent /reports: expected 503, got %d", resp.StatusCode)
+	} else if got := resp.Header.Get("X-Gateway-Reason"); got != "concurrency-limit" {
+		t.Errorf("expected reason concurrency-limit, got %q", got)
+	}
+	for i := 0; i < 5; i++ {
+		if resp := get("/echo/"); resp.StatusCode != http.StatusOK {
+			t.Errorf("/echo must not be limited by /reports, got %d", resp.StatusCode)
+		}
+	}
+
+	close(unblock)
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("first /reports: expected 200, got %d", status)
+	}
+
+	// The request turned away for concurrency did not spend the second
+	// token of the burst.
+	if resp := get("/reports/fast"); resp.StatusCode != http.StatusOK {
+		t.Errorf("/reports within rate: expected 200, got %d", resp.StatusCode)
+	}
+	resp := get("/reports/fast")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("/reports over rate: expected 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expected Retry-After on 429")
+	}
+}
+
+func TestGateway_RateLimit_PerClientIP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: backend.URL})
+	b := balancer.New(balancer.RoundRobin, r)
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	clk := clock.NewManual(time.Unix(0, 0))
+	gw := New(Config{
+		Registry:   r,
+		Dispatcher: dispatcher.New(b, cb),
+		Route:      func(*http.Request) string { return "echo" },
+		RateLimit:  RateLimit{Rate: 1, Burst: 2},
+		ClientIP:   clientip.NewResolver(netip.MustParsePrefix("192.0.2.0/24")), // httptest's RemoteAddr
+		Clock:      clk,
+	})
+	h := gw.Handler()
+
+	get := func(path, client string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("/echo", "203.0.113.7"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within burst: expected 200, got %d", i, rec.Code)
+		}
+	}
+	rec := get("/echo", "203.0.113.7")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past burst: expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+	if rec := get("/echo", "198.51.100.1"); rec.Code != http.StatusOK {
+		t.Errorf("other client: expected 200, got %d", rec.Code)
+	}
+	if rec := get("/health", "203.0.113.7"); rec.Code != http.StatusOK {
+		t.Errorf("built-in endpoint: expected 200, got %d", rec.Code)
+	}
+
+	clk.Advance(time.Second)
+	if rec := get("/echo", "203.0.113.7"); rec.Code != http.StatusOK {
+		t.Errorf("after refill: expected 200, got %d", rec.Code)
+	}
+	if rec := get("/echo", "203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("after one refilled token: expected 429, got %d", rec.Code)
+	}
+}
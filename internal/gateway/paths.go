@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TrailingSlash selects what path normalization does with a trailing slash.
+type TrailingSlash int
+
+const (
+	// TrailingSlashLeave keeps paths with and without a trailing slash
+	// apart (the default).
+	TrailingSlashLeave TrailingSlash = iota
+	// TrailingSlashStrip removes a trailing slash, so "/echo/" becomes "/echo".
+	TrailingSlashStrip
+	// TrailingSlashAdd appends a trailing slash, so "/echo" becomes "/echo/".
+	TrailingSlashAdd
+)
+
+// PathNormalization cleans up request paths before they are routed, so
+// routes and backends see one spelling of each path. Duplicate slashes are
+// always collapsed, e.g. "//echo//foo" to "/echo/foo"; TrailingSlash
+// decides about the slash at the end. The root path "/" is left alone.
+type PathNormalization struct {
+	TrailingSlash TrailingSlash
+
+	// Redirect answers requests for unnormalized paths with a 308 redirect
+	// to the normalized one instead of routing them under it, so clients
+	// learn the canonical URL.
+	Redirect bool
+}
+
+// wrap normalizes the paths of requests that proxied reports true for before
+// passing requests to next; other requests pass unchanged. A nil
+// configuration returns next unchanged.
+func (n *PathNormalization) wrap(next http.Handler, proxied func(*http.Request) bool) http.Handler {
+	if n == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !proxied(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		escaped := r.URL.EscapedPath()
+		clean := n.normalize(escaped)
+		if clean == escaped {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := url.PathUnescape(clean)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path, u.RawPath = path, clean
+		if n.Redirect {
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// normalize returns the normalized form of the escaped path p. Slashes are
+// only collapsed where they appear literally; an escaped "%2F" is data.
+// Paths that are not absolute, like "*" for OPTIONS, are returned unchanged.
+func (n *PathNormalization) normalize(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	if strings.Contains(p, "//") {
+		var b strings.Builder
+		b.Grow(len(p))
+		for i := 0; i < len(p); i++ {
+			if p[i] == '/' && i > 0 && p[i-1] == '/' {
+				continue
+			}
+			b.WriteByte(p[i])
+		}
+		p = b.String()
+	}
+	if p == "/" {
+		return p
+	}
+	switch n.TrailingSlash {
+	case TrailingSlashStrip:
+		p = strings.TrimSuffix(p, "/")
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+	}
+	return p
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestPathNormalization_Normalize(t *testing.T) {
+	tests := []struct {
+		mode TrailingSlash
+		in   string
+		want string
+	}{
+		{TrailingSlashLeave, "//echo//foo", "/echo/foo"},
+		{TrailingSlashLeave, "/echo/foo/", "/echo/foo/"},
+		{TrailingSlashLeave, "/a%2F%2Fb", "/a%2F%2Fb"},
+		{TrailingSlashStrip, "/echo/foo/", "/echo/foo"},
+		{TrailingSlashStrip, "/echo/foo//", "/echo/foo"},
+		{TrailingSlashStrip, "//", "/"},
+		{TrailingSlashAdd, "/echo/foo", "/echo/foo/"},
+		{TrailingSlashAdd, "/echo//foo/", "/echo/foo/"},
+		{TrailingSlashAdd, "/", "/"},
+		{TrailingSlashAdd, "*", "*"},
+	}
+	for _, tt := range tests {
+		n := &PathNormalization{TrailingSlash: tt.mode}
+		if got := n.normalize(tt.in); got != tt.want {
+			t.Errorf("normalize(%q) with mode %d = %q, want %q", tt.in, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestGateway_NormalizePaths(t *testing.T) {
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	var routed string
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Resolve: func(req *http.Request) dispatcher.RouteResult {
+			routed = req.URL.Path
+			if req.URL.Path == "/echo" || strings.HasPrefix(req.URL.Path, "/echo/") {
+				return dispatcher.RouteResult{Service: "echo", Rewrite: dispatcher.StripPrefix("/echo")}
+			}
+			return dispatcher.RouteResult{}
+		},
+		NormalizePaths: &PathNormalization{TrailingSlash: TrailingSlashStrip},
+	})
+
+	for _, path := range []string{"//echo//foo", "/echo/foo/", "/echo/foo"} {
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?q=1", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, rec.Code)
+		}
+		if routed != "/echo/foo" || gotPath != "/foo" {
+			t.Errorf("%s: expected to be routed as /echo/foo and forwarded as /foo, got %q and %q", path, routed, gotPath)
+		}
+	}
+}
+
+func TestGateway_NormalizePaths_Redirect(t *testing.T) {
+	gw := New(Config{
+		Route:          func(*http.Request) string { return "" },
+		NormalizePaths: &PathNormalization{TrailingSlash: TrailingSlashAdd, Redirect: true},
+	})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "//echo//foo?q=1", nil))
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("expected 308, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Location"); got != "/echo/foo/?q=1" {
+		t.Errorf("expected redirect to /echo/foo/?q=1, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo/foo/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a normalized path to be routed (404), got %d", rec.Code)
+	}
+}
+
+func TestGateway_NormalizePaths_LeavesGatewayEndpointsAlone(t *testing.T) {
+	for _, n := range []*PathNormalization{
+		{TrailingSlash: TrailingSlashAdd},
+		{TrailingSlash: TrailingSlashAdd, Redirect: true},
+	} {
+		gw := New(Config{
+			Route:          func(*http.Request) string { return "" },
+			NormalizePaths: n,
+		})
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("redirect %v: expected /health to answer 200, got %d", n.Redirect, rec.Code)
+		}
+	}
+}
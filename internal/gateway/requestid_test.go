@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_RequestID(t *testing.T) {
+	upstream := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream <- r.Header.Get(RequestIDHeader)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	var fromContext string
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+		Middleware: []func(http.Handler) http.Handler{
+			func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fromContext = RequestIDFromContext(r.Context())
+					next.ServeHTTP(w, r)
+				})
+			},
+		},
+	})
+	h := gw.Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+	generated := rec.Header().Get(RequestIDHeader)
+	if len(generated) != 32 {
+		t.Fatalf("expected a generated 32-character ID in the response, got %q", generated)
+	}
+	if got := <-upstream; got != generated {
+		t.Errorf("expected the backend to receive %q, got %q", generated, got)
+	}
+	if fromContext != generated {
+		t.Errorf("expected the context to carry %q, got %q", generated, fromContext)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := <-upstream; got != "abc-123" {
+		t.Errorf("expected the backend to receive the incoming ID, got %q", got)
+	}
+	if got := rec.Header().Get(RequestIDHeader); got != "abc-123" {
+		t.Errorf("expected the incoming ID in the response, got %q", got)
+	}
+}
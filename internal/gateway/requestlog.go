@@ -0,0 +1,26 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// logRequest writes the structured record for a completed routed request,
+// including err if it could not be forwarded.
+func (g *Gateway) logRequest(r *http.Request, service, instance string, rec *statusRecorder, elapsed time.Duration, err error) {
+	attrs := []slog.Attr{
+		slog.String("request_id", RequestIDFromContext(r.Context())),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("service", service),
+		slog.String("instance", instance),
+		slog.Int("status", rec.status()),
+		slog.Int64("bytes", rec.bytes),
+		slog.Duration("duration", elapsed),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	g.logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+}
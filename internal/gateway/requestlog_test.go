@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+// captureHandler keeps every record's attributes.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []map[string]slog.Value
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, rec slog.Record) error {
+	attrs := make(map[string]slog.Value)
+	rec.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	h.mu.Lock()
+	h.records = append(h.records, attrs)
+	h.mu.Unlock()
+	return nil
+}
+
+func TestGateway_Logger(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	capture := &captureHandler{}
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+		Logger:     slog.New(capture),
+	})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/echo/x", nil))
+
+	if len(capture.records) != 1 {
+		t.Fatalf("expected one record, got %d", len(capture.records))
+	}
+	got := capture.records[0]
+	want := map[string]string{
+		"method":   "POST",
+		"path":     "/echo/x",
+		"service":  "echo",
+		"instance": "inst-1",
+		"status":   "201",
+		"bytes":    "5",
+	}
+	for k, v := range want {
+		if got[k].String() != v {
+			t.Errorf("%s: got %q, want %q", k, got[k].String(), v)
+		}
+	}
+	if got["duration"].Kind() != slog.KindDuration {
+		t.Errorf("expected a duration, got %v", got["duration"])
+	}
+}
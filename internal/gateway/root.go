@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"kerberos/internal/dispatcher"
+)
+
+// RootMode selects how requests for the bare root path "/" are answered.
+type RootMode int
+
+const (
+	// RootRoute sends "/" through routing like any other path (the default).
+	RootRoute RootMode = iota
+	// RootStatus answers "/" with a small status JSON.
+	RootStatus
+	// RootRedirect redirects "/" to Root.Location.
+	RootRedirect
+	// RootService forwards "/" to Root.Service.
+	RootService
+)
+
+// Root configures the landing behavior for "/".
+type Root struct {
+	Mode     RootMode
+	Location string // Redirect target for RootRedirect
+	Service  string // Service to forward to for RootService
+}
+
+// rootStatus is the body served by RootStatus.
+type rootStatus struct {
+	Status   string `json:"status"`
+	Services int    `json:"services"`
+}
+
+// serveRoot answers "/" for RootStatus and RootRedirect, reporting whether it
+// did.
+func (g *Gateway) serveRoot(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != "/" {
+		return false
+	}
+	switch g.root.Mode {
+	case RootStatus:
+		status := rootStatus{Status: "ok"}
+		if g.shuttingDown.Load() {
+			status.Status = "shutting-down"
+		}
+		if g.registry != nil {
+			status.Services = len(g.registry.ListServices())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return true
+	case RootRedirect:
+		http.Redirect(w, r, g.root.Location, http.StatusFound)
+		return true
+	}
+	return false
+}
+
+// resolveRoot wraps resolve so "/" is routed to service.
+func resolveRoot(resolve dispatcher.RouteResultFunc, service string) dispatcher.RouteResultFunc {
+	return func(r *http.Request) dispatcher.RouteResult {
+		if r.URL.Path == "/" {
+			return dispatcher.RouteResult{Service: service}
+		}
+		if resolve == nil {
+			return dispatcher.RouteResult{}
+		}
+		return resolve(r)
+	}
+}
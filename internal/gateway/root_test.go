@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_Root_Status(t *testing.T) {
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "1", Addr: "http://a"})
+	gw := New(Config{
+		Registry: r,
+		Route:    func(req *http.Request) string { return "" },
+		Root:     Root{Mode: RootStatus},
+	})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var status rootStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if status.Status != "ok" || status.Services != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected other paths to be routed as before (404), got %d", rec.Code)
+	}
+}
+
+func TestGateway_Root_Service(t *testing.T) {
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte("home"))
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("web", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(req *http.Request) string { return "" },
+		Root:       Root{Mode: RootService, Service: "web"},
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "home" || gotPath != "/" {
+		t.Errorf("expected / to reach the web service, got %d %q (path %q)", resp.StatusCode, body, gotPath)
+	}
+
+	resp, err = http.Get(srv.URL + "/elsewhere")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected other paths to be routed as before (404), got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_Root_Redirect(t *testing.T) {
+	gw := New(Config{
+		Route: func(req *http.Request) string { return "" },
+		Root:  Root{Mode: RootRedirect, Location: "/echo/"},
+	})
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/echo/" {
+		t.Errorf("expected a redirect to /echo/, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Rule maps the requests it matches to Service. Every field that is set must
+// match; a Rule with none set matches every request.
+type Rule struct {
+	Service string
+
+	// Path matches exactly this path.
+	Path string
+
+	// PathPrefix matches paths under this prefix at a segment boundary, so
+	// "/echo" matches "/echo" and "/echo/foo" but not "/echoes".
+	PathPrefix string
+
+	// Methods matches requests with any of these methods, e.g. "GET".
+	Methods []string
+
+	// Headers matches requests carrying every header with the given value;
+	// an empty value only requires the header to be present.
+	Headers map[string]string
+}
+
+// Router routes requests by declarative rules, tried in the order they were
+// added; the first that matches decides. Requests no rule matches go to the
+// default service, if one is set. Use Route as Config.Route. A Router must
+// not be changed while it is routing requests.
+type Router struct {
+	rules    []Rule
+	fallback string
+}
+
+// NewRouter returns a Router without rules.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Add appends a rule and returns the Router, so rules can be chained.
+func (rt *Router) Add(rule Rule) *Router {
+	rt.rules = append(rt.rules, rule)
+	return rt
+}
+
+// Prefix adds a rule sending paths under prefix to service.
+func (rt *Router) Prefix(prefix, service string) *Router {
+	return rt.Add(Rule{PathPrefix: prefix, Service: service})
+}
+
+// Default sets the service for requests no rule matches.
+func (rt *Router) Default(service string) *Router {
+	rt.fallback = service
+	return rt
+}
+
+// Route returns the service of the first rule matching r, or the default.
+func (rt *Router) Route(r *http.Request) string {
+	for _, rule := range rt.rules {
+		if rule.matches(r) {
+			return rule.Service
+		}
+	}
+	return rt.fallback
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	if rule.Path != "" && r.URL.Path != rule.Path {
+		return false
+	}
+	if rule.PathPrefix != "" && !hasPathPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+		return false
+	}
+	for name, want := range rule.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || want != "" && !contains(values, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPathPrefix reports whether path is prefix or lies under it.
+func hasPathPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
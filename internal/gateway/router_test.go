@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter_Route(t *testing.T) {
+	router := NewRouter().
+		Add(Rule{Path: "/health/deep", Service: "probe"}).
+		Add(Rule{PathPrefix: "/orders", Methods: []string{http.MethodGet, http.MethodHead}, Service: "orders-read"}).
+		Add(Rule{PathPrefix: "/orders", Methods: []string{http.MethodPost}, Service: "orders-write"}).
+		Add(Rule{PathPrefix: "/api", Headers: map[string]string{"X-Canary": "true"}, Service: "api-canary"}).
+		Add(Rule{PathPrefix: "/beta/", Headers: map[string]string{"Authorization": ""}, Service: "beta"}).
+		Prefix("/api", "api").
+		Default("web")
+
+	tests := []struct {
+		method, path string
+		header       http.Header
+		want         string
+	}{
+		{http.MethodGet, "/health/deep", nil, "probe"},
+		{http.MethodGet, "/health/deep/more", nil, "web"},
+		{http.MethodGet, "/orders/42", nil, "orders-read"},
+		{http.MethodHead, "/orders", nil, "orders-read"},
+		{http.MethodPost, "/orders", nil, "orders-write"},
+		{http.MethodDelete, "/orders/42", nil, "web"},
+		{http.MethodGet, "/ordersx", nil, "web"},
+		{http.MethodGet, "/api/users", http.Header{"X-Canary": {"true"}}, "api-canary"},
+		{http.MethodGet, "/api/users", http.Header{"X-Canary": {"false"}}, "api"},
+		{http.MethodGet, "/api/users", nil, "api"},
+		{http.MethodGet, "/beta/x", http.Header{"Authorization": {"Bearer t"}}, "beta"},
+		{http.MethodGet, "/beta/x", nil, "web"},
+		{http.MethodGet, "/", nil, "web"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		if got := router.Route(req); got != tt.want {
+			t.Errorf("%s %s %v: got %q, want %q", tt.method, tt.path, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRouter_NoDefault(t *testing.T) {
+	router := NewRouter().Prefix("/echo", "echo")
+	gw := New(Config{Route: router.Route})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected unmatched requests to get 404, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"time"
+
+	"kerberos/internal/registry"
+)
+
+// Optional registry.Store methods. *registry.Registry has them all; an
+// external Store without them gets 501 from the endpoints that need them,
+// except for DELETE /register/all, which then unregisters instances one by
+// one.
+
+// ttlStore registers instances that expire unless renewed.
+type ttlStore interface {
+	RegisterWithTTL(serviceName string, instance registry.Instance, ttl time.Duration) error
+	Renew(serviceName string, instanceID string) bool
+}
+
+// drainStore drains instances before unregistering them.
+type drainStore interface {
+	Drain(serviceName string, instanceID string) bool
+	FinishDrain(serviceName string, instanceID string) bool
+}
+
+// weightStore changes the weight of registered instances.
+type weightStore interface {
+	SetWeight(serviceName string, instanceID string, weight int) bool
+}
+
+// serviceStore unregisters every instance of a service at once.
+type serviceStore interface {
+	UnregisterService(serviceName string) int
+}
+
+// batchStore registers several instances, or none of them.
+type batchStore interface {
+	RegisterBatch(regs []registry.Registration) error
+}
+
+var (
+	_ ttlStore     = (*registry.Registry)(nil)
+	_ drainStore   = (*registry.Registry)(nil)
+	_ weightStore  = (*registry.Registry)(nil)
+	_ serviceStore = (*registry.Registry)(nil)
+	_ batchStore   = (*registry.Registry)(nil)
+)
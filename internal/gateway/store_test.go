@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+// mockStore is a registry.Store with none of the optional methods, recording
+// the calls it gets.
+type mockStore struct {
+	mu        sync.Mutex
+	instances map[string][]registry.Instance
+	calls     []string
+}
+
+func (s *mockStore) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *mockStore) Register(service string, inst registry.Instance) error {
+	s.record("Register " + service + "/" + inst.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[service] = append(s.instances[service], inst)
+	return nil
+}
+
+func (s *mockStore) Unregister(service, id string) {
+	s.record("Unregister " + service + "/" + id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []registry.Instance
+	for _, inst := range s.instances[service] {
+		if inst.ID != id {
+			kept = append(kept, inst)
+		}
+	}
+	s.instances[service] = kept
+}
+
+func (s *mockStore) GetInstances(service string) []registry.Instance {
+	s.record("GetInstances " + service)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]registry.Instance(nil), s.instances[service]...)
+}
+
+func (s *mockStore) ListServices() []string {
+	s.record("ListServices")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.instances {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *mockStore) Watch() (<-chan registry.Event, func()) {
+	return make(chan registry.Event), func() {}
+}
+
+func (s *mockStore) called(call string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGateway_DelegatesToStore(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from the backend"))
+	}))
+	defer backend.Close()
+
+	store := &mockStore{instances: make(map[string][]registry.Instance)}
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Registry:   store,
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, store), cb),
+		Route:      func(*http.Request) string { return "echo" },
+	})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/register", `{"service":"echo","id":"inst-1","addr":"`+backend.URL+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("register: expected 204, got %d: %s", rec.Code, rec.Body)
+	}
+	if !store.called("Register echo/inst-1") {
+		t.Errorf("expected registration to reach the store, got %q", store.calls)
+	}
+
+	rec := do(http.MethodGet, "/echo", "")
+	if body, _ := io.ReadAll(rec.Body); rec.Code != http.StatusOK || string(body) != "hello from the backend" {
+		t.Fatalf("expected the request to reach the instance from the store, got %d %q", rec.Code, body)
+	}
+	if !store.called("GetInstances echo") {
+		t.Errorf("expected the balancer to read instances from the store, got %q", store.calls)
+	}
+
+	rec = do(http.MethodGet, "/services", "")
+	var services []string
+	json.NewDecoder(rec.Body).Decode(&services)
+	if len(services) != 1 || services[0] != "echo" || !store.called("ListServices") {
+		t.Errorf("expected services listed from the store, got %q", services)
+	}
+
+	// Endpoints needing methods the store lacks are not available.
+	for _, tt := range []struct{ method, path, body string }{
+		{http.MethodPatch, "/register", `{"service":"echo","id":"inst-1","weight":3}`},
+		{http.MethodPost, "/register", `{"service":"echo","id":"inst-2","addr":"http://b","ttl":30}`},
+		{http.MethodDelete, "/register?drain=true", `{"service":"echo","id":"inst-1"}`},
+	} {
+		if rec := do(tt.method, tt.path, tt.body); rec.Code != http.StatusNotImplemented {
+			t.Errorf("%s %s: expected 501, got %d", tt.method, tt.path, rec.Code)
+		}
+	}
+
+	if rec := do(http.MethodDelete, "/register", `{"service":"echo","id":"inst-1"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("unregister: expected 204, got %d", rec.Code)
+	}
+	if !store.called("Unregister echo/inst-1") {
+		t.Errorf("expected unregistration to reach the store, got %q", store.calls)
+	}
+}
+
+func TestGateway_NilRegistryPointer(t *testing.T) {
+	var reg *registry.Registry
+	gw := New(Config{Registry: reg})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"service":"echo","id":"1","addr":"http://a"}`)))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected registration to be disabled, got %d", rec.Code)
+	}
+	if err := gw.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestDispatcher_UnknownServicesFromStore(t *testing.T) {
+	store := &mockStore{instances: map[string][]registry.Instance{"emptied": nil}}
+	cb := circuitbreaker.New(http.DefaultClient, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, store), cb, dispatcher.WithUnknownServices(store)),
+		Route: func(req *http.Request) string {
+			return strings.TrimPrefix(req.URL.Path, "/")
+		},
+	})
+
+	for path, want := range map[string]int{"/emptied": http.StatusServiceUnavailable, "/never-registered": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+}
+
+// batchFailStore is a Store whose batch registration fails outright.
+type batchFailStore struct {
+	*mockStore
+}
+
+func (batchFailStore) RegisterBatch([]registry.Registration) error {
+	return errors.New("store unavailable")
+}
+
+func TestGateway_RegisterBatch_StoreError(t *testing.T) {
+	gw := New(Config{Registry: batchFailStore{&mockStore{instances: make(map[string][]registry.Instance)}}})
+
+	rec := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/register/batch", strings.NewReader(`[{"service":"echo","id":"1","addr":"http://a"}]`)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected the store's error to give 500, got %d", rec.Code)
+	}
+}
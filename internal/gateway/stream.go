@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// streaming reports whether resp should reach the client piece by piece as
+// the backend sends it: Server-Sent Events, and bodies of unknown length such
+// as chunked responses.
+func streaming(resp *http.Response) bool {
+	return isEventStream(resp) || resp.ContentLength < 0
+}
+
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// flushWriter flushes every write through to the client.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		// Best effort: a writer that cannot flush still gets the data.
+		f.rc.Flush()
+	}
+	return n, err
+}
+
+// streamWriter sends the response headers written to w so far and returns w
+// wrapped to flush each chunk of resp's body as soon as it is written. Event
+// streams are long-lived, so the server's write timeout is lifted for them.
+func streamWriter(w http.ResponseWriter, resp *http.Response) io.Writer {
+	rc := http.NewResponseController(w)
+	if isEventStream(resp) {
+		rc.SetWriteDeadline(time.Time{})
+	}
+	rc.Flush()
+	return flushWriter{w: w, rc: rc}
+}
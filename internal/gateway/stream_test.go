@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_EventStreamIsNotBuffered(t *testing.T) {
+	next := make(chan struct{})
+	release := sync.OnceFunc(func() { close(next) })
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i, event := range []string{"first", "second"} {
+			if i > 0 {
+				// Hold the next event back until the client has the last.
+				<-next
+			}
+			w.Write([]byte("data: " + event + "\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("events", registry.Instance{ID: "1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "events" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+	defer release() // lets the backend finish if the test fails early
+
+	client := &http.Client{Timeout: 2 * time.Second} // headers are held back too
+	resp, err := client.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if line := sc.Text(); strings.HasPrefix(line, "data: ") {
+				lines <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(lines)
+	}()
+
+	for i, want := range []string{"first", "second"} {
+		if i > 0 {
+			release()
+		}
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("expected event %q, got %q", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %q was not delivered while the stream was open", want)
+		}
+	}
+}
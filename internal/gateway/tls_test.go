@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+func TestGateway_ServeTLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	// Borrow httptest's certificate and a client that trusts it.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSrv.Close()
+	transport := certSrv.Client().Transport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	client := &http.Client{Transport: transport}
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	base := &http.Server{ReadHeaderTimeout: 5 * time.Second}
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+		TLSConfig:  &tls.Config{Certificates: certSrv.TLS.Certificates},
+		Server:     base,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go gw.Serve(ln)
+	defer gw.Shutdown(context.Background())
+
+	resp, err := client.Get("https://" + ln.Addr().String() + "/echo")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("expected the proxied body, got %q", body)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if base.Handler != nil || base.TLSConfig != nil {
+		t.Error("expected the supplied server to be left unchanged")
+	}
+}
+
+func TestGateway_NewServer_CopiesConfigServer(t *testing.T) {
+	states := 0
+	base := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		ConnState:         func(net.Conn, http.ConnState) { states++ },
+	}
+	gw := New(Config{Server: base, Addr: ":9999", Route: func(*http.Request) string { return "" }})
+
+	gw.newServer()
+	srv := gw.newServer()
+	if srv == base {
+		t.Fatal("expected a copy of the supplied server")
+	}
+	if srv.ReadHeaderTimeout != 5*time.Second || srv.Addr != ":9999" || srv.Handler == nil {
+		t.Errorf("expected the copy to keep the settings and serve the gateway, got %+v", srv)
+	}
+	if base.Addr != "" || base.Handler != nil {
+		t.Error("expected the supplied server to be left unchanged")
+	}
+
+	// Each server wraps the supplied ConnState once, however many were made.
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	srv.ConnState(conn, http.StateNew)
+	if states != 1 {
+		t.Errorf("expected the supplied ConnState to be called once, got %d", states)
+	}
+}
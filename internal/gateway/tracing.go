@@ -0,0 +1,56 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+)
+
+// SpanKind tells a Tracer which side of a call a span covers.
+type SpanKind int
+
+const (
+	SpanKindServer SpanKind = iota // The gateway receiving a request
+	SpanKindClient                 // The gateway forwarding it to a backend
+)
+
+// Tracer lets the gateway take part in distributed tracing. It mirrors the
+// parts of OpenTelemetry the gateway needs, so an adapter around an
+// OpenTelemetry tracer and W3C propagator satisfies it.
+//
+// Without a Tracer the W3C traceparent and tracestate headers still reach
+// the backend unchanged, like any other header.
+type Tracer interface {
+	// Extract returns ctx carrying the remote span context found in h, if
+	// any.
+	Extract(ctx context.Context, h http.Header) context.Context
+
+	// Start begins a span as a child of the span in ctx and returns a
+	// context carrying the new span.
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+
+	// Inject writes the span context in ctx to h, replacing traceparent and
+	// tracestate.
+	Inject(ctx context.Context, h http.Header)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetStatus records the HTTP status of the call the span covers.
+	SetStatus(code int)
+
+	// RecordError records why the call failed without a response.
+	RecordError(err error)
+
+	End()
+}
+
+// startForwardSpan starts the client span for forwarding r to service and
+// returns r with the span's context and headers. The request's cancellation
+// carries over.
+func (g *Gateway) startForwardSpan(r *http.Request, service string) (*http.Request, Span) {
+	ctx, span := g.tracer.Start(r.Context(), "forward "+service, SpanKindClient)
+	fwd := r.WithContext(ctx)
+	fwd.Header = r.Header.Clone()
+	g.tracer.Inject(ctx, fwd.Header)
+	return fwd, span
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// fakeTracer keeps W3C trace contexts as "<trace-id>-<span-id>" strings in
+// the context and records every span it starts.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name, parent, id string
+	kind             SpanKind
+	status           int
+	ended            bool
+}
+
+type fakeSpanKey struct{}
+
+func (t *fakeTracer) Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(h.Get("traceparent"), "-")
+	if len(parts) != 4 {
+		return ctx
+	}
+	return context.WithValue(ctx, fakeSpanKey{}, parts[1]+"-"+parts[2])
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, _ := ctx.Value(fakeSpanKey{}).(string)
+	traceID, _, _ := strings.Cut(parent, "-")
+	s := &fakeSpan{name: name, parent: parent, kind: kind, id: fmt.Sprintf("%s-%016x", traceID, len(t.spans)+1)}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, fakeSpanKey{}, s.id), s
+}
+
+func (t *fakeTracer) Inject(ctx context.Context, h http.Header) {
+	if id, ok := ctx.Value(fakeSpanKey{}).(string); ok {
+		h.Set("traceparent", "00-"+id+"-01")
+	}
+}
+
+func (s *fakeSpan) SetStatus(code int)    { s.status = code }
+func (s *fakeSpan) RecordError(err error) {}
+func (s *fakeSpan) End()                  { s.ended = true }
+
+func tracingGateway(t *testing.T, tracer Tracer) (http.Handler, <-chan string) {
+	t.Helper()
+	upstream := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(backend.Close)
+
+	r := registry.New()
+	r.Register("echo", registry.Instance{ID: "inst-1", Addr: backend.URL})
+	cb := circuitbreaker.New(backend.Client(), circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "echo" },
+		Tracer:     tracer,
+	})
+	return gw.Handler(), upstream
+}
+
+func TestGateway_TraceparentReachesBackendUnchanged(t *testing.T) {
+	h, upstream := tracingGateway(t, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+	req.Header.Set("traceparent", incomingTraceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := <-upstream; got != incomingTraceparent {
+		t.Errorf("expected traceparent %q at the backend, got %q", incomingTraceparent, got)
+	}
+}
+
+func TestGateway_TracerSpans(t *testing.T) {
+	tracer := &fakeTracer{}
+	h, upstream := tracingGateway(t, tracer)
+
+	req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+	req.Header.Set("traceparent", incomingTraceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected a server and a client span, got %d", len(tracer.spans))
+	}
+	server, client := tracer.spans[0], tracer.spans[1]
+	if server.kind != SpanKindServer || server.parent != "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7" {
+		t.Errorf("expected a server span continuing the incoming trace, got %+v", server)
+	}
+	if client.kind != SpanKindClient || client.parent != server.id {
+		t.Errorf("expected a client span under the server span, got %+v", client)
+	}
+	if want := "00-" + client.id + "-01"; <-upstream != want {
+		t.Errorf("expected the backend to see the client span's traceparent %q", want)
+	}
+	for _, s := range tracer.spans {
+		if !s.ended || s.status != http.StatusAccepted {
+			t.Errorf("span %q: expected ended with status 202, got ended=%v status=%d", s.name, s.ended, s.status)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serveUpgrade completes a protocol switch such as a WebSocket handshake the
+// backend has accepted: it relays the 101 response, then copies bytes both
+// ways between client and backend until either side closes.
+func (g *Gateway) serveUpgrade(w http.ResponseWriter, resp *http.Response) {
+	backend, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		http.Error(w, "backend upgrade not supported", http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// The server's read and write timeouts are meant for requests, not for
+	// connections that stay open for the length of a session.
+	conn.SetDeadline(time.Time{})
+
+	if err := writeSwitchingProtocols(brw.Writer, resp); err != nil {
+		return
+	}
+
+	var once sync.Once
+	closeBoth := func() {
+		conn.Close()
+		resp.Body.Close()
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		// brw.Reader may already hold bytes the client sent after its
+		// request.
+		io.Copy(backend, brw.Reader)
+		once.Do(closeBoth)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		once.Do(closeBoth)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// writeSwitchingProtocols writes resp's status line and headers, keeping the
+// Connection and Upgrade headers that complete the handshake.
+func writeSwitchingProtocols(bw *bufio.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode)); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/balancer"
+	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/dispatcher"
+	"kerberos/internal/registry"
+)
+
+// writeFrame writes payload as a single unfragmented WebSocket text frame,
+// masked as clients must.
+func writeFrame(w io.Writer, payload []byte, mask bool) error {
+	header := []byte{0x81, byte(len(payload))} // FIN + text; payloads here are < 126 bytes
+	data := append([]byte(nil), payload...)
+	if mask {
+		key := []byte{1, 2, 3, 4}
+		header[1] |= 0x80
+		header = append(header, key...)
+		for i := range data {
+			data[i] ^= key[i%4]
+		}
+	}
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+// readFrame reads one short WebSocket frame and returns its unmasked payload.
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var key []byte
+	if header[1]&0x80 != 0 {
+		key = make([]byte, 4)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		if key != nil {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return payload, nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func TestGateway_WebSocketEcho(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		brw.Flush()
+		msg, err := readFrame(brw)
+		if err != nil {
+			t.Errorf("backend readFrame: %v", err)
+			return
+		}
+		writeFrame(conn, msg, false)
+	}))
+	defer backend.Close()
+
+	r := registry.New()
+	r.Register("chat", registry.Instance{ID: "1", Addr: "ws://" + strings.TrimPrefix(backend.URL, "http://")})
+	cb := circuitbreaker.New(&http.Client{Timeout: 50 * time.Millisecond}, circuitbreaker.DefaultSettings())
+	gw := New(Config{
+		Dispatcher: dispatcher.New(balancer.New(balancer.RoundRobin, r), cb),
+		Route:      func(*http.Request) string { return "chat" },
+	})
+	srv := httptest.NewServer(gw.Handler())
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != websocketAccept(key) {
+		t.Errorf("expected the backend's Sec-WebSocket-Accept, got %q", got)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("expected Upgrade: websocket, got %q", resp.Header.Get("Upgrade"))
+	}
+
+	// Outlive the client timeout to show it does not apply to the session.
+	time.Sleep(100 * time.Millisecond)
+	if err := writeFrame(conn, []byte("hello"), true); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	msg, err := readFrame(br)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if string(msg) != "hello" {
+		t.Errorf("expected echo %q, got %q", "hello", msg)
+	}
+}
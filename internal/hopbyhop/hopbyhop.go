@@ -0,0 +1,50 @@
+// Package hopbyhop removes headers that apply to a single connection and
+// must not be forwarded by a proxy (RFC 7230, section 6.1).
+package hopbyhop
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Headers is the standard hop-by-hop set.
+var Headers = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Remove deletes the hop-by-hop headers from h, including any header named
+// in its Connection header.
+func Remove(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range Headers {
+		h.Del(name)
+	}
+}
+
+// UpgradeProtocol returns the protocol h asks to switch to, such as
+// "websocket", or "" if h is not an upgrade request. Call it before Remove,
+// which deletes the Upgrade header.
+func UpgradeProtocol(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
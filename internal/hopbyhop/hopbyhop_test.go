@@ -0,0 +1,44 @@
+package hopbyhop
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemove(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "X-Custom, keep-alive")
+	h.Add("Connection", "X-Other")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Upgrade", "websocket")
+	h.Set("Proxy-Authorization", "Basic abc")
+	h.Set("X-Custom", "1")
+	h.Set("X-Other", "2")
+	h.Set("Content-Type", "text/plain")
+	h.Set("Authorization", "Bearer t")
+
+	Remove(h)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "Upgrade", "Proxy-Authorization", "X-Custom", "X-Other"} {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			t.Errorf("expected %s to be removed", name)
+		}
+	}
+	for _, name := range []string{"Content-Type", "Authorization"} {
+		if h.Get(name) == "" {
+			t.Errorf("expected end-to-end header %s to be kept", name)
+		}
+	}
+}
+
+func TestUpgradeProtocol(t *testing.T) {
+	h := http.Header{}
+	h.Set("Upgrade", "websocket")
+	if got := UpgradeProtocol(h); got != "" {
+		t.Errorf("Upgrade without Connection: upgrade: expected none, got %q", got)
+	}
+	h.Set("Connection", "keep-alive, Upgrade")
+	if got := UpgradeProtocol(h); got != "websocket" {
+		t.Errorf("expected websocket, got %q", got)
+	}
+}
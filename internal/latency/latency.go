@@ -0,0 +1,151 @@
+package latency
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Histogram buckets cover 1µs to ~30 minutes with boundaries growing by
+// growth, so any percentile is accurate to within that relative error while
+// memory stays fixed regardless of sample count.
+const (
+	minValue = float64(time.Microsecond)
+	growth   = 1.02
+)
+
+var numBuckets = int(math.Ceil(math.Log(float64(30*time.Minute)/minValue)/math.Log(growth))) + 1
+
+// Histogram is a fixed-size, log-bucketed latency histogram.
+type Histogram struct {
+	counts []uint64
+	total  uint64
+}
+
+// NewHistogram creates an empty histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, numBuckets)}
+}
+
+// Observe records one sample. Not safe for concurrent use; Tracker locks.
+func (h *Histogram) Observe(d time.Duration) {
+	h.counts[bucketOf(d)]++
+	h.total++
+}
+
+// Count returns the number of samples recorded.
+func (h *Histogram) Count() uint64 {
+	return h.total
+}
+
+// Quantile returns the estimated q-quantile (0 < q <= 1), or 0 when empty.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return bucketValue(i)
+		}
+	}
+	return bucketValue(len(h.counts) - 1)
+}
+
+func bucketOf(d time.Duration) int {
+	if float64(d) <= minValue {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/minValue) / math.Log(growth)))
+	if i >= numBuckets {
+		return numBuckets - 1
+	}
+	return i
+}
+
+// bucketValue returns a representative value for bucket i: the geometric
+// midpoint of its bounds.
+func bucketValue(i int) time.Duration {
+	if i == 0 {
+		return time.Duration(minValue)
+	}
+	return time.Duration(minValue * math.Pow(growth, float64(i)-0.5))
+}
+
+// Summary is a snapshot of one service's latency and load.
+type Summary struct {
+	Count    uint64        `json:"count"`
+	InFlight int64         `json:"in_flight"`
+	P50      time.Duration `json:"p50_ns"`
+	P90      time.Duration `json:"p90_ns"`
+	P99      time.Duration `json:"p99_ns"`
+}
+
+// Tracker keeps a latency histogram and in-flight gauge per service.
+type Tracker struct {
+	mu       sync.Mutex
+	services map[string]*serviceStats
+}
+
+type serviceStats struct {
+	hist     *Histogram
+	inFlight int64
+}
+
+// NewTracker creates an empty tracker.
+func NewTracker() *Tracker {
+	return &Tracker{services: make(map[string]*serviceStats)}
+}
+
+func (t *Tracker) get(service string) *serviceStats {
+	s, ok := t.services[service]
+	if !ok {
+		s = &serviceStats{hist: NewHistogram()}
+		t.services[service] = s
+	}
+	return s
+}
+
+// Begin marks a request to service as in flight.
+func (t *Tracker) Begin(service string) {
+	t.mu.Lock()
+	t.get(service).inFlight++
+	t.mu.Unlock()
+}
+
+// End marks a request begun with Begin as finished.
+func (t *Tracker) End(service string) {
+	t.mu.Lock()
+	t.get(service).inFlight--
+	t.mu.Unlock()
+}
+
+// Observe records a latency sample for service.
+func (t *Tracker) Observe(service string, d time.Duration) {
+	t.mu.Lock()
+	t.get(service).hist.Observe(d)
+	t.mu.Unlock()
+}
+
+// Snapshot returns a summary per service.
+func (t *Tracker) Snapshot() map[string]Summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[string]Summary, len(t.services))
+	for name, s := range t.services {
+		out[name] = Summary{
+			Count:    s.hist.Count(),
+			InFlight: s.inFlight,
+			P50:      s.hist.Quantile(0.50),
+			P90:      s.hist.Quantile(0.90),
+			P99:      s.hist.Quantile(0.99),
+		}
+	}
+	return out
+}
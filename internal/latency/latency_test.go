@@ -0,0 +1,45 @@
+package latency
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTracker_PercentilesWithinTolerance(t *testing.T) {
+	tr := NewTracker()
+	// Uniform 1ms..1000ms.
+	for i := 1; i <= 1000; i++ {
+		tr.Observe("echo", time.Duration(i)*time.Millisecond)
+	}
+
+	s := tr.Snapshot()["echo"]
+	if s.Count != 1000 {
+		t.Fatalf("expected 1000 samples, got %d", s.Count)
+	}
+	checks := []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"p50", s.P50, 500 * time.Millisecond},
+		{"p90", s.P90, 900 * time.Millisecond},
+		{"p99", s.P99, 990 * time.Millisecond},
+	}
+	for _, c := range checks {
+		if rel := math.Abs(float64(c.got-c.want)) / float64(c.want); rel > 0.02 {
+			t.Errorf("%s: want ~%v, got %v (%.1f%% off)", c.name, c.want, c.got, rel*100)
+		}
+	}
+}
+
+func TestTracker_InFlight(t *testing.T) {
+	tr := NewTracker()
+	tr.Begin("echo")
+	tr.Begin("echo")
+	tr.End("echo")
+
+	if got := tr.Snapshot()["echo"].InFlight; got != 1 {
+		t.Errorf("expected 1 in flight, got %d", got)
+	}
+}
@@ -0,0 +1,155 @@
+// Package metrics exports gateway metrics in the Prometheus text exposition
+// format, without depending on a Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kerberos/internal/circuitbreaker"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the request duration
+// histogram.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Collector accumulates per-service request metrics.
+type Collector struct {
+	mu       sync.Mutex
+	services map[string]*serviceMetrics
+}
+
+type serviceMetrics struct {
+	requests uint64
+	statuses map[int]uint64
+	buckets  []uint64 // Non-cumulative counts per DurationBuckets entry, plus +Inf
+	sum      float64  // Seconds
+}
+
+// New creates an empty collector.
+func New() *Collector {
+	return &Collector{services: make(map[string]*serviceMetrics)}
+}
+
+// Observe records one request to service answered with status after d.
+func (c *Collector) Observe(service string, status int, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.services[service]
+	if m == nil {
+		m = &serviceMetrics{statuses: make(map[int]uint64), buckets: make([]uint64, len(DurationBuckets)+1)}
+		c.services[service] = m
+	}
+	m.requests++
+	m.statuses[status]++
+	secs := d.Seconds()
+	m.sum += secs
+	m.buckets[sort.SearchFloat64s(DurationBuckets, secs)]++
+}
+
+// WriteText writes the collected metrics in the Prometheus text format.
+func (c *Collector) WriteText(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.services))
+	for name := range c.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP kerberos_requests_total Requests routed to a service.")
+	fmt.Fprintln(bw, "# TYPE kerberos_requests_total counter")
+	for _, name := range names {
+		fmt.Fprintf(bw, "kerberos_requests_total{service=%s} %d\n", quote(name), c.services[name].requests)
+	}
+
+	fmt.Fprintln(bw, "# HELP kerberos_responses_total Responses by service and status code.")
+	fmt.Fprintln(bw, "# TYPE kerberos_responses_total counter")
+	for _, name := range names {
+		m := c.services[name]
+		codes := make([]int, 0, len(m.statuses))
+		for code := range m.statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(bw, "kerberos_responses_total{service=%s,code=\"%d\"} %d\n", quote(name), code, m.statuses[code])
+		}
+	}
+
+	fmt.Fprintln(bw, "# HELP kerberos_request_duration_seconds Time to answer a request, by service.")
+	fmt.Fprintln(bw, "# TYPE kerberos_request_duration_seconds histogram")
+	for _, name := range names {
+		m := c.services[name]
+		var cumulative uint64
+		for i, le := range DurationBuckets {
+			cumulative += m.buckets[i]
+			fmt.Fprintf(bw, "kerberos_request_duration_seconds_bucket{service=%s,le=\"%s\"} %d\n", quote(name), strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "kerberos_request_duration_seconds_bucket{service=%s,le=\"+Inf\"} %d\n", quote(name), m.requests)
+		fmt.Fprintf(bw, "kerberos_request_duration_seconds_sum{service=%s} %s\n", quote(name), strconv.FormatFloat(m.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "kerberos_request_duration_seconds_count{service=%s} %d\n", quote(name), m.requests)
+	}
+	return bw.Flush()
+}
+
+// breakerStates maps breaker state names to the exported gauge value.
+var breakerStates = map[string]int{"closed": 0, "half-open": 1, "open": 2}
+
+// WriteBreakerStats writes the state of each target's circuit breaker
+// (0 closed, 1 half-open, 2 open) and its request counters in the Prometheus
+// text format.
+func WriteBreakerStats(w io.Writer, stats map[string]circuitbreaker.Stats) error {
+	targets := make([]string, 0, len(stats))
+	for target := range stats {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP kerberos_breaker_state Circuit breaker state per target (0 closed, 1 half-open, 2 open).")
+	fmt.Fprintln(bw, "# TYPE kerberos_breaker_state gauge")
+	for _, target := range targets {
+		fmt.Fprintf(bw, "kerberos_breaker_state{target=%s} %d\n", quote(target), breakerStates[stats[target].State])
+	}
+
+	fmt.Fprintln(bw, "# HELP kerberos_breaker_requests_total Requests through the circuit breaker per target.")
+	fmt.Fprintln(bw, "# TYPE kerberos_breaker_requests_total counter")
+	for _, target := range targets {
+		fmt.Fprintf(bw, "kerberos_breaker_requests_total{target=%s} %d\n", quote(target), stats[target].Requests)
+	}
+
+	fmt.Fprintln(bw, "# HELP kerberos_breaker_successes_total Requests the circuit breaker counted as successes per target.")
+	fmt.Fprintln(bw, "# TYPE kerberos_breaker_successes_total counter")
+	for _, target := range targets {
+		fmt.Fprintf(bw, "kerberos_breaker_successes_total{target=%s} %d\n", quote(target), stats[target].Successes)
+	}
+
+	fmt.Fprintln(bw, "# HELP kerberos_breaker_failures_total Requests the circuit breaker counted as failures per target, including those it rejected.")
+	fmt.Fprintln(bw, "# TYPE kerberos_breaker_failures_total counter")
+	for _, target := range targets {
+		fmt.Fprintf(bw, "kerberos_breaker_failures_total{target=%s} %d\n", quote(target), stats[target].Failures)
+	}
+
+	fmt.Fprintln(bw, "# HELP kerberos_breaker_consecutive_failures Failures in a row per target since its last success.")
+	fmt.Fprintln(bw, "# TYPE kerberos_breaker_consecutive_failures gauge")
+	for _, target := range targets {
+		fmt.Fprintf(bw, "kerberos_breaker_consecutive_failures{target=%s} %d\n", quote(target), stats[target].ConsecutiveFailures)
+	}
+	return bw.Flush()
+}
+
+// quote renders a label value, escaping as the text format requires.
+func quote(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
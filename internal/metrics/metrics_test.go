@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"kerberos/internal/circuitbreaker"
+)
+
+func TestCollector_WriteText(t *testing.T) {
+	c := New()
+	c.Observe("echo", 200, 3*time.Millisecond)
+	c.Observe("echo", 200, 30*time.Millisecond)
+	c.Observe("echo", 502, 20*time.Second)
+	c.Observe(`we"ird`, 404, time.Millisecond)
+
+	var b strings.Builder
+	if err := c.WriteText(&b); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`kerberos_requests_total{service="echo"} 3`,
+		`kerberos_responses_total{service="echo",code="200"} 2`,
+		`kerberos_responses_total{service="echo",code="502"} 1`,
+		`kerberos_request_duration_seconds_bucket{service="echo",le="0.005"} 1`,
+		`kerberos_request_duration_seconds_bucket{service="echo",le="0.05"} 2`,
+		`kerberos_request_duration_seconds_bucket{service="echo",le="10"} 2`,
+		`kerberos_request_duration_seconds_bucket{service="echo",le="+Inf"} 3`,
+		`kerberos_request_duration_seconds_count{service="echo"} 3`,
+		`kerberos_requests_total{service="we\"ird"} 1`,
+		"# TYPE kerberos_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteBreakerStats(t *testing.T) {
+	var b strings.Builder
+	WriteBreakerStats(&b, map[string]circuitbreaker.Stats{
+		"http://a": {State: "closed", Requests: 5, Successes: 4, Failures: 1},
+		"http://b": {State: "half-open", Requests: 3, Failures: 3, ConsecutiveFailures: 2},
+		"http://c": {State: "open"},
+	})
+	for _, want := range []string{
+		`kerberos_breaker_state{target="http://a"} 0`,
+		`kerberos_breaker_state{target="http://b"} 1`,
+		`kerberos_breaker_state{target="http://c"} 2`,
+		`kerberos_breaker_requests_total{target="http://a"} 5`,
+		`kerberos_breaker_successes_total{target="http://a"} 4`,
+		`kerberos_breaker_failures_total{target="http://a"} 1`,
+		`kerberos_breaker_consecutive_failures{target="http://a"} 0`,
+		`kerberos_breaker_requests_total{target="http://b"} 3`,
+		`kerberos_breaker_successes_total{target="http://b"} 0`,
+		`kerberos_breaker_failures_total{target="http://b"} 3`,
+		`kerberos_breaker_consecutive_failures{target="http://b"} 2`,
+		`kerberos_breaker_requests_total{target="http://c"} 0`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_AllowAndRefill(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBucket(2, 2, func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatalf("Allow %d: expected burst to be available", i)
+		}
+	}
+	ok, wait := b.Allow()
+	if ok {
+		t.Fatal("expected bucket to be empty")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("expected 500ms until next token, got %v", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := b.Allow(); !ok {
+		t.Error("expected a token after 500ms at 2/s")
+	}
+}
+
+func TestBucket_SetLimitCapsTokens(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBucket(10, 10, func() time.Time { return now })
+
+	b.SetLimit(1, 1)
+	if ok, _ := b.Allow(); !ok {
+		t.Fatal("expected one token after lowering the limit")
+	}
+	if ok, _ := b.Allow(); ok {
+		t.Error("expected tokens above the new burst to be discarded")
+	}
+}
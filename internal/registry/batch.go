@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Registration pairs an instance with the service it belongs to.
+type Registration struct {
+	Service  string
+	Instance Instance
+}
+
+// BatchError is returned by RegisterBatch when any registration is rejected.
+// Items holds one entry per registration, nil for those that were valid.
+type BatchError struct {
+	Items []error
+}
+
+func (e *BatchError) Error() string {
+	var msgs []string
+	for i, err := range e.Items {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("#%d: %v", i, err))
+		}
+	}
+	return fmt.Sprintf("%d of %d registrations rejected: %s", len(msgs), len(e.Items), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the individual errors, so errors.Is finds e.g.
+// ErrInvalidInstance.
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Items {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// RegisterBatch validates and registers all regs under a single lock. If any
+// registration is invalid, or in global-ID mode reuses an ID held by another
+// service (including earlier in the batch), nothing is registered and a
+// *BatchError describes each rejected item.
+func (r *Registry) RegisterBatch(regs []Registration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	items := make([]error, len(regs))
+	failed := false
+	owners := make(map[string]string) // instance ID -> service, within the batch
+	for i, reg := range regs {
+		err := Validate(reg.Service, reg.Instance)
+		if err == nil && r.globalIDs {
+			owner, ok := owners[reg.Instance.ID]
+			if !ok {
+				owner = r.ownerOf(reg.Instance.ID)
+			}
+			if owner != "" && owner != reg.Service {
+				err = fmt.Errorf("%w: %q is used by service %q", ErrDuplicateID, reg.Instance.ID, owner)
+			} else {
+				owners[reg.Instance.ID] = reg.Service
+			}
+		}
+		if err != nil {
+			items[i] = err
+			failed = true
+		}
+	}
+	if failed {
+		return &BatchError{Items: items}
+	}
+
+	for _, reg := range regs {
+		r.register(reg.Service, reg.Instance)
+	}
+	return nil
+}
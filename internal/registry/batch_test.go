@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegistry_RegisterBatch(t *testing.T) {
+	r := New()
+	err := r.RegisterBatch([]Registration{
+		{"echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"}},
+		{"echo", Instance{ID: "inst-2", Addr: "http://localhost:8082"}},
+		{"users", Instance{ID: "inst-3", Addr: "http://localhost:8083"}},
+	})
+	if err != nil {
+		t.Fatalf("RegisterBatch: %v", err)
+	}
+	if len(r.GetInstances("echo")) != 2 || len(r.GetInstances("users")) != 1 {
+		t.Errorf("expected all instances registered, got echo=%v users=%v", r.GetInstances("echo"), r.GetInstances("users"))
+	}
+}
+
+func TestRegistry_RegisterBatch_RejectsWholeBatch(t *testing.T) {
+	r := New(WithGlobalIDs())
+	err := r.RegisterBatch([]Registration{
+		{"echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"}},
+		{"echo", Instance{ID: "inst-2"}},
+		{"users", Instance{ID: "inst-1", Addr: "http://localhost:8083"}},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a BatchError, got %v", err)
+	}
+	if batchErr.Items[0] != nil {
+		t.Errorf("item 0: expected no error, got %v", batchErr.Items[0])
+	}
+	if !errors.Is(batchErr.Items[1], ErrInvalidInstance) {
+		t.Errorf("item 1: expected ErrInvalidInstance, got %v", batchErr.Items[1])
+	}
+	if !errors.Is(batchErr.Items[2], ErrDuplicateID) {
+		t.Errorf("item 2: expected ErrDuplicateID, got %v", batchErr.Items[2])
+	}
+	if !errors.Is(err, ErrInvalidInstance) {
+		t.Error("expected errors.Is to see through the BatchError")
+	}
+	if len(r.ListServices()) != 0 {
+		t.Error("expected nothing to be registered")
+	}
+}
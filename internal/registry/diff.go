@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Snapshot is the full set of instances per service.
+type Snapshot map[string][]Instance
+
+// Snapshot returns a copy of every registered service and its instances.
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snap := make(Snapshot, len(r.services))
+	for name, instances := range r.services {
+		if len(instances) == 0 {
+			continue
+		}
+		snap[name] = append([]Instance(nil), instances...)
+	}
+	return snap
+}
+
+// Change describes one instance that differs between two snapshots. Old is
+// nil for additions and New is nil for removals.
+type Change struct {
+	Service string    `json:"service"`
+	ID      string    `json:"id"`
+	Old     *Instance `json:"old,omitempty"`
+	New     *Instance `json:"new,omitempty"`
+}
+
+// Diff is the result of comparing a proposed snapshot against the current one.
+type Diff struct {
+	Added   []Change `json:"added"`
+	Removed []Change `json:"removed"`
+	Changed []Change `json:"changed"`
+	Errors  []string `json:"errors"` // Invalid proposed entries; they are left out of the diff
+}
+
+// Compare reports what would change if current were replaced by proposed.
+// Proposed entries that fail Validate, or repeat an ID within a service, are
+// reported in Errors and otherwise ignored. Results are sorted by service
+// and ID.
+func Compare(current, proposed Snapshot) Diff {
+	d := Diff{Added: []Change{}, Removed: []Change{}, Changed: []Change{}, Errors: []string{}}
+
+	valid := make(map[string]map[string]Instance, len(proposed))
+	for _, service := range sortedServices(proposed) {
+		byID := make(map[string]Instance)
+		for _, inst := range proposed[service] {
+			if err := Validate(service, inst); err != nil {
+				d.Errors = append(d.Errors, fmt.Sprintf("%s/%s: %v", service, inst.ID, err))
+				continue
+			}
+			inst.Addr = normalizeAddr(inst.Addr)
+			if _, dup := byID[inst.ID]; dup {
+				d.Errors = append(d.Errors, fmt.Sprintf("%s/%s: duplicate id", service, inst.ID))
+				continue
+			}
+			byID[inst.ID] = inst
+		}
+		valid[service] = byID
+	}
+
+	for _, service := range sortedServices(current) {
+		for _, old := range current[service] {
+			old := old
+			next, ok := valid[service][old.ID]
+			switch {
+			case !ok:
+				d.Removed = append(d.Removed, Change{Service: service, ID: old.ID, Old: &old})
+			case !sameInstance(old, next):
+				d.Changed = append(d.Changed, Change{Service: service, ID: old.ID, Old: &old, New: &next})
+			}
+		}
+	}
+	for service, byID := range valid {
+		for id, next := range byID {
+			next := next
+			if find(current[service], id) < 0 {
+				d.Added = append(d.Added, Change{Service: service, ID: id, New: &next})
+			}
+		}
+	}
+
+	sortChanges(d.Added)
+	sortChanges(d.Removed)
+	sortChanges(d.Changed)
+	return d
+}
+
+func sameInstance(a, b Instance) bool {
+	if a.Addr != b.Addr || a.Weight != b.Weight || a.Zone != b.Zone ||
+		a.MaxConcurrency != b.MaxConcurrency || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	return a.HasTags(b.Tags)
+}
+
+func find(instances []Instance, id string) int {
+	for i, inst := range instances {
+		if inst.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func sortedServices(s Snapshot) []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Service != changes[j].Service {
+			return changes[i].Service < changes[j].Service
+		}
+		return changes[i].ID < changes[j].ID
+	})
+}
@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	current := Snapshot{
+		"echo": {
+			{ID: "1", Addr: "http://a:1", Weight: 1},
+			{ID: "2", Addr: "http://a:2", Weight: 1},
+			{ID: "3", Addr: "http://a:3", Tags: map[string]string{"region": "eu"}},
+		},
+		"old": {{ID: "1", Addr: "http://old:1"}},
+	}
+	proposed := Snapshot{
+		"echo": {
+			{ID: "1", Addr: "http://a:1", Weight: 1},                               // unchanged
+			{ID: "2", Addr: "http://a:2", Weight: 5},                               // weight change
+			{ID: "3", Addr: "http://a:3", Tags: map[string]string{"region": "us"}}, // tag change
+			{ID: "4", Addr: "http://a:4"},                                          // added
+			{ID: "5", Addr: "http://bad host"},                                     // invalid
+			{ID: "4", Addr: "http://a:44"},                                         // duplicate
+		},
+		"new": {{ID: "1", Addr: "http://new:1"}, {ID: "2", Weight: -1, Addr: "http://new:2"}},
+	}
+
+	d := Compare(current, proposed)
+
+	ids := func(changes []Change) string {
+		var parts []string
+		for _, c := range changes {
+			parts = append(parts, c.Service+"/"+c.ID)
+		}
+		return strings.Join(parts, ",")
+	}
+	if got := ids(d.Added); got != "echo/4,new/1" {
+		t.Errorf("Added = %s", got)
+	}
+	if got := ids(d.Removed); got != "old/1" {
+		t.Errorf("Removed = %s", got)
+	}
+	if got := ids(d.Changed); got != "echo/2,echo/3" {
+		t.Errorf("Changed = %s", got)
+	}
+	if c := d.Changed[0]; c.Old.Weight != 1 || c.New.Weight != 5 {
+		t.Errorf("expected weight 1 -> 5, got %d -> %d", c.Old.Weight, c.New.Weight)
+	}
+	if d.Added[0].New.Addr != "http://a:4" {
+		t.Errorf("expected the first of duplicate entries to win, got %s", d.Added[0].New.Addr)
+	}
+	if len(d.Errors) != 3 {
+		t.Fatalf("expected 3 errors (bad addr, duplicate, negative weight), got %v", d.Errors)
+	}
+	for i, prefix := range []string{"echo/5:", "echo/4: duplicate", "new/2:"} {
+		if !strings.HasPrefix(d.Errors[i], prefix) {
+			t.Errorf("Errors[%d] = %q, want prefix %q", i, d.Errors[i], prefix)
+		}
+	}
+}
+
+func TestCompare_DoesNotTouchRegistry(t *testing.T) {
+	r := New()
+	r.Register("echo", Instance{ID: "1", Addr: "http://a:1"})
+
+	d := Compare(r.Snapshot(), Snapshot{})
+	if len(d.Removed) != 1 {
+		t.Fatalf("expected 1 removal, got %+v", d)
+	}
+	if len(r.GetInstances("echo")) != 1 {
+		t.Error("Compare must not modify the registry")
+	}
+}
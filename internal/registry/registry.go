@@ -1,14 +1,59 @@
 package registry
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"kerberos/internal/clock"
 )
 
+// ErrInvalidInstance is returned for registrations that fail validation.
+var ErrInvalidInstance = errors.New("invalid instance")
+
+// ErrDuplicateID is returned by Register in global-ID mode when the instance
+// ID is already used by another service.
+var ErrDuplicateID = errors.New("instance id already registered")
+
 // Instance represents a single instance of a service.
 type Instance struct {
-	ID     string // Unique instance identifier
-	Addr   string // Address (e.g., "http://localhost:8081")
-	Weight int    // Optional. >= 1 enables weighted LB; < 1 or 0 falls back to unweighted
+	ID     string            `json:"id"`               // Unique instance identifier
+	Addr   string            `json:"addr"`             // Address (e.g., "http://localhost:8081")
+	Weight int               `json:"weight,omitempty"` // Optional. >= 1 enables weighted LB; < 1 or 0 falls back to unweighted
+	Tags   map[string]string `json:"tags,omitempty"`   // Optional labels (e.g. "region": "eu") used by route constraints
+	Zone   string            `json:"zone,omitempty"`   // Optional availability zone, e.g. "eu-west-1a", for zone-aware balancing
+
+	// MaxConcurrency optionally caps the requests in flight to the instance
+	// at once; the balancer passes it over while it is at the cap. 0 leaves
+	// it to the balancer's default limit, if any.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// Draining instances get no new requests but stay registered until the
+	// ones in flight are done. Set by Drain; registering again clears it.
+	Draining bool `json:"draining,omitempty"`
+
+	// Unhealthy instances get no requests until marked healthy again, e.g.
+	// while their circuit breaker is open. Set by SetHealthyAddr;
+	// registering again keeps it unless the address changes.
+	Unhealthy bool `json:"unhealthy,omitempty"`
+
+	// RegisteredAt is when the instance was first registered; registering
+	// it again keeps the time. Set by the registry.
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// HasTags reports whether the instance carries every key/value in tags.
+func (i Instance) HasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if i.Tags[k] != v {
+			return false
+		}
+	}
+	return true
 }
 
 // Service represents a named service with one or more instances.
@@ -19,31 +64,165 @@ type Service struct {
 
 // Registry holds registered services and their instances.
 type Registry struct {
-	mu       sync.RWMutex
-	services map[string][]Instance
+	mu        sync.RWMutex
+	services  map[string][]Instance
+	globalIDs bool
+	watchers  map[chan Event]struct{} // guarded by mu
+	dropped   atomic.Uint64
+	leases    map[string]lease // service/id -> TTL registration, guarded by mu
+	clock     clock.Clock
+}
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithGlobalIDs makes instance IDs unique across all services rather than
+// per service, so reusing an ID under another service is rejected.
+func WithGlobalIDs() Option {
+	return func(r *Registry) {
+		r.globalIDs = true
+	}
+}
+
+// WithClock replaces the wall clock for TTL bookkeeping, e.g. in tests.
+func WithClock(c clock.Clock) Option {
+	return func(r *Registry) {
+		r.clock = c
+	}
 }
 
 // New creates a new service registry.
-func New() *Registry {
-	return &Registry{
+func New(opts ...Option) *Registry {
+	r := &Registry{
 		services: make(map[string][]Instance),
+		watchers: make(map[chan Event]struct{}),
+		leases:   make(map[string]lease),
+		clock:    clock.Real,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 // Register adds or updates an instance for a service.
 // If the instance ID already exists, it replaces the address.
-func (r *Registry) Register(serviceName string, instance Instance) {
+// In global-ID mode it returns ErrDuplicateID if another service uses the ID.
+func (r *Registry) Register(serviceName string, instance Instance) error {
+	return r.RegisterWithTTL(serviceName, instance, 0)
+}
+
+// RegisterWithTTL is like Register, but unless ttl is 0 the instance is
+// removed by Reap once it has not been renewed for longer than ttl.
+func (r *Registry) RegisterWithTTL(serviceName string, instance Instance, ttl time.Duration) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.globalIDs {
+		if owner := r.ownerOf(instance.ID); owner != "" && owner != serviceName {
+			return fmt.Errorf("%w: %q is used by service %q", ErrDuplicateID, instance.ID, owner)
+		}
+	}
+	r.register(serviceName, instance)
+	if ttl > 0 {
+		r.leases[leaseKey(serviceName, instance.ID)] = lease{ttl: ttl, lastSeen: r.clock.Now()}
+	}
+	return nil
+}
+
+// register adds or replaces an instance, without a TTL. Caller must hold r.mu.
+func (r *Registry) register(serviceName string, instance Instance) {
+	instance.Addr = normalizeAddr(instance.Addr)
+	delete(r.leases, leaseKey(serviceName, instance.ID))
 	instances := r.services[serviceName]
 	for i, inst := range instances {
 		if inst.ID == instance.ID {
+			instance.RegisteredAt = inst.RegisteredAt
+			if instance.Addr == inst.Addr {
+				// Health is tracked per address, e.g. by its breaker.
+				instance.Unhealthy = inst.Unhealthy
+			}
 			instances[i] = instance
+			r.notify(Updated, serviceName, instance)
 			return
 		}
 	}
+	instance.RegisteredAt = r.clock.Now()
 	r.services[serviceName] = append(instances, instance)
+	r.notify(Registered, serviceName, instance)
+}
+
+// Validate checks a registration the same way the /register endpoint does:
+// service, ID and a parseable http(s):// or ws(s):// address with a host, or
+// a unix:// socket path, are required, and the weight must not be negative.
+// An address without a scheme is taken as http.
+func Validate(serviceName string, instance Instance) error {
+	if serviceName == "" || instance.ID == "" || instance.Addr == "" {
+		return fmt.Errorf("%w: service, id, and addr are required", ErrInvalidInstance)
+	}
+	addr := instance.Addr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr // the forwarder assumes http when no scheme is given
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("%w: addr %q: %v", ErrInvalidInstance, instance.Addr, err)
+	}
+	switch {
+	case u.Scheme == "unix":
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return fmt.Errorf("%w: addr %q must name an absolute socket path, e.g. unix:///var/run/svc.sock", ErrInvalidInstance, instance.Addr)
+		}
+	case !supportedSchemes[u.Scheme]:
+		return fmt.Errorf("%w: addr %q has unsupported scheme %q; use http, https, ws, wss or unix", ErrInvalidInstance, instance.Addr, u.Scheme)
+	case u.Hostname() == "":
+		return fmt.Errorf("%w: addr %q has no host", ErrInvalidInstance, instance.Addr)
+	case u.RawQuery != "" || u.Fragment != "":
+		// Requests carry their own query; this one would be dropped.
+		return fmt.Errorf("%w: addr %q must not have a query or fragment", ErrInvalidInstance, instance.Addr)
+	}
+	if instance.Weight < 0 {
+		return fmt.Errorf("%w: weight %d is negative", ErrInvalidInstance, instance.Weight)
+	}
+	if instance.MaxConcurrency < 0 {
+		return fmt.Errorf("%w: max_concurrency %d is negative", ErrInvalidInstance, instance.MaxConcurrency)
+	}
+	return nil
+}
+
+// supportedSchemes lists the address schemes instances can be reached over,
+// besides unix.
+var supportedSchemes = map[string]bool{"http": true, "https": true, "ws": true, "wss": true}
+
+// normalizeAddr returns addr without trailing slashes, so "http://a:8081/"
+// and "http://a:8081" name the same instance.
+func normalizeAddr(addr string) string {
+	for strings.HasSuffix(addr, "/") && !strings.HasSuffix(addr, "://") {
+		addr = addr[:len(addr)-1]
+	}
+	return addr
+}
+
+// RegisterValidated validates the instance and registers it. Invalid
+// instances are rejected with an error wrapping ErrInvalidInstance.
+func (r *Registry) RegisterValidated(serviceName string, instance Instance) error {
+	if err := Validate(serviceName, instance); err != nil {
+		return err
+	}
+	return r.Register(serviceName, instance)
+}
+
+// ownerOf returns the service holding an instance with the given ID, or "".
+// Caller must hold r.mu.
+func (r *Registry) ownerOf(id string) string {
+	for name, instances := range r.services {
+		for _, inst := range instances {
+			if inst.ID == id {
+				return name
+			}
+		}
+	}
+	return ""
 }
 
 // Unregister removes an instance from a service.
@@ -51,15 +230,102 @@ func (r *Registry) Unregister(serviceName string, instanceID string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	instances := r.services[serviceName]
-	for i, inst := range instances {
+	for i, inst := range r.services[serviceName] {
 		if inst.ID == instanceID {
-			r.services[serviceName] = append(instances[:i], instances[i+1:]...)
+			r.removeAt(serviceName, i)
 			return
 		}
 	}
 }
 
+// UnregisterService removes every instance of a service and returns how many
+// it removed. Unknown services are left alone.
+func (r *Registry) UnregisterService(serviceName string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.services[serviceName])
+	for i := n - 1; i >= 0; i-- {
+		r.removeAt(serviceName, i)
+	}
+	delete(r.services, serviceName)
+	return n
+}
+
+// removeAt removes the i-th instance of a service. Caller must hold r.mu.
+func (r *Registry) removeAt(serviceName string, i int) {
+	instances := r.services[serviceName]
+	inst := instances[i]
+	r.services[serviceName] = append(instances[:i], instances[i+1:]...)
+	delete(r.leases, leaseKey(serviceName, inst.ID))
+	r.notify(Unregistered, serviceName, inst)
+}
+
+// Drain marks an instance as draining, so it is no longer selected for new
+// requests while GetInstances still reports it. It returns false if the
+// instance is not registered.
+func (r *Registry) Drain(serviceName string, instanceID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, inst := range r.services[serviceName] {
+		if inst.ID == instanceID {
+			r.services[serviceName][i].Draining = true
+			r.notify(Updated, serviceName, r.services[serviceName][i])
+			return true
+		}
+	}
+	return false
+}
+
+// SetWeight changes the weight of a registered instance, e.g. to shift traffic
+// to a canary gradually, and keeps everything else about it, including its
+// TTL. It returns false if the instance is not registered.
+func (r *Registry) SetWeight(serviceName string, instanceID string, weight int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := find(r.services[serviceName], instanceID)
+	if i < 0 {
+		return false
+	}
+	r.services[serviceName][i].Weight = weight
+	r.notify(Updated, serviceName, r.services[serviceName][i])
+	return true
+}
+
+// SetHealthyAddr marks every instance registered with addr, under any
+// service, healthy or unhealthy. It fits circuitbreaker.Settings.OnHealthChange,
+// whose targets are instance addresses.
+func (r *Registry) SetHealthyAddr(addr string, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for service, instances := range r.services {
+		for i := range instances {
+			if instances[i].Addr == addr && instances[i].Unhealthy == healthy {
+				instances[i].Unhealthy = !healthy
+				r.notify(Updated, service, instances[i])
+			}
+		}
+	}
+}
+
+// FinishDrain unregisters an instance if it is still draining, and reports
+// whether it did. An instance registered again meanwhile is kept.
+func (r *Registry) FinishDrain(serviceName string, instanceID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, inst := range r.services[serviceName] {
+		if inst.ID == instanceID && inst.Draining {
+			r.removeAt(serviceName, i)
+			return true
+		}
+	}
+	return false
+}
+
 // GetInstances returns all instances for a service, or nil if not found.
 func (r *Registry) GetInstances(serviceName string) []Instance {
 	r.mu.RLock()
@@ -75,6 +341,17 @@ func (r *Registry) GetInstances(serviceName string) []Instance {
 	return result
 }
 
+// Known reports whether a service has been registered, even if every one of
+// its instances has since been unregistered or has expired. A service removed
+// with UnregisterService is forgotten.
+func (r *Registry) Known(serviceName string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.services[serviceName]
+	return ok
+}
+
 // ListServices returns the names of all registered services.
 func (r *Registry) ListServices() []string {
 	r.mu.RLock()
@@ -1,7 +1,11 @@
 package registry
 
 import (
+	"errors"
 	"testing"
+	"time"
+
+	"kerberos/internal/clock"
 )
 
 func TestRegistry_Register_GetInstances(t *testing.T) {
@@ -68,6 +72,33 @@ func TestRegistry_Unregister(t *testing.T) {
 	}
 }
 
+func TestRegistry_UnregisterService(t *testing.T) {
+	r := New()
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+	r.Register("echo", Instance{ID: "inst-2", Addr: "http://localhost:8082"})
+	r.Register("other", Instance{ID: "inst-1", Addr: "http://localhost:8083"})
+	events, cancel := r.Watch()
+	defer cancel()
+
+	if n := r.UnregisterService("echo"); n != 2 {
+		t.Errorf("expected 2 instances removed, got %d", n)
+	}
+	if r.GetInstances("echo") != nil || len(r.GetInstances("other")) != 1 {
+		t.Error("expected only the cleared service to lose its instances")
+	}
+	if services := r.ListServices(); len(services) != 1 || services[0] != "other" {
+		t.Errorf("expected the cleared service to be unlisted, got %v", services)
+	}
+	for i := 0; i < 2; i++ {
+		if e := <-events; e.Kind != Unregistered || e.Service != "echo" {
+			t.Errorf("expected an Unregistered event for echo, got %+v", e)
+		}
+	}
+	if n := r.UnregisterService("nonexistent"); n != 0 {
+		t.Errorf("expected nothing removed for an unknown service, got %d", n)
+	}
+}
+
 func TestRegistry_Unregister_UnknownInstanceNoOp(t *testing.T) {
 	r := New()
 
@@ -102,3 +133,171 @@ func TestRegistry_ListServices(t *testing.T) {
 		t.Errorf("expected echo and users, got %v", names)
 	}
 }
+
+func TestRegistry_Register_SameIDAcrossServicesAllowedByDefault(t *testing.T) {
+	r := New()
+
+	if err := r.Register("echo", Instance{ID: "inst-1", Addr: "http://a"}); err != nil {
+		t.Fatalf("Register echo: %v", err)
+	}
+	if err := r.Register("users", Instance{ID: "inst-1", Addr: "http://b"}); err != nil {
+		t.Fatalf("Register users: %v", err)
+	}
+	if len(r.GetInstances("users")) != 1 {
+		t.Error("expected inst-1 registered under users")
+	}
+}
+
+func TestRegistry_Register_GlobalIDsRejectsReuse(t *testing.T) {
+	r := New(WithGlobalIDs())
+
+	if err := r.Register("echo", Instance{ID: "inst-1", Addr: "http://a"}); err != nil {
+		t.Fatalf("Register echo: %v", err)
+	}
+	err := r.Register("users", Instance{ID: "inst-1", Addr: "http://b"})
+	if !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("expected ErrDuplicateID, got %v", err)
+	}
+	if r.GetInstances("users") != nil {
+		t.Error("rejected instance must not be registered")
+	}
+
+	// Re-registering under the owning service is still an update.
+	if err := r.Register("echo", Instance{ID: "inst-1", Addr: "http://c"}); err != nil {
+		t.Fatalf("update under owning service: %v", err)
+	}
+}
+
+func TestRegistry_RegisterValidated(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		instance Instance
+		wantErr  bool
+	}{
+		{"valid", "echo", Instance{ID: "1", Addr: "http://localhost:8081"}, false},
+		{"valid without scheme", "echo", Instance{ID: "2", Addr: "localhost:8082"}, false},
+		{"missing service", "", Instance{ID: "1", Addr: "http://a"}, true},
+		{"missing id", "echo", Instance{Addr: "http://a"}, true},
+		{"missing addr", "echo", Instance{ID: "1"}, true},
+		{"unparseable addr", "echo", Instance{ID: "1", Addr: "http://bad host"}, true},
+		{"addr without host", "echo", Instance{ID: "1", Addr: "http://"}, true},
+		{"addr with port but no host", "echo", Instance{ID: "1", Addr: "http://:8081"}, true},
+		{"unsupported scheme", "echo", Instance{ID: "1", Addr: "ftp://localhost:21"}, true},
+		{"addr with query", "echo", Instance{ID: "1", Addr: "http://a/?x=1"}, true},
+		{"valid with base path", "echo", Instance{ID: "4", Addr: "https://a:8443/api/"}, false},
+		{"negative weight", "echo", Instance{ID: "1", Addr: "http://a", Weight: -1}, true},
+		{"unix socket", "echo", Instance{ID: "3", Addr: "unix:///var/run/echo.sock"}, false},
+		{"relative unix socket", "echo", Instance{ID: "1", Addr: "unix://echo.sock"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New()
+			err := r.RegisterValidated(tt.service, tt.instance)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidInstance) {
+					t.Fatalf("expected ErrInvalidInstance, got %v", err)
+				}
+				if len(r.ListServices()) != 0 {
+					t.Error("invalid instance must not be registered")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterValidated: %v", err)
+			}
+			if len(r.GetInstances(tt.service)) != 1 {
+				t.Error("expected instance to be registered")
+			}
+		})
+	}
+}
+
+func TestRegistry_Drain(t *testing.T) {
+	r := New()
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+
+	if r.Drain("echo", "nonexistent") {
+		t.Error("expected Drain of an unknown instance to report false")
+	}
+	if !r.Drain("echo", "inst-1") {
+		t.Fatal("expected Drain to find the instance")
+	}
+	instances := r.GetInstances("echo")
+	if len(instances) != 1 || !instances[0].Draining {
+		t.Fatalf("expected the draining instance to be reported, got %+v", instances)
+	}
+
+	// Registering again cancels the drain.
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+	if r.FinishDrain("echo", "inst-1") {
+		t.Error("expected a re-registered instance to be kept")
+	}
+
+	r.Drain("echo", "inst-1")
+	if !r.FinishDrain("echo", "inst-1") {
+		t.Error("expected FinishDrain to unregister the draining instance")
+	}
+	if r.GetInstances("echo") != nil {
+		t.Error("expected no instances after FinishDrain")
+	}
+}
+
+func TestRegistry_SetWeight(t *testing.T) {
+	clk := clock.NewManual(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := New(WithClock(clk))
+	r.RegisterWithTTL("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081", Weight: 1, Tags: map[string]string{"track": "canary"}}, 10*time.Second)
+	events, cancel := r.Watch()
+	defer cancel()
+
+	if r.SetWeight("echo", "nonexistent", 5) {
+		t.Error("expected SetWeight of an unknown instance to report false")
+	}
+	if !r.SetWeight("echo", "inst-1", 5) {
+		t.Fatal("expected SetWeight to find the instance")
+	}
+	instances := r.GetInstances("echo")
+	if len(instances) != 1 || instances[0].Weight != 5 || instances[0].Tags["track"] != "canary" {
+		t.Fatalf("expected only the weight to change, got %+v", instances)
+	}
+	if e := <-events; e.Kind != Updated || e.Instance.Weight != 5 {
+		t.Errorf("expected an Updated event with the new weight, got %+v", e)
+	}
+
+	// Unlike registering again, changing the weight keeps the TTL.
+	clk.Advance(11 * time.Second)
+	if n := r.Reap(); n != 1 {
+		t.Errorf("expected the instance to keep its TTL, reaped %d", n)
+	}
+}
+
+func TestRegistry_Known(t *testing.T) {
+	r := New()
+	if r.Known("echo") {
+		t.Error("expected a service never registered to be unknown")
+	}
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+	r.Unregister("echo", "inst-1")
+	if !r.Known("echo") {
+		t.Error("expected a service to stay known after its last instance is unregistered")
+	}
+	r.UnregisterService("echo")
+	if r.Known("echo") {
+		t.Error("expected UnregisterService to forget the service")
+	}
+}
+
+func TestRegistry_Register_KeepsUnhealthy(t *testing.T) {
+	r := New()
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+	r.SetHealthyAddr("http://localhost:8081", false)
+
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+	if !r.GetInstances("echo")[0].Unhealthy {
+		t.Error("expected registering again to keep the instance unhealthy")
+	}
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8082"})
+	if r.GetInstances("echo")[0].Unhealthy {
+		t.Error("expected a new address to clear the mark")
+	}
+}
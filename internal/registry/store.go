@@ -0,0 +1,61 @@
+package registry
+
+import "reflect"
+
+// Store is what the balancer and gateway need of a service registry. The
+// in-memory *Registry is one; implementations backed by etcd or Consul let
+// several gateways share their registrations. GetInstances must return a copy
+// the caller may keep, and Watch must deliver an Event for every change until
+// its cancel function is called.
+//
+// The gateway uses further methods of *Registry, such as Drain, SetWeight or
+// RegisterWithTTL, when a Store has them with the same signatures, and
+// answers the endpoints needing them with 501 Not Implemented otherwise.
+type Store interface {
+	Register(serviceName string, instance Instance) error
+	Unregister(serviceName string, instanceID string)
+	GetInstances(serviceName string) []Instance
+	ListServices() []string
+	Watch() (<-chan Event, func())
+}
+
+var _ Store = (*Registry)(nil)
+
+// StoreOrNil returns s, or a nil Store if s holds a nil pointer such as a nil
+// *Registry, so that a missing store can be told by comparing with nil.
+func StoreOrNil(s Store) Store {
+	if v := reflect.ValueOf(s); v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil
+	}
+	return s
+}
+
+// Known reports whether s knows the service, even without instances, using
+// s's own Known method if it has one. Otherwise a service is known while
+// ListServices reports it.
+func Known(s Store, serviceName string) bool {
+	if k, ok := s.(interface{ Known(serviceName string) bool }); ok {
+		return k.Known(serviceName)
+	}
+	for _, name := range s.ListServices() {
+		if name == serviceName {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotOf returns a copy of every service in s and its instances, using
+// s's own Snapshot method if it has one.
+func SnapshotOf(s Store) Snapshot {
+	if r, ok := s.(interface{ Snapshot() Snapshot }); ok {
+		return r.Snapshot()
+	}
+	snap := make(Snapshot)
+	for _, name := range s.ListServices() {
+		if instances := s.GetInstances(name); len(instances) > 0 {
+			snap[name] = instances
+		}
+	}
+	return snap
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"context"
+	"time"
+)
+
+// lease tracks an instance registered with a TTL.
+type lease struct {
+	ttl      time.Duration
+	lastSeen time.Time
+}
+
+func leaseKey(serviceName, instanceID string) string {
+	return serviceName + "/" + instanceID
+}
+
+// Renew records a heartbeat for an instance, restarting its TTL. It returns
+// false if the instance is not registered. Instances without a TTL are
+// accepted but unaffected.
+func (r *Registry) Renew(serviceName string, instanceID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if find(r.services[serviceName], instanceID) < 0 {
+		return false
+	}
+	key := leaseKey(serviceName, instanceID)
+	if l, ok := r.leases[key]; ok {
+		l.lastSeen = r.clock.Now()
+		r.leases[key] = l
+	}
+	return true
+}
+
+// Reap unregisters every instance whose TTL has passed since it was
+// registered or last renewed, and returns how many it removed.
+func (r *Registry) Reap() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	reaped := 0
+	for serviceName := range r.services {
+		for i := len(r.services[serviceName]) - 1; i >= 0; i-- {
+			l, ok := r.leases[leaseKey(serviceName, r.services[serviceName][i].ID)]
+			if ok && now.Sub(l.lastSeen) > l.ttl {
+				r.removeAt(serviceName, i)
+				reaped++
+			}
+		}
+	}
+	return reaped
+}
+
+// StartReaper calls Reap every interval in the background until the returned
+// func is called.
+func (r *Registry) StartReaper(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.reapEvery(ctx, interval, r.clock.After(interval))
+	return cancel
+}
+
+// RunReaper calls Reap every interval until ctx is done.
+func (r *Registry) RunReaper(ctx context.Context, interval time.Duration) {
+	r.reapEvery(ctx, interval, r.clock.After(interval))
+}
+
+func (r *Registry) reapEvery(ctx context.Context, interval time.Duration, tick <-chan time.Time) {
+	for {
+		select {
+		case <-tick:
+			r.Reap()
+			tick = r.clock.After(interval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"kerberos/internal/clock"
+)
+
+func TestRegistry_Reap(t *testing.T) {
+	clk := clock.NewManual(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := New(WithClock(clk))
+
+	r.RegisterWithTTL("echo", Instance{ID: "silent", Addr: "http://localhost:8081"}, 10*time.Second)
+	r.RegisterWithTTL("echo", Instance{ID: "renewed", Addr: "http://localhost:8082"}, 10*time.Second)
+	r.Register("echo", Instance{ID: "static", Addr: "http://localhost:8083"})
+
+	clk.Advance(6 * time.Second)
+	if !r.Renew("echo", "renewed") {
+		t.Fatal("expected Renew to find the instance")
+	}
+	if r.Renew("echo", "nonexistent") {
+		t.Error("expected Renew of an unknown instance to report false")
+	}
+	if n := r.Reap(); n != 0 {
+		t.Fatalf("expected nothing reaped within the TTL, got %d", n)
+	}
+
+	clk.Advance(6 * time.Second)
+	if n := r.Reap(); n != 1 {
+		t.Fatalf("expected 1 instance reaped, got %d", n)
+	}
+	ids := make(map[string]bool)
+	for _, inst := range r.GetInstances("echo") {
+		ids[inst.ID] = true
+	}
+	if ids["silent"] || !ids["renewed"] || !ids["static"] {
+		t.Errorf("expected only the un-renewed instance to be reaped, left %v", ids)
+	}
+
+	// Registering again without a TTL makes the instance permanent.
+	r.Register("echo", Instance{ID: "renewed", Addr: "http://localhost:8082"})
+	clk.Advance(time.Hour)
+	if n := r.Reap(); n != 0 {
+		t.Errorf("expected instances without a TTL to stay, reaped %d", n)
+	}
+}
+
+func TestRegistry_StartReaper(t *testing.T) {
+	clk := clock.NewManual(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := New(WithClock(clk))
+	r.RegisterWithTTL("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"}, 10*time.Second)
+
+	events, cancel := r.Watch()
+	defer cancel()
+	stop := r.StartReaper(time.Second)
+	defer stop()
+
+	clk.Advance(11 * time.Second)
+	ev := <-events
+	if ev.Kind != Unregistered || ev.Instance.ID != "inst-1" {
+		t.Fatalf("expected inst-1 to be reaped, got %+v", ev)
+	}
+	if got := r.GetInstances("echo"); len(got) != 0 {
+		t.Errorf("expected no instances left, got %v", got)
+	}
+}
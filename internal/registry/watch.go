@@ -0,0 +1,73 @@
+package registry
+
+// EventKind says how an instance changed.
+type EventKind string
+
+const (
+	Registered   EventKind = "registered"   // A new instance was added
+	Unregistered EventKind = "unregistered" // The instance was removed
+	Updated      EventKind = "updated"      // An existing instance was registered again, started draining or changed weight
+)
+
+// Event describes one change to the registry. Instance is the instance as
+// it is after the change, or as it was before for Unregistered.
+type Event struct {
+	Kind     EventKind
+	Service  string
+	Instance Instance
+}
+
+// watchBuffer is how many events a watcher may fall behind before further
+// events are dropped for it.
+const watchBuffer = 64
+
+// Watch subscribes to registry changes. Events arrive in the order the
+// changes were made. Registry updates never wait for watchers: while a
+// watcher's buffer is full its events are dropped and counted in
+// DroppedEvents. The returned func ends the subscription and closes the
+// channel.
+func (r *Registry) Watch() (<-chan Event, func()) {
+	ch := make(chan Event, watchBuffer)
+	r.mu.Lock()
+	r.watchers[ch] = struct{}{}
+	r.mu.Unlock()
+
+	cancel := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if _, ok := r.watchers[ch]; ok {
+			delete(r.watchers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// CloseWatches ends every current subscription, closing its channel, e.g.
+// when shutting down so watchers stop.
+func (r *Registry) CloseWatches() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ch := range r.watchers {
+		delete(r.watchers, ch)
+		close(ch)
+	}
+}
+
+// DroppedEvents returns how many events were dropped because a watcher was
+// not keeping up.
+func (r *Registry) DroppedEvents() uint64 {
+	return r.dropped.Load()
+}
+
+// notify delivers an event to every watcher. Caller must hold r.mu.
+func (r *Registry) notify(kind EventKind, service string, inst Instance) {
+	e := Event{Kind: kind, Service: service, Instance: inst}
+	for ch := range r.watchers {
+		select {
+		case ch <- e:
+		default:
+			r.dropped.Add(1)
+		}
+	}
+}
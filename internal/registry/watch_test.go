@@ -0,0 +1,47 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegistry_Watch(t *testing.T) {
+	r := New()
+	events, cancel := r.Watch()
+
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:8081"})
+	r.Register("echo", Instance{ID: "inst-1", Addr: "http://localhost:9999"})
+	r.Unregister("echo", "nonexistent")
+	r.Unregister("echo", "inst-1")
+	cancel()
+
+	var got []string
+	for e := range events {
+		got = append(got, fmt.Sprintf("%s %s/%s %s", e.Kind, e.Service, e.Instance.ID, e.Instance.Addr))
+	}
+	want := []string{
+		"registered echo/inst-1 http://localhost:8081",
+		"updated echo/inst-1 http://localhost:9999",
+		"unregistered echo/inst-1 http://localhost:9999",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events:\ngot  %q\nwant %q", got, want)
+	}
+
+	// Cancelled watchers get nothing further; cancelling twice is harmless.
+	r.Register("echo", Instance{ID: "inst-2", Addr: "http://localhost:8082"})
+	cancel()
+}
+
+func TestRegistry_Watch_SlowConsumerDoesNotBlock(t *testing.T) {
+	r := New()
+	_, cancel := r.Watch()
+	defer cancel()
+
+	for i := 0; i < watchBuffer+10; i++ {
+		r.Register("echo", Instance{ID: fmt.Sprint(i), Addr: "http://localhost:8081"})
+	}
+	if got := r.DroppedEvents(); got != 10 {
+		t.Errorf("expected 10 dropped events, got %d", got)
+	}
+}
@@ -0,0 +1,98 @@
+package retry
+
+import (
+	"sync"
+	"time"
+
+	"kerberos/internal/clock"
+)
+
+// budgetWindow is how long deposits and withdrawals count against a Budget.
+const budgetWindow = 10 * time.Second
+
+// Budget bounds retries relative to traffic, so that during an outage
+// retries cannot multiply the load on struggling backends. Within any
+// 10-second window, retries may not exceed Ratio times the requests plus
+// MinPerSecond times 10. The zero Budget is unlimited.
+type Budget struct {
+	Ratio        float64 // Retries allowed per request, e.g. 0.2 adds at most 20% load
+	MinPerSecond float64 // Retries allowed per second regardless of traffic
+}
+
+// Enabled reports whether b limits retries.
+func (b Budget) Enabled() bool {
+	return b.Ratio > 0 || b.MinPerSecond > 0
+}
+
+// BudgetTracker enforces a Budget. It is safe for concurrent use.
+type BudgetTracker struct {
+	mu     sync.Mutex
+	budget Budget
+	clock  clock.Clock
+	slots  [10]budgetSlot // one per second of the window, guarded by mu
+}
+
+type budgetSlot struct {
+	second      int64 // unix second the slot counts for
+	deposits    float64
+	withdrawals int
+}
+
+// NewBudgetTracker creates a tracker for b. c may be nil to use the wall
+// clock.
+func NewBudgetTracker(b Budget, c clock.Clock) *BudgetTracker {
+	if c == nil {
+		c = clock.Real
+	}
+	return &BudgetTracker{budget: b, clock: c}
+}
+
+// Deposit records a request, earning Ratio retries.
+func (t *BudgetTracker) Deposit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slot().deposits += t.budget.Ratio
+}
+
+// Available reports whether a retry would currently be allowed, without
+// spending it.
+func (t *BudgetTracker) Available() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.balance() >= 1
+}
+
+// Withdraw spends a retry if the budget allows one.
+func (t *BudgetTracker) Withdraw() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.balance() < 1 {
+		return false
+	}
+	t.slot().withdrawals++
+	return true
+}
+
+// slot returns the slot for the current second, clearing what it held for
+// an earlier one. Caller must hold t.mu.
+func (t *BudgetTracker) slot() *budgetSlot {
+	now := t.clock.Now().Unix()
+	s := &t.slots[now%int64(len(t.slots))]
+	if s.second != now {
+		*s = budgetSlot{second: now}
+	}
+	return s
+}
+
+// balance returns the retries left in the current window. Caller must hold
+// t.mu.
+func (t *BudgetTracker) balance() float64 {
+	now := t.clock.Now().Unix()
+	balance := t.budget.MinPerSecond * budgetWindow.Seconds()
+	for _, s := range t.slots {
+		if s.second > now-int64(len(t.slots)) && s.second <= now {
+			balance += s.deposits - float64(s.withdrawals)
+		}
+	}
+	return balance
+}
@@ -2,16 +2,74 @@ package retry
 
 import (
 	"math"
+	"math/rand"
+	"net/http"
 	"time"
 )
 
+// Strategy selects how delays between retries grow.
+type Strategy string
+
+const (
+	// Exponential doubles the delay from InitialBackoff on every retry,
+	// randomized by Jitter if set (the default).
+	Exponential Strategy = "exponential"
+	// FullJitter picks each delay uniformly from zero up to the
+	// exponential delay, spreading out clients the most.
+	FullJitter Strategy = "full-jitter"
+	// DecorrelatedJitter picks each delay uniformly between InitialBackoff
+	// and three times the previous delay, so delays grow about as fast as
+	// exponential ones but independently per client.
+	DecorrelatedJitter Strategy = "decorrelated-jitter"
+)
+
 // Config for retry behavior.
 type Config struct {
 	MaxRetries    int           // Max retry attempts (0 = no retries)
 	InitialBackoff time.Duration // Initial backoff between retries
 	MaxBackoff    time.Duration // Max backoff cap
+
+	// Strategy selects how delays grow; empty means Exponential. Every
+	// delay is capped at MaxBackoff.
+	Strategy Strategy
+
+	// Jitter spreads each delay uniformly over base ± base*Jitter (0.0–1.0)
+	// so clients retrying a recovered backend don't synchronize. 0 keeps
+	// delays exact. Only applies to Exponential.
+	Jitter float64
+	// Rand returns values in [0, 1) for jitter; defaults to math/rand.
+	Rand func() float64
+
+	// RetryableStatusCodes lists response statuses (e.g. 502, 503, 504)
+	// that are retried like transport errors. When attempts run out the
+	// last response is returned as is.
+	RetryableStatusCodes []int
+
+	// IdempotentOnly restricts retries to idempotent methods (GET, HEAD,
+	// OPTIONS, TRACE, PUT, DELETE).
+	IdempotentOnly bool
+	// RetryIdempotencyKey, with IdempotentOnly, also retries requests that
+	// carry an Idempotency-Key header, since the backend deduplicates them.
+	RetryIdempotencyKey bool
+
+	// Budget caps retries relative to traffic; once it is spent, failed
+	// requests are not retried even if attempts remain. The zero Budget
+	// is unlimited.
+	Budget Budget
+
+	// Deadline bounds the whole sequence of attempts for a request,
+	// backoffs included, in addition to the request's own deadline, e.g.
+	// from a route timeout. A retry is only made if, after its backoff, at
+	// least MinAttempt is left before the earlier of the two, so a caller
+	// gets the last error in time instead of a retry that cannot finish.
+	// Zero Deadline leaves just the request's deadline.
+	Deadline   time.Duration
+	MinAttempt time.Duration
 }
 
+// IdempotencyKeyHeader marks a request the backend deduplicates.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // DefaultConfig returns sensible defaults.
 func DefaultConfig() Config {
 	return Config{
@@ -23,13 +81,89 @@ func DefaultConfig() Config {
 
 // Backoff returns the delay for the given attempt (0-based).
 // Uses exponential backoff: initial * 2^attempt, capped at MaxBackoff.
+// With Jitter the delay is randomized around that value, still capped.
+// Other strategies randomize it as described for them; as Backoff does not
+// know the previous delay, DecorrelatedJitter assumes the exponential one.
+// Use Next to track the actual delays.
 func (c Config) Backoff(attempt int) time.Duration {
+	var prev time.Duration
+	if c.Strategy == DecorrelatedJitter && attempt > 1 {
+		prev = c.exponential(attempt - 1)
+	}
+	return c.Next(attempt, prev)
+}
+
+// Next returns the delay before the given retry, the one before it having
+// been prev (0 for the first retry). Only DecorrelatedJitter depends on
+// prev; for the other strategies Next is Backoff.
+func (c Config) Next(attempt int, prev time.Duration) time.Duration {
 	if attempt <= 0 {
 		return 0
 	}
+	var d time.Duration
+	switch c.Strategy {
+	case FullJitter:
+		d = time.Duration(c.random() * float64(c.exponential(attempt)))
+	case DecorrelatedJitter:
+		if prev < c.InitialBackoff {
+			prev = c.InitialBackoff
+		}
+		d = c.InitialBackoff + time.Duration(c.random()*float64(3*prev-c.InitialBackoff))
+	default:
+		d = c.exponential(attempt)
+		if c.Jitter > 0 {
+			jitter := math.Min(c.Jitter, 1)
+			d += time.Duration(float64(d) * jitter * (2*c.random() - 1))
+		}
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d
+}
+
+// exponential returns InitialBackoff * 2^(attempt-1), capped at MaxBackoff.
+func (c Config) exponential(attempt int) time.Duration {
 	d := c.InitialBackoff * time.Duration(math.Pow(2, float64(attempt-1)))
 	if d > c.MaxBackoff {
 		d = c.MaxBackoff
 	}
 	return d
 }
+
+// random returns a value in [0, 1) from Rand or math/rand.
+func (c Config) random() float64 {
+	if c.Rand != nil {
+		return c.Rand()
+	}
+	return rand.Float64()
+}
+
+// Fits reports whether a retry waiting backoff from now still leaves
+// MinAttempt before deadline. A zero deadline always fits.
+func (c Config) Fits(deadline, now time.Time, backoff time.Duration) bool {
+	return deadline.IsZero() || !now.Add(backoff+c.MinAttempt).After(deadline)
+}
+
+// Retryable reports whether req may be retried under c.
+func (c Config) Retryable(req *http.Request) bool {
+	if !c.IdempotentOnly {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return c.RetryIdempotencyKey && req.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// RetryableStatus reports whether a response with status code should be
+// retried.
+func (c Config) RetryableStatus(code int) bool {
+	for _, s := range c.RetryableStatusCodes {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
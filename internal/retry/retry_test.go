@@ -1,6 +1,9 @@
 package retry
 
 import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -24,3 +27,132 @@ func TestConfig_Backoff(t *testing.T) {
 		t.Errorf("Backoff(5): want capped at MaxBackoff, got %v", d)
 	}
 }
+
+func TestConfig_Retryable(t *testing.T) {
+	post := func(key string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return req
+	}
+	get := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		req  *http.Request
+		want bool
+	}{
+		{"all methods by default", Config{}, post(""), true},
+		{"idempotent method", Config{IdempotentOnly: true}, get, true},
+		{"post without key", Config{IdempotentOnly: true}, post(""), false},
+		{"post with key, option off", Config{IdempotentOnly: true}, post("abc"), false},
+		{"post with key", Config{IdempotentOnly: true, RetryIdempotencyKey: true}, post("abc"), true},
+		{"post without key, option on", Config{IdempotentOnly: true, RetryIdempotencyKey: true}, post(""), false},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.Retryable(tt.req); got != tt.want {
+			t.Errorf("%s: Retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_Backoff_Jitter(t *testing.T) {
+	src := rand.New(rand.NewSource(1))
+	cfg := Config{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Jitter:         0.5,
+		Rand:           src.Float64,
+	}
+
+	distinct := map[time.Duration]bool{}
+	for attempt := 1; attempt <= 6; attempt++ {
+		base := Config{InitialBackoff: cfg.InitialBackoff, MaxBackoff: cfg.MaxBackoff}.Backoff(attempt)
+		low, high := base/2, base+base/2
+		for i := 0; i < 100; i++ {
+			d := cfg.Backoff(attempt)
+			if d < low || d > high {
+				t.Fatalf("attempt %d: %v outside %v–%v", attempt, d, low, high)
+			}
+			if d > cfg.MaxBackoff {
+				t.Fatalf("attempt %d: %v exceeds MaxBackoff", attempt, d)
+			}
+			distinct[d] = true
+		}
+	}
+	if len(distinct) < 100 {
+		t.Errorf("expected jittered delays to vary, got %d distinct values", len(distinct))
+	}
+
+	if d := cfg.Backoff(0); d != 0 {
+		t.Errorf("Backoff(0): want 0, got %v", d)
+	}
+}
+
+func TestConfig_Next_Strategies(t *testing.T) {
+	const (
+		initial    = 100 * time.Millisecond
+		maxBackoff = 2 * time.Second
+	)
+	exponential := Config{InitialBackoff: initial, MaxBackoff: maxBackoff}
+
+	t.Run("full jitter", func(t *testing.T) {
+		src := rand.New(rand.NewSource(1))
+		cfg := Config{InitialBackoff: initial, MaxBackoff: maxBackoff, Strategy: FullJitter, Rand: src.Float64}
+		for attempt := 1; attempt <= 8; attempt++ {
+			high := exponential.Backoff(attempt)
+			var sum time.Duration
+			for i := 0; i < 200; i++ {
+				d := cfg.Next(attempt, 0)
+				if d < 0 || d > high {
+					t.Fatalf("attempt %d: %v outside 0–%v", attempt, d, high)
+				}
+				sum += d
+			}
+			// The mean of random(0, high) is high/2.
+			if mean := sum / 200; mean < high/3 || mean > 2*high/3 {
+				t.Errorf("attempt %d: mean %v far from %v", attempt, mean, high/2)
+			}
+		}
+	})
+
+	t.Run("decorrelated jitter", func(t *testing.T) {
+		src := rand.New(rand.NewSource(1))
+		cfg := Config{InitialBackoff: initial, MaxBackoff: maxBackoff, Strategy: DecorrelatedJitter, Rand: src.Float64}
+		reachedMax := false
+		for run := 0; run < 50; run++ {
+			var prev time.Duration
+			for attempt := 1; attempt <= 10; attempt++ {
+				d := cfg.Next(attempt, prev)
+				high := 3 * prev
+				if high < 3*initial {
+					high = 3 * initial
+				}
+				if high > maxBackoff {
+					high = maxBackoff
+				}
+				if d < initial || d > high {
+					t.Fatalf("attempt %d after %v: %v outside %v–%v", attempt, prev, d, initial, high)
+				}
+				reachedMax = reachedMax || d == maxBackoff
+				prev = d
+			}
+		}
+		if !reachedMax {
+			t.Error("expected delays to grow up to MaxBackoff")
+		}
+	})
+
+	t.Run("default is exponential", func(t *testing.T) {
+		for attempt := 1; attempt <= 6; attempt++ {
+			if d, want := exponential.Next(attempt, time.Hour), exponential.Backoff(attempt); d != want {
+				t.Errorf("attempt %d: got %v, want %v", attempt, d, want)
+			}
+		}
+		if d := exponential.Backoff(6); d != maxBackoff {
+			t.Errorf("expected Backoff(6) to be capped at %v, got %v", maxBackoff, d)
+		}
+	})
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -13,19 +16,53 @@ import (
 
 	"kerberos/internal/balancer"
 	"kerberos/internal/circuitbreaker"
+	"kerberos/internal/clientip"
 	"kerberos/internal/dispatcher"
 	"kerberos/internal/gateway"
+	"kerberos/internal/latency"
 	"kerberos/internal/registry"
 	"kerberos/internal/retry"
 )
 
 func main() {
 	reg := registry.New()
-	reg.Register("echo", registry.Instance{ID: "echo-1", Addr: "http://localhost:8081"})
-	reg.Register("echo", registry.Instance{ID: "echo-2", Addr: "http://localhost:8082"})
-
+	if err := registerStatic(reg, staticInstances); err != nil {
+		log.Fatalf("Startup registration: %v", err)
+	}
 	strategy := balancerStrategy()
-	b := balancer.New(strategy, reg)
+	clientIP, err := clientIPResolver()
+	if err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
+	balancerOpts := []balancer.Option{balancer.WithClientIP(clientIP), balancer.WithStrategies(serviceStrategies())}
+	if n, err := strconv.Atoi(os.Getenv("OUTLIER_CONSECUTIVE_FAILURES")); err == nil && n > 0 {
+		balancerOpts = append(balancerOpts, balancer.WithOutlierDetection(balancer.OutlierDetection{ConsecutiveFailures: n}))
+	}
+	if sec, err := strconv.Atoi(os.Getenv("SLOW_START")); err == nil && sec > 0 {
+		balancerOpts = append(balancerOpts, balancer.WithSlowStart(time.Duration(sec)*time.Second))
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_CONCURRENCY")); err == nil && n > 0 {
+		balancerOpts = append(balancerOpts, balancer.WithMaxConcurrency(n))
+	}
+	if zone := os.Getenv("LOCAL_ZONE"); zone != "" {
+		minLocal, _ := strconv.Atoi(os.Getenv("ZONE_MIN_LOCAL"))
+		balancerOpts = append(balancerOpts, balancer.ZoneAware(zone, minLocal))
+	}
+	if secret := os.Getenv("STICKY_COOKIE_SECRET"); secret != "" {
+		sticky := balancer.StickyCookieConfig{
+			Secret: []byte(secret),
+			Name:   os.Getenv("STICKY_COOKIE_NAME"),
+			Secure: os.Getenv("STICKY_COOKIE_SECURE") == "true",
+		}
+		if base := os.Getenv("STICKY_COOKIE_BASE"); base != "" {
+			sticky.Base = parseStrategy(base)
+		}
+		if sec, err := strconv.Atoi(os.Getenv("STICKY_COOKIE_MAX_AGE")); err == nil && sec > 0 {
+			sticky.MaxAge = time.Duration(sec) * time.Second
+		}
+		balancerOpts = append(balancerOpts, balancer.WithStickyCookie(sticky))
+	}
+	b := balancer.New(strategy, reg, balancerOpts...)
 
 	// HTTP client with timeout for forwarded requests
 	requestTimeout := requestTimeout()
@@ -34,8 +71,37 @@ func main() {
 	// Circuit breaker with retry
 	cbSettings := circuitbreaker.DefaultSettings()
 	cbSettings.Retry = retryConfig()
+	cbSettings.DialTimeout = dialTimeout()
+	cbSettings.Pool = connectionPool()
+	if n, err := strconv.ParseInt(os.Getenv("RETRY_MAX_BODY"), 10, 64); err == nil && n != 0 {
+		cbSettings.MaxRetryBody = n
+	}
+	if n, err := strconv.ParseUint(os.Getenv("FAIL_FAST_AFTER"), 10, 32); err == nil && n > 0 {
+		cbSettings.UnavailableAfter = uint32(n)
+	}
+	cbSettings.TLSConfig, err = backendTLSConfig()
+	if err != nil {
+		log.Fatalf("BACKEND_CA_FILE: %v", err)
+	}
+	if os.Getenv("BREAKER_DEREGISTER") == "true" {
+		cbSettings.OnHealthChange = reg.SetHealthyAddr
+	}
+	if codes := failureStatus(); len(codes) > 0 {
+		cbSettings.IsFailure = circuitbreaker.FailureStatus(codes...)
+	}
 	cb := circuitbreaker.New(httpClient, cbSettings)
-	disp := dispatcher.New(b, cb)
+	tracker := latency.NewTracker()
+	dispOpts := []dispatcher.Option{dispatcher.WithLatency(tracker), dispatcher.WithEjectInvalid(reg), dispatcher.WithUnknownServices(reg)}
+	if h := os.Getenv("LOAD_HEADER"); h != "" {
+		dispOpts = append(dispOpts, dispatcher.WithLoadHeader(h))
+	}
+	if os.Getenv("FAIL_FAST") == "true" {
+		dispOpts = append(dispOpts, dispatcher.WithFailFast())
+	}
+	if n, err := strconv.ParseInt(os.Getenv("CACHE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		dispOpts = append(dispOpts, dispatcher.WithCache(dispatcher.NewCache(n)))
+	}
+	disp := dispatcher.New(b, cb, dispOpts...)
 
 	// Route by path prefix: /echo/* -> echo service
 	route := func(r *http.Request) string {
@@ -45,12 +111,51 @@ func main() {
 		return ""
 	}
 
-	gw := gateway.New(gateway.Config{
+	cfg := gateway.Config{
 		Addr:       ":8080",
 		Registry:   reg,
 		Dispatcher: disp,
 		Route:      route,
-	})
+		Latency:    tracker,
+		ErrorLog:   log.Default(),
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+		Root:       rootConfig(),
+		RateLimit:  rateLimit(),
+		ClientIP:   clientIP,
+
+		MetricsEnabled: os.Getenv("METRICS") == "true",
+		Breakers:       cb,
+		ErrorMessage:   os.Getenv("ERROR_MESSAGE"),
+
+		CertFile: os.Getenv("TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("TLS_KEY_FILE"),
+	}
+	cfg.NormalizePaths = pathNormalization()
+	if os.Getenv("COMPRESSION") == "true" {
+		cfg.Compression = &gateway.Compression{}
+		if n, err := strconv.Atoi(os.Getenv("COMPRESSION_MIN_SIZE")); err == nil && n > 0 {
+			cfg.Compression.MinSize = n
+		}
+	}
+	if s := os.Getenv("CORS_ORIGINS"); s != "" {
+		cfg.CORS = &gateway.CORS{
+			AllowedOrigins: splitList(s),
+			AllowedMethods: splitList(os.Getenv("CORS_METHODS")),
+			AllowedHeaders: splitList(os.Getenv("CORS_HEADERS")),
+		}
+	}
+	if s := os.Getenv("RESPONSE_HEADERS_REMOVE"); s != "" {
+		cfg.ResponseHeaders.Remove = splitList(s)
+	}
+	if format, ok := accessLogFormat(); ok {
+		cfg.AccessLog = os.Stdout
+		cfg.AccessLogFormat = format
+	}
+	gw := gateway.New(cfg)
+	// Remove instances registered with a TTL that stopped sending heartbeats.
+	gw.Go(func(ctx context.Context) { reg.RunReaper(ctx, time.Second) })
+	// Forget the load and latency of instances once they are unregistered.
+	gw.Go(b.RunPruner)
 
 	log.Printf("Kerberos gateway listening on :8080 (strategy: %s, timeout: %v)", strategy, requestTimeout)
 
@@ -71,6 +176,7 @@ func main() {
 		if err := gw.Shutdown(ctx); err != nil {
 			log.Printf("Shutdown error: %v", err)
 		}
+		cb.Close()
 	case err := <-done:
 		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
@@ -78,8 +184,89 @@ func main() {
 	}
 }
 
+// staticInstance is an instance registered at startup.
+type staticInstance struct {
+	service  string
+	instance registry.Instance
+}
+
+// staticInstances are registered at startup, before the gateway accepts traffic.
+var staticInstances = []staticInstance{
+	{"echo", registry.Instance{ID: "echo-1", Addr: "http://localhost:8081"}},
+	{"echo", registry.Instance{ID: "echo-2", Addr: "http://localhost:8082"}},
+}
+
+// registerStatic registers instances through the same validation as
+// POST /register, stopping at the first invalid entry.
+func registerStatic(reg *registry.Registry, instances []staticInstance) error {
+	for _, s := range instances {
+		if err := reg.RegisterValidated(s.service, s.instance); err != nil {
+			return fmt.Errorf("service %q instance %q: %w", s.service, s.instance.ID, err)
+		}
+	}
+	return nil
+}
+
+// backendTLSConfig reads BACKEND_CA_FILE, a PEM file of certificates trusted
+// for https:// backends in addition to the system roots, and
+// BACKEND_TLS_INSECURE, which skips verification altogether. It returns nil
+// if neither is set.
+func backendTLSConfig() (*tls.Config, error) {
+	file := os.Getenv("BACKEND_CA_FILE")
+	insecure := os.Getenv("BACKEND_TLS_INSECURE") == "true"
+	if file == "" && !insecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if file != "" {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", file)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// clientIPResolver reads TRUSTED_PROXIES, a comma-separated list of CIDRs or
+// addresses whose X-Forwarded-For and X-Real-IP headers are believed.
+func clientIPResolver() (*clientip.Resolver, error) {
+	s := os.Getenv("TRUSTED_PROXIES")
+	if s == "" {
+		return nil, nil
+	}
+	trusted, err := clientip.ParsePrefixes(strings.Split(s, ","))
+	if err != nil {
+		return nil, err
+	}
+	return clientip.NewResolver(trusted...), nil
+}
+
 func balancerStrategy() balancer.Strategy {
-	s := os.Getenv("BALANCER_STRATEGY")
+	return parseStrategy(os.Getenv("BALANCER_STRATEGY"))
+}
+
+// serviceStrategies reads SERVICE_STRATEGIES, e.g.
+// "cache=consistent-hash,api=round-robin", giving those services their own
+// strategy.
+func serviceStrategies() map[string]balancer.Strategy {
+	m := make(map[string]balancer.Strategy)
+	for _, entry := range splitList(os.Getenv("SERVICE_STRATEGIES")) {
+		if service, strategy, ok := strings.Cut(entry, "="); ok {
+			m[strings.TrimSpace(service)] = parseStrategy(strings.TrimSpace(strategy))
+		}
+	}
+	return m
+}
+
+func parseStrategy(s string) balancer.Strategy {
 	switch s {
 	case "random":
 		return balancer.Random
@@ -89,11 +276,50 @@ func balancerStrategy() balancer.Strategy {
 		return balancer.WeightedRandom
 	case "ip-hash":
 		return balancer.IPHash
+	case "key-hash":
+		return balancer.KeyHash
+	case "failover":
+		return balancer.Failover
+	case "p2c":
+		return balancer.P2C
+	case "weighted-p2c":
+		return balancer.WeightedP2C
+	case "consistent-hash":
+		return balancer.ConsistentHash
+	case "p2c-ewma":
+		return balancer.PowerOfTwoChoices
+	case "maglev":
+		return balancer.Maglev
+	case "sticky-cookie":
+		return balancer.StickyCookie
 	default:
 		return balancer.RoundRobin
 	}
 }
 
+// dialTimeout reads DIAL_TIMEOUT in milliseconds; 0 keeps the transport default.
+func dialTimeout() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("DIAL_TIMEOUT"))
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// connectionPool reads BACKEND_MAX_IDLE_CONNS, BACKEND_MAX_IDLE_CONNS_PER_HOST,
+// BACKEND_MAX_CONNS_PER_HOST and BACKEND_IDLE_CONN_TIMEOUT (seconds). Unset
+// values keep circuitbreaker.DefaultPool.
+func connectionPool() circuitbreaker.Pool {
+	var p circuitbreaker.Pool
+	p.MaxIdleConns, _ = strconv.Atoi(os.Getenv("BACKEND_MAX_IDLE_CONNS"))
+	p.MaxIdleConnsPerHost, _ = strconv.Atoi(os.Getenv("BACKEND_MAX_IDLE_CONNS_PER_HOST"))
+	p.MaxConnsPerHost, _ = strconv.Atoi(os.Getenv("BACKEND_MAX_CONNS_PER_HOST"))
+	if sec, err := strconv.Atoi(os.Getenv("BACKEND_IDLE_CONN_TIMEOUT")); err == nil && sec > 0 {
+		p.IdleConnTimeout = time.Duration(sec) * time.Second
+	}
+	return p
+}
+
 func requestTimeout() time.Duration {
 	s := os.Getenv("REQUEST_TIMEOUT")
 	if s == "" {
@@ -115,5 +341,111 @@ func retryConfig() retry.Config {
 			cfg.MaxRetries = n
 		}
 	}
+	switch s := retry.Strategy(os.Getenv("RETRY_BACKOFF")); s {
+	case retry.FullJitter, retry.DecorrelatedJitter:
+		cfg.Strategy = s
+	}
+	if j, err := strconv.ParseFloat(os.Getenv("RETRY_JITTER"), 64); err == nil && j > 0 {
+		cfg.Jitter = j
+	}
+	for _, code := range strings.Split(os.Getenv("RETRY_STATUS"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(code)); err == nil {
+			cfg.RetryableStatusCodes = append(cfg.RetryableStatusCodes, n)
+		}
+	}
+	cfg.IdempotentOnly = os.Getenv("RETRY_IDEMPOTENT_ONLY") == "true"
+	cfg.RetryIdempotencyKey = os.Getenv("RETRY_IDEMPOTENCY_KEY") == "true"
+	if r, err := strconv.ParseFloat(os.Getenv("RETRY_BUDGET_RATIO"), 64); err == nil && r > 0 {
+		cfg.Budget.Ratio = r
+	}
+	if m, err := strconv.ParseFloat(os.Getenv("RETRY_BUDGET_MIN"), 64); err == nil && m > 0 {
+		cfg.Budget.MinPerSecond = m
+	}
+	if ms, err := strconv.Atoi(os.Getenv("RETRY_DEADLINE")); err == nil && ms > 0 {
+		cfg.Deadline = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.Atoi(os.Getenv("RETRY_MIN_ATTEMPT")); err == nil && ms > 0 {
+		cfg.MinAttempt = time.Duration(ms) * time.Millisecond
+	}
 	return cfg
 }
+
+// splitList splits a comma-separated list, dropping blanks around entries.
+// It returns nil for "".
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// failureStatus reads BREAKER_FAILURE_STATUS, a comma-separated list of
+// response statuses the circuit breaker counts as failures.
+func failureStatus() []int {
+	var codes []int
+	for _, code := range strings.Split(os.Getenv("BREAKER_FAILURE_STATUS"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(code)); err == nil {
+			codes = append(codes, n)
+		}
+	}
+	return codes
+}
+
+// rateLimit reads RATE_LIMIT (requests per second per client IP) and
+// RATE_LIMIT_BURST. An unset or invalid RATE_LIMIT disables limiting.
+func rateLimit() gateway.RateLimit {
+	var l gateway.RateLimit
+	if rate, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT"), 64); err == nil && rate > 0 {
+		l.Rate = rate
+	}
+	if burst, err := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST")); err == nil && burst > 0 {
+		l.Burst = burst
+	}
+	return l
+}
+
+// rootConfig reads ROOT: "status", "redirect:<location>" or
+// "service:<name>". Anything else routes "/" like other paths.
+func rootConfig() gateway.Root {
+	s := os.Getenv("ROOT")
+	switch {
+	case s == "status":
+		return gateway.Root{Mode: gateway.RootStatus}
+	case strings.HasPrefix(s, "redirect:"):
+		return gateway.Root{Mode: gateway.RootRedirect, Location: strings.TrimPrefix(s, "redirect:")}
+	case strings.HasPrefix(s, "service:"):
+		return gateway.Root{Mode: gateway.RootService, Service: strings.TrimPrefix(s, "service:")}
+	default:
+		return gateway.Root{}
+	}
+}
+
+// pathNormalization reads PATH_NORMALIZE: "leave", "strip" or "add" for the
+// trailing slash policy. Unset leaves paths alone entirely.
+func pathNormalization() *gateway.PathNormalization {
+	n := &gateway.PathNormalization{Redirect: os.Getenv("PATH_NORMALIZE_REDIRECT") == "true"}
+	switch os.Getenv("PATH_NORMALIZE") {
+	case "leave":
+	case "strip":
+		n.TrailingSlash = gateway.TrailingSlashStrip
+	case "add":
+		n.TrailingSlash = gateway.TrailingSlashAdd
+	default:
+		return nil
+	}
+	return n
+}
+
+func accessLogFormat() (gateway.AccessLogFormatter, bool) {
+	switch os.Getenv("ACCESS_LOG") {
+	case "common":
+		return gateway.CommonLogFormat, true
+	case "combined":
+		return gateway.CombinedLogFormat, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"kerberos/internal/registry"
+)
+
+func TestRegisterStatic(t *testing.T) {
+	reg := registry.New()
+	if err := registerStatic(reg, staticInstances); err != nil {
+		t.Fatalf("expected the built-in instances to register, got %v", err)
+	}
+	if got := len(reg.GetInstances("echo")); got != len(staticInstances) {
+		t.Errorf("expected %d echo instances, got %d", len(staticInstances), got)
+	}
+
+	reg = registry.New()
+	err := registerStatic(reg, []staticInstance{
+		{"users", registry.Instance{ID: "users-1", Addr: "http://localhost:9001"}},
+		{"users", registry.Instance{ID: "users-2", Addr: "ftp://localhost:9002"}},
+		{"users", registry.Instance{ID: "users-3", Addr: "http://localhost:9003"}},
+	})
+	if !errors.Is(err, registry.ErrInvalidInstance) {
+		t.Fatalf("expected an invalid instance error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `service "users" instance "users-2"`) {
+		t.Errorf("expected the error to name the invalid entry, got %v", err)
+	}
+	if got := len(reg.GetInstances("users")); got != 1 {
+		t.Errorf("expected registration to stop at the invalid entry, got %d instances", got)
+	}
+}